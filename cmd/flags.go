@@ -0,0 +1,16 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// addConfigFlags adds the flags that set the locations of the configuration files
+func addConfigFlags(flags *flag.FlagSet) {
+	flags.StringVar(&util.ConfigFile, "config", "", "path of the configuration file (default config.yaml in the working directory)")
+	flags.StringVar(&util.ReposFile, "repos", "", "path of the repos file (default repos.yaml in the working directory)")
+	flags.StringVar(&util.StacksFile, "stacks", "", "path of the stacks file (default stacks.yaml in the working directory)")
+	flags.StringVar(&util.GeneratorsFile, "generators", "", "path of the generators file (default generators.yaml in the working directory)")
+	flags.StringVar(&util.StacksDir, "stacks-dir", util.StacksDir, "directory of additional stacks files")
+}
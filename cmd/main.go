@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 
@@ -9,19 +11,73 @@ import (
 	"github.com/m-adawi/swarm-cd/web"
 )
 
-func init() {
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(validate(os.Args[2:]))
+		case "render":
+			os.Exit(render(os.Args[2:]))
+		case "help":
+			printUsage()
+			return
+		}
+	}
+	os.Exit(serve(os.Args[1:]))
+}
+
+// serve syncs stacks and serves the web UI until it fails,
+// returns the exit code of the command
+func serve(args []string) int {
+	flags := flag.NewFlagSet("swarm-cd", flag.ContinueOnError)
+	addConfigFlags(flags)
+	flags.Usage = func() {
+		printUsage()
+		fmt.Fprintln(flags.Output(), "\nFlags:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flags.Arg(0))
+		printUsage()
+		return 2
+	}
+
 	err := util.LoadConfigs()
 	handleInitError(err)
 	err = swarmcd.Init()
 	handleInitError(err)
-}
+	err = util.WatchConfigs(swarmcd.ReloadConfig)
+	handleInitError(err)
+
+	apiToken, err := util.Configs.ReadAPIToken()
+	handleInitError(err)
 
-func main() {
 	go swarmcd.Run()
-	if err := web.RunServer(util.Configs.Address); err != nil {
+	if err := web.RunServer(util.Configs.Address, apiToken); err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		return 1
 	}
+	return 0
+}
+
+func printUsage() {
+	fmt.Println(`Usage: swarm-cd [command] [flags]
+
+Commands:
+  validate    check the configuration files and list all problems
+  render      print the compose file SwarmCD would deploy for a stack
+  help        show this help
+
+Without a command, SwarmCD starts syncing stacks and serving the web UI.
+All commands accept --config, --repos, --stacks and --stacks-dir to set the
+locations of the configuration files. Any configuration option can be set
+from the environment with the SWARMCD_ prefix, like SWARMCD_UPDATE_INTERVAL.`)
 }
 
 func handleInitError(err error) {
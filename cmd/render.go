@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/m-adawi/swarm-cd/swarmcd"
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// render prints the compose file SwarmCD would deploy for
+// a stack, returns the exit code of the command
+func render(args []string) int {
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	localPath := flags.String("path", "", "read the stack's files from this checkout instead of its repo")
+	showSecrets := flags.Bool("show-secrets", false, "print the contents of decrypted secrets")
+	addConfigFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: swarm-cd render [flags] <stack>\n\nPrints the compose file SwarmCD would deploy for the stack.\n\nFlags:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	err := util.LoadConfigs()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	composeFile, decryptedFiles, err := swarmcd.RenderStack(flags.Arg(0), *localPath, !*showSecrets)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	output := string(composeFile)
+	if !*showSecrets {
+		// RenderStack redacts the values it decrypted, this also hides
+		// the secrets registered for the logs wherever else they appear
+		output = util.Redact(output)
+	}
+	fmt.Print(output)
+	printDecryptedFiles(decryptedFiles, *showSecrets)
+	return 0
+}
+
+// printDecryptedFiles prints decrypted files as comments,
+// so that the output is still a valid compose file
+func printDecryptedFiles(decryptedFiles map[string][]byte, showSecrets bool) {
+	filePaths := make([]string, 0, len(decryptedFiles))
+	for filePath := range decryptedFiles {
+		filePaths = append(filePaths, filePath)
+	}
+	sort.Strings(filePaths)
+	for _, filePath := range filePaths {
+		if !showSecrets {
+			fmt.Printf("# decrypted %s: <redacted>\n", filePath)
+			continue
+		}
+		fmt.Printf("# decrypted %s:\n", filePath)
+		for _, line := range strings.Split(strings.TrimRight(string(decryptedFiles[filePath]), "\n"), "\n") {
+			fmt.Printf("#   %s\n", line)
+		}
+	}
+}
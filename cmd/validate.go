@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// validate checks the configuration files in the working
+// directory, returns the exit code of the command
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	addConfigFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: swarm-cd validate [flags]\n\nChecks config, repos, stacks and generators files and lists all problems.\n\nFlags:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	problems := util.ValidateConfigFiles()
+	if len(problems) == 0 {
+		fmt.Println("configuration is valid")
+		return 0
+	}
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, problem)
+	}
+	fmt.Fprintf(os.Stderr, "found %d problem(s)\n", len(problems))
+	return 1
+}
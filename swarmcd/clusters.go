@@ -0,0 +1,198 @@
+package swarmcd
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/cli/cli/command"
+	"github.com/docker/cli/cli/flags"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// docker clients of the clusters in the config and the configs they were
+// created with. Stacks without a cluster use dockerCli, set up from the environment
+var clusterClis map[string]*command.DockerCli = map[string]*command.DockerCli{}
+var clusterConfigs map[string]util.ClusterConfig = map[string]util.ClusterConfig{}
+var clustersLock sync.RWMutex
+
+// initClusters creates a docker client for every cluster in the config.
+// Clients of clusters whose config did not change are kept
+func initClusters() error {
+	newClis := map[string]*command.DockerCli{}
+	newConfigs := map[string]util.ClusterConfig{}
+	clustersLock.RLock()
+	for clusterName, clusterConfig := range getConfig().Clusters {
+		if cli, ok := clusterClis[clusterName]; ok && clusterConfigs[clusterName] == *clusterConfig {
+			newClis[clusterName] = cli
+			newConfigs[clusterName] = *clusterConfig
+			continue
+		}
+		cli, err := newClusterCli(clusterName, clusterConfig)
+		if err != nil {
+			clustersLock.RUnlock()
+			return err
+		}
+		newClis[clusterName] = cli
+		newConfigs[clusterName] = *clusterConfig
+	}
+	clustersLock.RUnlock()
+
+	clustersLock.Lock()
+	defer clustersLock.Unlock()
+	for clusterName, cli := range clusterClis {
+		if newClis[clusterName] != cli {
+			cli.Client().Close()
+		}
+	}
+	clusterClis = newClis
+	clusterConfigs = newConfigs
+	return nil
+}
+
+func newClusterCli(clusterName string, clusterConfig *util.ClusterConfig) (*command.DockerCli, error) {
+	clientOptions := flags.NewClientOptions()
+	clientOptions.Context = clusterConfig.Context
+	if clusterConfig.Host != "" {
+		clientOptions.Hosts = []string{clusterConfig.Host}
+	}
+	if clusterConfig.TLSCACert != "" || clusterConfig.TLSCert != "" || clusterConfig.TLSKey != "" || clusterConfig.TLSVerify {
+		clientOptions.TLS = true
+		clientOptions.TLSVerify = clusterConfig.TLSVerify
+		clientOptions.TLSOptions = &tlsconfig.Options{
+			CAFile:   clusterConfig.TLSCACert,
+			CertFile: clusterConfig.TLSCert,
+			KeyFile:  clusterConfig.TLSKey,
+		}
+	}
+	cli, err := newDockerCli(clientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("could not create docker client of %s cluster: %w", clusterName, err)
+	}
+	return cli, nil
+}
+
+// newDockerCli creates a docker cli object that doesn't print
+// command outputs, errors are returned as objects
+func newDockerCli(clientOptions *flags.ClientOptions) (*command.DockerCli, error) {
+	nullFile, _ := os.Open("/dev/null")
+	defer nullFile.Close()
+	cli, err := command.NewDockerCli(command.WithOutputStream(nullFile), command.WithErrorStream(nullFile))
+	if err != nil {
+		return nil, fmt.Errorf("could not create a docker cli object: %w", err)
+	}
+	err = cli.Initialize(clientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize docker cli object: %w", err)
+	}
+	return cli, nil
+}
+
+// clusterCli returns the docker client of a cluster,
+// or the default one when cluster is empty
+func clusterCli(cluster string) (*command.DockerCli, error) {
+	if cluster == "" {
+		return dockerCli, nil
+	}
+	clustersLock.RLock()
+	defer clustersLock.RUnlock()
+	cli, ok := clusterClis[cluster]
+	if !ok {
+		return nil, fmt.Errorf("no such cluster: %s", cluster)
+	}
+	return cli, nil
+}
+
+// stackClusters returns the clusters a stack is deployed to,
+// a single empty one for the default cluster
+func stackClusters(stackConfig *util.StackConfig) []string {
+	if len(stackConfig.Cluster) == 0 {
+		return []string{""}
+	}
+	return stackConfig.Cluster
+}
+
+// clusterStackName identifies a stack of a cluster, stacks
+// deployed to several clusters are named stack@cluster
+func clusterStackName(stack string, cluster string) string {
+	if cluster == "" {
+		return stack
+	}
+	return stack + "@" + cluster
+}
+
+func splitClusterStackName(name string) (stack string, cluster string) {
+	stack, cluster, _ = strings.Cut(name, "@")
+	return
+}
+
+// prunedClusters returns the clusters to look for orphaned stacks in
+func prunedClusters() []string {
+	clustersLock.RLock()
+	defer clustersLock.RUnlock()
+	var clusters []string
+	for clusterName := range clusterClis {
+		clusters = append(clusters, clusterName)
+	}
+	sort.Strings(clusters)
+	usesDefault := len(clusters) == 0
+	stacksLock.RLock()
+	for _, swarmStack := range stacks {
+		usesDefault = usesDefault || swarmStack.cluster == ""
+	}
+	stacksLock.RUnlock()
+	if usesDefault {
+		clusters = append([]string{""}, clusters...)
+	}
+	return clusters
+}
+
+// newClusterStacks creates the stack for every cluster it is deployed to
+func newClusterStacks(stack string, stackConfigs map[string]*util.StackConfig) ([]*swarmStack, error) {
+	stackConfig := stackConfigs[stack]
+	clusters := stackClusters(stackConfig)
+	var clusterStacks []*swarmStack
+	for _, cluster := range clusters {
+		if _, ok := getConfig().Clusters[cluster]; cluster != "" && !ok {
+			return nil, fmt.Errorf("error initializing %s stack, no such cluster: %s", stack, cluster)
+		}
+		name := stack
+		if len(clusters) > 1 {
+			name = clusterStackName(stack, cluster)
+		}
+		swarmStack, err := newStackFromConfig(name, stackConfig)
+		if err != nil {
+			return nil, err
+		}
+		swarmStack.namespace = stack
+		swarmStack.cluster = cluster
+		swarmStack.dependsOn, err = clusterDependencies(stack, cluster, stackConfigs)
+		if err != nil {
+			return nil, err
+		}
+		clusterStacks = append(clusterStacks, swarmStack)
+	}
+	return clusterStacks, nil
+}
+
+// clusterDependencies returns the stacks a stack deployed to cluster depends on.
+// Dependencies deployed to several clusters are the ones of the same cluster
+func clusterDependencies(stack string, cluster string, stackConfigs map[string]*util.StackConfig) ([]string, error) {
+	var dependencies []string
+	for _, dependency := range stackConfigs[stack].DependsOn {
+		dependencyConfig, ok := stackConfigs[dependency]
+		if !ok || len(dependencyConfig.Cluster) <= 1 {
+			dependencies = append(dependencies, dependency)
+			continue
+		}
+		if !slices.Contains(dependencyConfig.Cluster, cluster) {
+			return nil, fmt.Errorf("error initializing %s stack, dependency %s is not deployed to cluster %q", stack, dependency, cluster)
+		}
+		dependencies = append(dependencies, clusterStackName(dependency, cluster))
+	}
+	return dependencies, nil
+}
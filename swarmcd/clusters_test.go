@@ -0,0 +1,40 @@
+package swarmcd
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// Dependencies deployed to several clusters resolve to the one of the same cluster
+func TestClusterDependencies(t *testing.T) {
+	stackConfigs := map[string]*util.StackConfig{
+		"app":    {DependsOn: []string{"db", "proxy"}, Cluster: []string{"prod", "staging"}},
+		"db":     {Cluster: []string{"prod", "staging"}},
+		"proxy":  {Cluster: []string{"edge"}},
+		"report": {DependsOn: []string{"db"}, Cluster: []string{"edge"}},
+	}
+	dependencies, err := clusterDependencies("app", "staging", stackConfigs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !slices.Equal(dependencies, []string{"db@staging", "proxy"}) {
+		t.Errorf("unexpected dependencies: %v", dependencies)
+	}
+	_, err = clusterDependencies("report", "edge", stackConfigs)
+	if err == nil {
+		t.Errorf("expected an error for a dependency missing from the cluster")
+	}
+}
+
+func TestSplitClusterStackName(t *testing.T) {
+	stackName, cluster := splitClusterStackName(clusterStackName("app", "prod"))
+	if stackName != "app" || cluster != "prod" {
+		t.Errorf("unexpected stack %q and cluster %q", stackName, cluster)
+	}
+	stackName, cluster = splitClusterStackName(clusterStackName("app", ""))
+	if stackName != "app" || cluster != "" {
+		t.Errorf("unexpected stack %q and cluster %q", stackName, cluster)
+	}
+}
@@ -0,0 +1,62 @@
+package swarmcd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+// resolveImageDigests resolves the image of every service to the digest
+// it currently points to, and pins the digests in the compose map if enabled.
+// Returns a map of images to digests
+func (swarmStack *swarmStack) resolveImageDigests(ctx context.Context, composeMap map[string]any) (map[string]string, error) {
+	services, ok := composeMap["services"].(map[string]any)
+	if !ok {
+		return nil, nil
+	}
+	digests := map[string]string{}
+	for serviceName, service := range services {
+		serviceMap, ok := service.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid compose file: %s service must be a map", serviceName)
+		}
+		image, ok := serviceMap["image"].(string)
+		if !ok {
+			continue
+		}
+		digest, ok := digests[image]
+		if !ok {
+			var err error
+			digest, err = resolveImageDigest(ctx, image)
+			if err != nil {
+				if swarmStack.pinImageDigests {
+					return nil, fmt.Errorf("could not pin image of service %s in stack %s: %w", serviceName, swarmStack.name, err)
+				}
+				logger.Warn(err.Error(), slog.String("stack", swarmStack.name), slog.String("service", serviceName))
+			}
+			digests[image] = digest
+		}
+		if swarmStack.pinImageDigests && !strings.Contains(image, "@") {
+			serviceMap["image"] = image + "@" + digest
+		}
+	}
+	return digests, nil
+}
+
+func resolveImageDigest(ctx context.Context, image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image %s: %w", image, err)
+	}
+	if canonical, ok := named.(reference.Canonical); ok {
+		return canonical.Digest().String(), nil
+	}
+	tag := "latest"
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	return registryClient.ResolveDigest(ctx, named.Name(), tag)
+}
@@ -0,0 +1,53 @@
+package swarmcd
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Images already pinned to a digest are recorded without
+// contacting the registry and are not pinned again
+func TestResolvePinnedImageDigests(t *testing.T) {
+	repo := newTestRepo("test")
+	stack := newSwarmStack("test", repo, "main", "docker-compose.yaml", nil, "", false)
+	stack.pinImageDigests = true
+	digest := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	image := "registry.example.com/team/app:1.0.0@" + digest
+	composeMap := map[string]any{
+		"services": map[string]any{
+			"app": map[string]any{"image": image},
+		},
+	}
+	images, err := stack.resolveImageDigests(context.Background(), composeMap)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if images[image] != digest {
+		t.Errorf("unexpected digests: %v", images)
+	}
+	if composeMap["services"].(map[string]any)["app"].(map[string]any)["image"] != image {
+		t.Errorf("pinned image was changed")
+	}
+}
+
+// Only deployments that changed the revision or images are recorded
+func TestRecordDeployment(t *testing.T) {
+	status := &StackStatus{}
+	images := map[string]string{"app:1.0.0": "sha256:1234"}
+	recordDeployment(status, Deployment{Revision: "aaaaaaaa", DeployedAt: time.Now(), Images: images})
+	recordDeployment(status, Deployment{Revision: "aaaaaaaa", DeployedAt: time.Now(), Images: images})
+	if len(status.Deployments) != 1 {
+		t.Errorf("unexpected number of deployments: %d", len(status.Deployments))
+	}
+	recordDeployment(status, Deployment{Revision: "aaaaaaaa", DeployedAt: time.Now(), Images: map[string]string{"app:1.0.0": "sha256:5678"}})
+	if len(status.Deployments) != 2 || status.Deployments[0].Images["app:1.0.0"] != "sha256:5678" {
+		t.Errorf("unexpected deployments: %v", status.Deployments)
+	}
+	for i := 0; i < deploymentHistorySize+5; i++ {
+		recordDeployment(status, Deployment{Revision: string(rune('a' + i)), DeployedAt: time.Now()})
+	}
+	if len(status.Deployments) != deploymentHistorySize {
+		t.Errorf("unexpected number of deployments: %d", len(status.Deployments))
+	}
+}
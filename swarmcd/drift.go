@@ -0,0 +1,208 @@
+package swarmcd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/cli/cli/command"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// short names that can be used in ignore_differences
+var driftFieldAliases = map[string]string{
+	"replicas": "Mode.Replicated.Replicas",
+	"image":    "TaskTemplate.ContainerSpec.Image",
+	"env":      "TaskTemplate.ContainerSpec.Env",
+	"labels":   "Labels",
+}
+
+// fields whose values can hold secrets, like env values rendered from secret
+// providers or decrypted by sops. Their drift is reported without the values
+var sensitiveDriftFields = []string{
+	"TaskTemplate.ContainerSpec.Env",
+	"TaskTemplate.ContainerSpec.Secrets",
+	"TaskTemplate.ContainerSpec.Configs",
+}
+
+const redactedDriftValue = util.RedactedValue
+
+// FieldDrift is a difference between the deployed
+// and the live spec of a stack service
+type FieldDrift struct {
+	Service string
+	Field   string
+	Desired string
+	Live    string
+}
+
+// recordDesiredState stores the specs of the stack's services right after
+// deploying it, to compare them with the live specs later on
+func (swarmStack *swarmStack) recordDesiredState(ctx context.Context) error {
+	cli, err := swarmStack.cli()
+	if err != nil {
+		return err
+	}
+	specs, err := listStackServiceSpecs(ctx, cli, swarmStack.namespace)
+	if err != nil {
+		return fmt.Errorf("could not record deployed services of stack %s: %w", swarmStack.name, err)
+	}
+	swarmStack.desiredSpecs = specs
+	return nil
+}
+
+// detectDrift compares the live specs of the stack's services
+// with the ones recorded at the last deployment
+func (swarmStack *swarmStack) detectDrift(ctx context.Context) ([]FieldDrift, error) {
+	if swarmStack.desiredSpecs == nil {
+		return nil, nil
+	}
+	cli, err := swarmStack.cli()
+	if err != nil {
+		return nil, err
+	}
+	liveSpecs, err := listStackServiceSpecs(ctx, cli, swarmStack.namespace)
+	if err != nil {
+		return nil, fmt.Errorf("could not list services of stack %s to detect drift: %w", swarmStack.name, err)
+	}
+	return compareServiceSpecs(swarmStack.desiredSpecs, liveSpecs, swarmStack.ignoreDifferences)
+}
+
+func listStackServiceSpecs(ctx context.Context, cli *command.DockerCli, stackName string) (map[string]swarm.ServiceSpec, error) {
+	services, err := cli.Client().ServiceList(ctx, types.ServiceListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", stackNamespaceLabel+"="+stackName)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	specs := map[string]swarm.ServiceSpec{}
+	for _, service := range services {
+		specs[service.Spec.Name] = service.Spec
+	}
+	return specs, nil
+}
+
+func compareServiceSpecs(desiredSpecs map[string]swarm.ServiceSpec, liveSpecs map[string]swarm.ServiceSpec, ignoreDifferences []string) ([]FieldDrift, error) {
+	var drift []FieldDrift
+	for serviceName, desiredSpec := range desiredSpecs {
+		liveSpec, ok := liveSpecs[serviceName]
+		if !ok {
+			drift = append(drift, FieldDrift{Service: serviceName, Desired: "present", Live: "missing"})
+			continue
+		}
+		desiredFields, err := flattenSpec(desiredSpec)
+		if err != nil {
+			return nil, err
+		}
+		liveFields, err := flattenSpec(liveSpec)
+		if err != nil {
+			return nil, err
+		}
+		fields := map[string]bool{}
+		for field := range desiredFields {
+			fields[field] = true
+		}
+		for field := range liveFields {
+			fields[field] = true
+		}
+		for field := range fields {
+			if desiredFields[field] == liveFields[field] || isIgnoredField(field, ignoreDifferences) {
+				continue
+			}
+			drift = append(drift, FieldDrift{
+				Service: serviceName,
+				Field:   field,
+				Desired: driftValue(field, desiredFields[field]),
+				Live:    driftValue(field, liveFields[field]),
+			})
+		}
+	}
+	for serviceName := range liveSpecs {
+		if _, ok := desiredSpecs[serviceName]; !ok {
+			drift = append(drift, FieldDrift{Service: serviceName, Desired: "missing", Live: "present"})
+		}
+	}
+	sort.Slice(drift, func(i, j int) bool {
+		if drift[i].Service != drift[j].Service {
+			return drift[i].Service < drift[j].Service
+		}
+		return drift[i].Field < drift[j].Field
+	})
+	return drift, nil
+}
+
+// flattenSpec maps the dotted path of every leaf field of a spec to its value
+func flattenSpec(spec swarm.ServiceSpec) (map[string]string, error) {
+	specBytes, err := json.Marshal(spec)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode spec of service %s: %w", spec.Name, err)
+	}
+	var specMap any
+	err = json.Unmarshal(specBytes, &specMap)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode spec of service %s: %w", spec.Name, err)
+	}
+	fields := map[string]string{}
+	flattenValue("", specMap, fields)
+	return fields, nil
+}
+
+func flattenValue(prefix string, value any, fields map[string]string) {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, child := range value {
+			childPrefix := key
+			if prefix != "" {
+				childPrefix = prefix + "." + key
+			}
+			flattenValue(childPrefix, child, fields)
+		}
+	case []any:
+		for i, child := range value {
+			flattenValue(fmt.Sprintf("%s[%d]", prefix, i), child, fields)
+		}
+	default:
+		fields[prefix] = fmt.Sprint(value)
+	}
+}
+
+// driftValue returns the value of a field as shown in the status. Values of
+// sensitive fields are redacted, env variables keep their name
+func driftValue(field string, value string) string {
+	if value == "" {
+		return value
+	}
+	for _, sensitiveField := range sensitiveDriftFields {
+		if !isFieldOf(field, sensitiveField) {
+			continue
+		}
+		if name, _, ok := strings.Cut(value, "="); ok && isFieldOf(field, driftFieldAliases["env"]) {
+			return name + "=" + redactedDriftValue
+		}
+		return redactedDriftValue
+	}
+	return util.Redact(value)
+}
+
+// isIgnoredField reports whether a field, or one of its parents, is ignored
+func isIgnoredField(field string, ignoreDifferences []string) bool {
+	for _, ignored := range ignoreDifferences {
+		if alias, ok := driftFieldAliases[ignored]; ok {
+			ignored = alias
+		}
+		if isFieldOf(field, ignored) {
+			return true
+		}
+	}
+	return false
+}
+
+// isFieldOf reports whether a field is parent, or one of its children
+func isFieldOf(field string, parent string) bool {
+	return field == parent || strings.HasPrefix(field, parent+".") || strings.HasPrefix(field, parent+"[")
+}
@@ -0,0 +1,99 @@
+package swarmcd
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+func replicatedSpec(name string, image string, replicas uint64) swarm.ServiceSpec {
+	return swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: name},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: &swarm.ContainerSpec{Image: image, Env: []string{"A=1"}},
+		},
+		Mode: swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}},
+	}
+}
+
+func TestCompareServiceSpecs(t *testing.T) {
+	desired := map[string]swarm.ServiceSpec{
+		"app_web": replicatedSpec("app_web", "nginx:1.25", 2),
+		"app_db":  replicatedSpec("app_db", "postgres:16", 1),
+	}
+	live := map[string]swarm.ServiceSpec{
+		"app_web":    replicatedSpec("app_web", "nginx:1.26", 5),
+		"app_worker": replicatedSpec("app_worker", "worker:1", 1),
+	}
+
+	drift, err := compareServiceSpecs(desired, live, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []FieldDrift{
+		{Service: "app_db", Desired: "present", Live: "missing"},
+		{Service: "app_web", Field: "Mode.Replicated.Replicas", Desired: "2", Live: "5"},
+		{Service: "app_web", Field: "TaskTemplate.ContainerSpec.Image", Desired: "nginx:1.25", Live: "nginx:1.26"},
+		{Service: "app_worker", Desired: "missing", Live: "present"},
+	}
+	if len(drift) != len(expected) {
+		t.Fatalf("expected %d differences, got %v", len(expected), drift)
+	}
+	for i := range expected {
+		if drift[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], drift[i])
+		}
+	}
+
+	drift, err = compareServiceSpecs(desired, live, []string{"replicas", "TaskTemplate.ContainerSpec"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(drift) != 2 {
+		t.Errorf("expected only added and removed services, got %v", drift)
+	}
+}
+
+func TestIsIgnoredField(t *testing.T) {
+	ignored := []string{"TaskTemplate.ContainerSpec.Env", "Labels"}
+	if !isIgnoredField("TaskTemplate.ContainerSpec.Env[0]", ignored) {
+		t.Errorf("expected list items of ignored fields to be ignored")
+	}
+	if !isIgnoredField("Labels.com.example", ignored) {
+		t.Errorf("expected children of ignored fields to be ignored")
+	}
+	if isIgnoredField("LabelsExtra", ignored) {
+		t.Errorf("expected fields sharing a prefix not to be ignored")
+	}
+}
+
+// Env values, secrets and configs that drifted are not shown in the status
+func TestDriftRedactsSensitiveValues(t *testing.T) {
+	desired := replicatedSpec("app_web", "nginx:1.25", 1)
+	desired.TaskTemplate.ContainerSpec.Env = []string{"DB_PASSWORD=deployed-hunter22"}
+	desired.TaskTemplate.ContainerSpec.Secrets = []*swarm.SecretReference{{SecretName: "app-db-password-12345678"}}
+	live := replicatedSpec("app_web", "nginx:1.25", 1)
+	live.TaskTemplate.ContainerSpec.Env = []string{"DB_PASSWORD=live-hunter22"}
+	drift, err := compareServiceSpecs(map[string]swarm.ServiceSpec{"app_web": desired}, map[string]swarm.ServiceSpec{"app_web": live}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	stackStatus = map[string]*StackStatus{"app": {}}
+	defer func() { stackStatus = map[string]*StackStatus{} }()
+	updateStatus("app", func(status *StackStatus) { status.Drift = drift })
+
+	statusBytes, err := json.Marshal(GetStackStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"hunter22", "app-db-password"} {
+		if strings.Contains(string(statusBytes), secret) {
+			t.Errorf("expected %s not to be in the status, got %s", secret, statusBytes)
+		}
+	}
+	if len(drift) == 0 || drift[0].Desired != "DB_PASSWORD=<redacted>" || drift[0].Live != "DB_PASSWORD=<redacted>" {
+		t.Errorf("expected the env variable to keep its name, got %v", drift)
+	}
+}
@@ -0,0 +1,206 @@
+package swarmcd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"text/template"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+const defaultGeneratorNameTemplate = "{{ .DirName }}"
+
+// names that docker accepts for stacks. It also keeps generated
+// stacks from targeting another cluster with a stack@cluster name
+var stackNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// stackGenerator creates a stack for every
+// file in a repo that matches a glob
+type stackGenerator struct {
+	name               string
+	repo               *stackRepo
+	branch             string
+	glob               string
+	nameTemplate       *template.Template
+	valuesFileTemplate *template.Template
+	sopsFileTemplates  []*template.Template
+	stackConfig        util.StackConfig
+	// stacks generated by the last successful run, kept when the repo can't be read
+	stackConfigs map[string]*util.StackConfig
+}
+
+// data available to the templates of generated stacks
+type generatorMatch struct {
+	// path of the matching file, relative to the repo root
+	Path string
+	// directory of the matching file, and its name
+	Dir     string
+	DirName string
+}
+
+var generators []*stackGenerator
+
+func initGenerators() error {
+	newGenerators := []*stackGenerator{}
+	generatorNames := make([]string, 0, len(getConfig().GeneratorConfigs))
+	for generatorName := range getConfig().GeneratorConfigs {
+		generatorNames = append(generatorNames, generatorName)
+	}
+	sort.Strings(generatorNames)
+	for _, generatorName := range generatorNames {
+		generator, err := newStackGenerator(generatorName, getConfig().GeneratorConfigs[generatorName])
+		if err != nil {
+			return err
+		}
+		newGenerators = append(newGenerators, generator)
+	}
+	generators = newGenerators
+	return nil
+}
+
+func newStackGenerator(name string, generatorConfig *util.GeneratorConfig) (*stackGenerator, error) {
+	repo, ok := repos[generatorConfig.Repo]
+	if !ok {
+		return nil, fmt.Errorf("error initializing %s generator, no such repo: %s", name, generatorConfig.Repo)
+	}
+	if generatorConfig.Glob == "" {
+		return nil, fmt.Errorf("error initializing %s generator: glob is required", name)
+	}
+	if _, err := filepath.Match(generatorConfig.Glob, ""); err != nil {
+		return nil, fmt.Errorf("error initializing %s generator: invalid glob %q: %w", name, generatorConfig.Glob, err)
+	}
+	nameTemplate := generatorConfig.Template.Name
+	if nameTemplate == "" {
+		nameTemplate = defaultGeneratorNameTemplate
+	}
+	generator := &stackGenerator{
+		name:        name,
+		repo:        repo,
+		branch:      generatorConfig.Branch,
+		glob:        generatorConfig.Glob,
+		stackConfig: generatorConfig.Template.StackConfig,
+	}
+	var err error
+	generator.nameTemplate, err = parseGeneratorTemplate(name, "name", nameTemplate)
+	if err != nil {
+		return nil, err
+	}
+	generator.valuesFileTemplate, err = parseGeneratorTemplate(name, "values_file", generatorConfig.Template.ValuesFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, sopsFile := range generatorConfig.Template.SopsFiles {
+		sopsFileTemplate, err := parseGeneratorTemplate(name, "sops_files", sopsFile)
+		if err != nil {
+			return nil, err
+		}
+		generator.sopsFileTemplates = append(generator.sopsFileTemplates, sopsFileTemplate)
+	}
+	return generator, nil
+}
+
+func parseGeneratorTemplate(generatorName string, field string, text string) (*template.Template, error) {
+	parsedTemplate, err := template.New(field).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing %s generator: invalid %s template: %w", generatorName, field, err)
+	}
+	return parsedTemplate, nil
+}
+
+// addGeneratedStacks adds the stacks of all generators to stackConfigs.
+// Generated stacks never replace stacks that are already defined
+func addGeneratedStacks(stackConfigs map[string]*util.StackConfig) {
+	for _, generator := range generators {
+		generated, err := generator.generateStackConfigs()
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		for stack, stackConfig := range generated {
+			if _, ok := stackConfigs[stack]; ok {
+				logger.Error(fmt.Sprintf("%s generator created %s stack which is already defined, ignoring it", generator.name, stack))
+				continue
+			}
+			stackConfigs[stack] = stackConfig
+		}
+	}
+}
+
+// generateStackConfigs pulls the generator's repo and creates a stack for
+// every matching file. If that fails, the stacks of the last run are returned
+func (generator *stackGenerator) generateStackConfigs() (map[string]*util.StackConfig, error) {
+	generator.repo.lock.Lock()
+	defer generator.repo.lock.Unlock()
+	ctx, cancel := withTimeout(context.Background(), getConfig().Timeouts.Pull)
+	defer cancel()
+	_, err := generator.repo.pullChanges(ctx, generator.branch)
+	if err != nil {
+		return generator.stackConfigs, fmt.Errorf("could not run %s generator: %w", generator.name, err)
+	}
+	matches, err := filepath.Glob(filepath.Join(generator.repo.path, generator.glob))
+	if err != nil {
+		return generator.stackConfigs, fmt.Errorf("could not run %s generator: %w", generator.name, err)
+	}
+	stackConfigs := map[string]*util.StackConfig{}
+	for _, match := range matches {
+		relativePath, err := filepath.Rel(generator.repo.path, match)
+		if err != nil {
+			return generator.stackConfigs, fmt.Errorf("could not run %s generator: %w", generator.name, err)
+		}
+		stack, stackConfig, err := generator.generateStackConfig(filepath.ToSlash(relativePath))
+		if err != nil {
+			return generator.stackConfigs, fmt.Errorf("could not run %s generator: %w", generator.name, err)
+		}
+		if _, ok := stackConfigs[stack]; ok {
+			return generator.stackConfigs, fmt.Errorf("could not run %s generator: more than one file generates %s stack", generator.name, stack)
+		}
+		stackConfigs[stack] = stackConfig
+	}
+	generator.stackConfigs = stackConfigs
+	return stackConfigs, nil
+}
+
+func (generator *stackGenerator) generateStackConfig(composeFile string) (string, *util.StackConfig, error) {
+	dir := path.Dir(composeFile)
+	match := generatorMatch{Path: composeFile, Dir: dir, DirName: path.Base(dir)}
+	stack, err := executeGeneratorTemplate(generator.nameTemplate, match)
+	if err != nil {
+		return "", nil, err
+	}
+	if stack == "" {
+		return "", nil, fmt.Errorf("name of the stack generated for %s is empty", composeFile)
+	}
+	if !stackNameRegex.MatchString(stack) {
+		return "", nil, fmt.Errorf("name of the stack generated for %s is invalid: %q", composeFile, stack)
+	}
+	stackConfig := generator.stackConfig
+	stackConfig.Repo = generator.repo.name
+	stackConfig.Branch = generator.branch
+	stackConfig.ComposeFile = composeFile
+	stackConfig.ValuesFile, err = executeGeneratorTemplate(generator.valuesFileTemplate, match)
+	if err != nil {
+		return "", nil, err
+	}
+	stackConfig.SopsFiles = nil
+	for _, sopsFileTemplate := range generator.sopsFileTemplates {
+		sopsFile, err := executeGeneratorTemplate(sopsFileTemplate, match)
+		if err != nil {
+			return "", nil, err
+		}
+		stackConfig.SopsFiles = append(stackConfig.SopsFiles, sopsFile)
+	}
+	return stack, &stackConfig, nil
+}
+
+func executeGeneratorTemplate(generatorTemplate *template.Template, match generatorMatch) (string, error) {
+	var buffer bytes.Buffer
+	err := generatorTemplate.Execute(&buffer, match)
+	if err != nil {
+		return "", fmt.Errorf("could not render %s template for %s: %w", generatorTemplate.Name(), match.Path, err)
+	}
+	return buffer.String(), nil
+}
@@ -0,0 +1,79 @@
+package swarmcd
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+func TestGenerateStackConfig(t *testing.T) {
+	repos["apps"] = &stackRepo{name: "apps", path: "apps", lock: &sync.Mutex{}}
+	defer delete(repos, "apps")
+	generator, err := newStackGenerator("apps", &util.GeneratorConfig{
+		Repo:   "apps",
+		Branch: "main",
+		Glob:   "stacks/*/compose.yaml",
+		Template: util.GeneratorTemplate{
+			Name: "app-{{ .DirName }}",
+			StackConfig: util.StackConfig{
+				ValuesFile: "{{ .Dir }}/values.yaml",
+				SopsFiles:  []string{"{{ .Dir }}/secrets.yaml"},
+				SyncPolicy: "manual",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	stack, stackConfig, err := generator.generateStackConfig("stacks/nginx/compose.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if stack != "app-nginx" {
+		t.Errorf("unexpected stack name %s", stack)
+	}
+	if stackConfig.Repo != "apps" || stackConfig.Branch != "main" || stackConfig.ComposeFile != "stacks/nginx/compose.yaml" {
+		t.Errorf("unexpected stack source: %+v", stackConfig)
+	}
+	if stackConfig.ValuesFile != "stacks/nginx/values.yaml" {
+		t.Errorf("unexpected values file %s", stackConfig.ValuesFile)
+	}
+	if len(stackConfig.SopsFiles) != 1 || stackConfig.SopsFiles[0] != "stacks/nginx/secrets.yaml" {
+		t.Errorf("unexpected sops files %v", stackConfig.SopsFiles)
+	}
+	if stackConfig.SyncPolicy != "manual" {
+		t.Errorf("expected other options to be copied, got sync policy %q", stackConfig.SyncPolicy)
+	}
+}
+
+func TestNewStackGeneratorInvalidTemplate(t *testing.T) {
+	repos["apps"] = &stackRepo{name: "apps", path: "apps", lock: &sync.Mutex{}}
+	defer delete(repos, "apps")
+	_, err := newStackGenerator("apps", &util.GeneratorConfig{
+		Repo:     "apps",
+		Glob:     "stacks/*/compose.yaml",
+		Template: util.GeneratorTemplate{Name: "{{ .DirName"},
+	})
+	if err == nil {
+		t.Errorf("expected an error for an invalid name template")
+	}
+}
+
+func TestGenerateStackConfigInvalidName(t *testing.T) {
+	repos["apps"] = &stackRepo{name: "apps", path: "apps", lock: &sync.Mutex{}}
+	defer delete(repos, "apps")
+	generator, err := newStackGenerator("apps", &util.GeneratorConfig{
+		Repo:     "apps",
+		Glob:     "stacks/*/compose.yaml",
+		Template: util.GeneratorTemplate{Name: "{{ .DirName }}"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, composeFile := range []string{"stacks/web@production/compose.yaml", "stacks/.web/compose.yaml", "stacks/my web/compose.yaml"} {
+		if _, _, err := generator.generateStackConfig(composeFile); err == nil {
+			t.Errorf("expected an error for the stack generated for %s", composeFile)
+		}
+	}
+}
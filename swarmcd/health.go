@@ -0,0 +1,71 @@
+package swarmcd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/cli/cli/command"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// interval between two checks of a stack's services
+const healthCheckInterval = 5 * time.Second
+
+// waitForStackHealthy waits for the services of a stack to run all their
+// tasks, for at most timeout unless it is zero, or until ctx is done
+func waitForStackHealthy(ctx context.Context, cli *command.DockerCli, stackName string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		healthy, err := isStackHealthy(ctx, cli, stackName)
+		if err != nil {
+			return fmt.Errorf("could not check health of stack %s: %w", stackName, err)
+		}
+		if healthy {
+			return nil
+		}
+		if timeout > 0 && time.Now().After(deadline) {
+			return fmt.Errorf("stack %s did not become healthy within %s", stackName, timeout)
+		}
+		select {
+		case <-time.After(healthCheckInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for stack %s to become healthy: %w", stackName, ctx.Err())
+		}
+	}
+}
+
+func isStackHealthy(ctx context.Context, cli *command.DockerCli, stackName string) (bool, error) {
+	services, err := cli.Client().ServiceList(ctx, types.ServiceListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", stackNamespaceLabel+"="+stackName)),
+		Status:  true,
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(services) == 0 {
+		return false, nil
+	}
+	for _, service := range services {
+		if !isServiceHealthy(service) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func isServiceHealthy(service swarm.Service) bool {
+	// jobs run to completion and never stay running
+	if service.Spec.Mode.ReplicatedJob != nil || service.Spec.Mode.GlobalJob != nil {
+		return true
+	}
+	if service.UpdateStatus != nil && service.UpdateStatus.State == swarm.UpdateStateUpdating {
+		return false
+	}
+	if service.ServiceStatus == nil {
+		return false
+	}
+	return service.ServiceStatus.RunningTasks >= service.ServiceStatus.DesiredTasks
+}
@@ -0,0 +1,223 @@
+package swarmcd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/docker/cli/cli/command"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// top level compose keys copied as is into hook stacks
+var hookStackKeys = []string{"version", "networks", "volumes"}
+
+// extractHooks removes the hook services from the compose map and
+// returns a compose map for each of them, to be deployed as its own stack
+func (swarmStack *swarmStack) extractHooks(composeMap map[string]any) (map[string]map[string]any, error) {
+	hookNames := append(append([]string{}, swarmStack.preDeployHooks...), swarmStack.postDeployHooks...)
+	if len(hookNames) == 0 {
+		return nil, nil
+	}
+	services, ok := composeMap["services"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid compose file: services must be a map")
+	}
+	hooks := map[string]map[string]any{}
+	for _, hookName := range hookNames {
+		// the same hook can run before and after deploying
+		if _, ok := hooks[hookName]; ok {
+			continue
+		}
+		service, ok := services[hookName].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("hook %s of stack %s is not a service in the compose file", hookName, swarmStack.name)
+		}
+		hookCompose, err := newHookCompose(composeMap, hookName, service)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hook %s of stack %s: %w", hookName, swarmStack.name, err)
+		}
+		hooks[hookName] = hookCompose
+		delete(services, hookName)
+	}
+	return hooks, nil
+}
+
+func newHookCompose(composeMap map[string]any, hookName string, service map[string]any) (map[string]any, error) {
+	deploy, ok := service["deploy"].(map[string]any)
+	if !ok {
+		deploy = map[string]any{}
+		service["deploy"] = deploy
+	}
+	switch deploy["mode"] {
+	case nil:
+		deploy["mode"] = "replicated-job"
+	case "replicated-job", "global-job":
+	default:
+		return nil, fmt.Errorf("deploy mode must be replicated-job or global-job, got %v", deploy["mode"])
+	}
+	// a failed hook fails the sync instead of being retried
+	if _, ok := deploy["restart_policy"]; !ok {
+		deploy["restart_policy"] = map[string]any{"condition": "none"}
+	}
+
+	hookCompose := map[string]any{
+		"services": map[string]any{hookName: service},
+	}
+	for _, key := range hookStackKeys {
+		if value, ok := composeMap[key]; ok {
+			hookCompose[key] = value
+		}
+	}
+	for _, objectType := range []string{"configs", "secrets"} {
+		objects, ok := composeMap[objectType].(map[string]any)
+		if !ok {
+			continue
+		}
+		hookObjects := map[string]any{}
+		for _, objectName := range referencedObjects(service, objectType) {
+			objectMap, ok := objects[objectName].(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s %s is not defined", objectType, objectName)
+			}
+			hookObject := map[string]any{}
+			for key, value := range objectMap {
+				hookObject[key] = value
+			}
+			// the rotated name is owned by the main stack, the hook stack
+			// creates its own copy, prefixed with the hook name. It keeps the
+			// hash of the content, so that objects left by an earlier run
+			// never clash with ones of the same name but other content
+			if isExternal, _ := objectMap["external"].(bool); !isExternal {
+				if name, ok := objectMap["name"].(string); ok {
+					hookObject["name"] = hookName + "-" + name
+				}
+			}
+			hookObjects[objectName] = hookObject
+		}
+		if len(hookObjects) > 0 {
+			hookCompose[objectType] = hookObjects
+		}
+	}
+	return hookCompose, nil
+}
+
+// referencedObjects returns the names of the configs or secrets used by a service,
+// which are listed either by name or as a map with a source
+func referencedObjects(service map[string]any, objectType string) []string {
+	references, _ := service[objectType].([]any)
+	var objectNames []string
+	for _, reference := range references {
+		switch reference := reference.(type) {
+		case string:
+			objectNames = append(objectNames, reference)
+		case map[string]any:
+			if source, ok := reference["source"].(string); ok {
+				objectNames = append(objectNames, source)
+			}
+		}
+	}
+	return objectNames
+}
+
+func (swarmStack *swarmStack) runHooks(ctx context.Context, hookNames []string, hooks map[string]map[string]any) error {
+	for _, hookName := range hookNames {
+		err := checkLeadership(ctx)
+		if err != nil {
+			return err
+		}
+		err = swarmStack.runHook(ctx, hookName, hooks[hookName])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (swarmStack *swarmStack) runHook(ctx context.Context, hookName string, hookCompose map[string]any) (err error) {
+	hookStackName := swarmStack.namespace + "-hook-" + hookName
+	log := logger.With(
+		slog.String("stack", swarmStack.name),
+		slog.String("hook", hookName),
+	)
+	cli, err := swarmStack.deployCli()
+	if err != nil {
+		return err
+	}
+	// a hook stack left by a crash, a failed cleanup or another leader would
+	// not run the job again when deployed unchanged, and its completed tasks
+	// would pass for the new run
+	log.Debug("removing hook stack left by an earlier run...")
+	err = removeStackAndWait(ctx, cli, hookStackName)
+	if err != nil {
+		return fmt.Errorf("could not remove earlier run of hook %s of stack %s: %w", hookName, swarmStack.name, err)
+	}
+	log.Info("running hook...")
+	// relative config and secret files resolve like the ones of the stack
+	err = deployCompose(ctx, cli, hookCompose, swarmStack.composeDir(), hookStackName)
+	if err != nil {
+		return fmt.Errorf("could not run hook %s of stack %s: %w", hookName, swarmStack.name, err)
+	}
+	defer func() {
+		// the hook is removed even if the update timed out
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+		defer cancel()
+		removeErr := removeStack(cleanupCtx, cli, hookStackName)
+		if removeErr != nil {
+			log.Warn(removeErr.Error())
+		}
+	}()
+
+	err = waitForJob(ctx, cli, hookStackName+"_"+hookName, swarmStack.hookTimeout)
+	if err != nil {
+		return fmt.Errorf("hook %s of stack %s failed: %w", hookName, swarmStack.name, err)
+	}
+	log.Info("hook completed")
+	return nil
+}
+
+func waitForJob(ctx context.Context, cli *command.DockerCli, serviceName string, timeout time.Duration) error {
+	service, _, err := cli.Client().ServiceInspectWithRaw(ctx, serviceName, types.ServiceInspectOptions{})
+	if err != nil {
+		return fmt.Errorf("could not inspect job %s: %w", serviceName, err)
+	}
+	totalCompletions := uint64(1)
+	if job := service.Spec.Mode.ReplicatedJob; job != nil && job.TotalCompletions != nil {
+		totalCompletions = *job.TotalCompletions
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		tasks, err := cli.Client().TaskList(ctx, types.TaskListOptions{
+			Filters: filters.NewArgs(filters.Arg("service", service.ID)),
+		})
+		if err != nil {
+			return fmt.Errorf("could not list tasks of job %s: %w", serviceName, err)
+		}
+		completed := uint64(0)
+		for _, task := range tasks {
+			switch task.Status.State {
+			case swarm.TaskStateComplete:
+				completed++
+			case swarm.TaskStateFailed, swarm.TaskStateRejected:
+				return fmt.Errorf("task %s %s: %s", task.ID, task.Status.State, task.Status.Err)
+			}
+		}
+		if service.Spec.Mode.GlobalJob != nil && len(tasks) > 0 {
+			totalCompletions = uint64(len(tasks))
+		}
+		if completed > 0 && completed >= totalCompletions {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("job did not complete within %s", timeout)
+		}
+		select {
+		case <-time.After(healthCheckInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for job %s: %w", serviceName, ctx.Err())
+		}
+	}
+}
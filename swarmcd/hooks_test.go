@@ -0,0 +1,130 @@
+package swarmcd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/cli/cli/command"
+	"github.com/docker/cli/cli/flags"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// Hook services are removed from the stack and get their own
+// compose with only the secrets they use, under their own names
+func TestExtractHooks(t *testing.T) {
+	repo := newTestRepo("test")
+	stack := newSwarmStack("test", repo, "main", "docker-compose.yaml", nil, "", false)
+	stack.preDeployHooks = []string{"migrate"}
+	stackString := []byte(`services:
+  api:
+    image: my-image
+    secrets:
+      - db-password
+      - api-key
+  migrate:
+    image: my-image
+    command: migrate
+    secrets:
+      - source: db-password
+secrets:
+  db-password:
+    file: secrets/db-password
+    name: test-db-password-12345678
+  api-key:
+    external: true`)
+	composeMap, err := stack.parseStackString(stackString)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	hooks, err := stack.extractHooks(composeMap)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	services := composeMap["services"].(map[string]any)
+	if _, ok := services["migrate"]; ok {
+		t.Errorf("hook service was not removed from the stack")
+	}
+	hookCompose, ok := hooks["migrate"]
+	if !ok {
+		t.Fatalf("hook compose missing")
+	}
+	deploy := hookCompose["services"].(map[string]any)["migrate"].(map[string]any)["deploy"].(map[string]any)
+	if deploy["mode"] != "replicated-job" {
+		t.Errorf("unexpected hook deploy mode: %v", deploy["mode"])
+	}
+	secrets := hookCompose["secrets"].(map[string]any)
+	if len(secrets) != 1 {
+		t.Errorf("unexpected hook secrets: %v", secrets)
+	}
+	dbPassword := secrets["db-password"].(map[string]any)
+	if dbPassword["name"] != "migrate-test-db-password-12345678" {
+		t.Errorf("expected the hook secret to be named after the hook and the content hash, got %v", dbPassword["name"])
+	}
+	if _, ok := composeMap["secrets"].(map[string]any)["db-password"].(map[string]any)["name"]; !ok {
+		t.Errorf("rotated secret name was removed from stack secret")
+	}
+}
+
+// newFakeDockerCli returns a docker cli talking to handler, which
+// gets the API paths without their version prefix
+func newFakeDockerCli(t *testing.T, handler http.HandlerFunc) *command.DockerCli {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Api-Version", "1.45")
+		if r.URL.Path == "/_ping" {
+			return
+		}
+		_, r.URL.Path, _ = strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		r.URL.Path = "/" + r.URL.Path
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	clientOptions := flags.NewClientOptions()
+	clientOptions.Hosts = []string{"tcp://" + server.Listener.Addr().String()}
+	cli, err := newDockerCli(clientOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cli
+}
+
+// A hook stack left by an earlier run is removed before the hook runs
+func TestRemoveStaleHookStack(t *testing.T) {
+	var lock sync.Mutex
+	staleServices := []swarm.Service{{ID: "stale", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{
+		Name:   "web-hook-migrate_migrate",
+		Labels: map[string]string{"com.docker.stack.namespace": "web-hook-migrate"},
+	}}}}
+	removed := []string{}
+	cli := newFakeDockerCli(t, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/services":
+			json.NewEncoder(w).Encode(staleServices)
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/services/"):
+			removed = append(removed, strings.TrimPrefix(r.URL.Path, "/services/"))
+			staleServices = nil
+		case r.Method == http.MethodGet:
+			w.Write([]byte("[]"))
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	})
+
+	err := removeStackAndWait(context.Background(), cli, "web-hook-migrate")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(removed) != 1 || removed[0] != "stale" {
+		t.Errorf("expected the stale hook service to be removed, removed %v", removed)
+	}
+	err = removeStackAndWait(context.Background(), cli, "web-hook-migrate")
+	if err != nil {
+		t.Errorf("expected removing a missing hook stack to succeed, got %s", err)
+	}
+}
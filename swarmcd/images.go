@@ -0,0 +1,227 @@
+package swarmcd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+const defaultCommitMessage = `Update images of {{.Stack}} stack
+{{range .Changes}}
+- {{.Image}}: {{.OldTag}} -> {{.NewTag}}{{end}}
+`
+
+var registryClient *util.RegistryClient = util.NewRegistryClient(registryCredentials)
+
+type imageChange struct {
+	Image  string
+	File   string
+	OldTag string
+	NewTag string
+}
+
+// registryCredentials looks up registry credentials in the registries
+// of the config, then in the docker config
+func registryCredentials(host string) (string, string) {
+	address := registryAuthAddress(host)
+	if registries := configuredRegistries(host); len(registries) > 0 {
+		configFile, err := registryAuthConfigFile(registries[:1])
+		if err != nil {
+			logger.Warn(err.Error())
+			return "", ""
+		}
+		authConfig, err := configFile.GetAuthConfig(address)
+		if err != nil {
+			return "", ""
+		}
+		return authConfig.Username, authConfig.Password
+	}
+	authConfig, err := dockerCli.ConfigFile().GetAuthConfig(address)
+	if err != nil {
+		return "", ""
+	}
+	return authConfig.Username, authConfig.Password
+}
+
+// updateImages writes the newest tags allowed by the image update
+// policies to the repo and pushes them, returns whether anything changed
+func (swarmStack *swarmStack) updateImages(ctx context.Context) (bool, error) {
+	var changes []imageChange
+	var files []string
+	for _, imageUpdate := range swarmStack.imageUpdates {
+		log := logger.With(
+			slog.String("stack", swarmStack.name),
+			slog.String("image", imageUpdate.Image),
+		)
+		file := imageUpdate.File
+		if file == "" {
+			file = swarmStack.composePath
+		}
+		filePath := path.Join(swarmStack.repo.path, file)
+		fileBytes, err := os.ReadFile(filePath)
+		if err != nil {
+			return false, fmt.Errorf("could not read file %s for image update: %w", filePath, err)
+		}
+		currentTag := findImageTag(fileBytes, imageUpdate.Image)
+		if currentTag == "" {
+			return false, fmt.Errorf("could not find image %s in %s for stack %s", imageUpdate.Image, file, swarmStack.name)
+		}
+
+		log.Debug("listing tags...")
+		tags, err := registryClient.ListTags(ctx, imageUpdate.Image)
+		if err != nil {
+			return false, err
+		}
+		newTag, err := selectTag(tags, imageUpdate.Policy, func(tag string) (time.Time, error) {
+			return registryClient.GetCreated(ctx, imageUpdate.Image, tag)
+		})
+		if err != nil {
+			return false, fmt.Errorf("could not select tag of image %s for stack %s: %w", imageUpdate.Image, swarmStack.name, err)
+		}
+		if newTag == "" || newTag == currentTag {
+			continue
+		}
+
+		log.Info("updating image tag...", "old_tag", currentTag, "new_tag", newTag)
+		fileInfo, _ := os.Stat(filePath)
+		err = os.WriteFile(filePath, replaceImageTag(fileBytes, imageUpdate.Image, newTag), fileInfo.Mode())
+		if err != nil {
+			return false, fmt.Errorf("could not write file %s for image update: %w", filePath, err)
+		}
+		changes = append(changes, imageChange{Image: imageUpdate.Image, File: file, OldTag: currentTag, NewTag: newTag})
+		files = append(files, file)
+	}
+	if len(changes) == 0 {
+		return false, nil
+	}
+
+	message, err := swarmStack.renderCommitMessage(changes)
+	if err != nil {
+		return false, err
+	}
+	// only the leader pushes, the lease may have been lost meanwhile
+	err = checkLeadership(ctx)
+	if err != nil {
+		return false, err
+	}
+	err = swarmStack.repo.commitAndPush(ctx, swarmStack.branch, files, message)
+	if err != nil {
+		return false, fmt.Errorf("could not write back image updates of stack %s: %w", swarmStack.name, err)
+	}
+	return true, nil
+}
+
+func (swarmStack *swarmStack) renderCommitMessage(changes []imageChange) (string, error) {
+	messageTemplate := swarmStack.repo.commitMessage
+	if messageTemplate == "" {
+		messageTemplate = defaultCommitMessage
+	}
+	templ, err := template.New("commit_message").Parse(messageTemplate)
+	if err != nil {
+		return "", fmt.Errorf("could not parse commit message template of %s repo: %w", swarmStack.repo.name, err)
+	}
+	var message bytes.Buffer
+	err = templ.Execute(&message, map[string]any{"Stack": swarmStack.name, "Changes": changes})
+	if err != nil {
+		return "", fmt.Errorf("could not render commit message template of %s repo: %w", swarmStack.repo.name, err)
+	}
+	return message.String(), nil
+}
+
+// selectTag returns the tag the policy selects out of tags, or an empty string
+// when none matches. getCreated is only called for the latest policy
+func selectTag(tags []string, policy util.ImagePolicyConfig, getCreated func(tag string) (time.Time, error)) (string, error) {
+	if policy.Regex != "" {
+		tagRegex, err := regexp.Compile(policy.Regex)
+		if err != nil {
+			return "", fmt.Errorf("invalid regex %s: %w", policy.Regex, err)
+		}
+		var matchingTags []string
+		for _, tag := range tags {
+			if tagRegex.MatchString(tag) {
+				matchingTags = append(matchingTags, tag)
+			}
+		}
+		tags = matchingTags
+	}
+
+	switch {
+	case policy.Semver != "":
+		semverRange, err := semver.ParseRange(policy.Semver)
+		if err != nil {
+			return "", fmt.Errorf("invalid semver range %s: %w", policy.Semver, err)
+		}
+		var selectedTag string
+		var selectedVersion semver.Version
+		for _, tag := range tags {
+			version, err := semver.ParseTolerant(tag)
+			if err != nil || !semverRange(version) {
+				continue
+			}
+			if selectedTag == "" || version.GT(selectedVersion) {
+				selectedTag = tag
+				selectedVersion = version
+			}
+		}
+		return selectedTag, nil
+	case policy.Latest:
+		var selectedTag string
+		var selectedCreated time.Time
+		for _, tag := range tags {
+			created, err := getCreated(tag)
+			if err != nil {
+				return "", err
+			}
+			if selectedTag == "" || created.After(selectedCreated) {
+				selectedTag = tag
+				selectedCreated = created
+			}
+		}
+		return selectedTag, nil
+	case policy.Regex != "":
+		if len(tags) == 0 {
+			return "", nil
+		}
+		sort.Strings(tags)
+		return tags[len(tags)-1], nil
+	default:
+		return "", fmt.Errorf("policy must set one of semver, regex or latest")
+	}
+}
+
+// imageTagRegexes match the tag of an image either referenced as image:tag,
+// or as a value followed by a `# swarm-cd-image: image` comment
+func imageTagRegexes(image string) []*regexp.Regexp {
+	quotedImage := regexp.QuoteMeta(image)
+	return []*regexp.Regexp{
+		regexp.MustCompile(`(^|[^\w./-])(` + quotedImage + `:)(\w[\w.-]{0,127})`),
+		regexp.MustCompile(`(?m)^(\s*[\w.-]+:\s*["']?)(\w[\w.-]{0,127})(["']?\s*#\s*swarm-cd-image:\s*` + quotedImage + `\s*)$`),
+	}
+}
+
+func findImageTag(contents []byte, image string) string {
+	regexes := imageTagRegexes(image)
+	if match := regexes[0].FindSubmatch(contents); match != nil {
+		return string(match[3])
+	}
+	if match := regexes[1].FindSubmatch(contents); match != nil {
+		return string(match[2])
+	}
+	return ""
+}
+
+func replaceImageTag(contents []byte, image string, tag string) []byte {
+	regexes := imageTagRegexes(image)
+	contents = regexes[0].ReplaceAll(contents, []byte("${1}${2}"+tag))
+	return regexes[1].ReplaceAll(contents, []byte("${1}"+tag+"${3}"))
+}
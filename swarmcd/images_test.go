@@ -0,0 +1,74 @@
+package swarmcd
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+func TestSelectTag(t *testing.T) {
+	tags := []string{"1.0.0", "v1.2.0", "1.10.1", "2.0.0", "latest", "main-20240501", "main-20240601"}
+	created := map[string]time.Time{
+		"main-20240501": time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		"main-20240601": time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+	}
+	getCreated := func(tag string) (time.Time, error) {
+		if createdTime, ok := created[tag]; ok {
+			return createdTime, nil
+		}
+		return time.Time{}, fmt.Errorf("unexpected tag %s", tag)
+	}
+	tests := []struct {
+		name    string
+		policy  util.ImagePolicyConfig
+		want    string
+		wantErr bool
+	}{
+		{name: "semver range", policy: util.ImagePolicyConfig{Semver: ">=1.0.0 <2.0.0"}, want: "1.10.1"},
+		{name: "semver no match", policy: util.ImagePolicyConfig{Semver: ">=3.0.0"}, want: ""},
+		{name: "regex", policy: util.ImagePolicyConfig{Regex: `^main-\d+$`}, want: "main-20240601"},
+		{name: "latest", policy: util.ImagePolicyConfig{Regex: `^main-`, Latest: true}, want: "main-20240601"},
+		{name: "no policy", policy: util.ImagePolicyConfig{}, wantErr: true},
+		{name: "invalid regex", policy: util.ImagePolicyConfig{Regex: "("}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectTag(append([]string{}, tags...), tt.policy, getCreated)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectTag() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("selectTag() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Image tags are found and replaced in references and marked values
+func TestReplaceImageTag(t *testing.T) {
+	contents := []byte(`services:
+  app:
+    image: registry.example.com/team/app:1.0.0
+  other:
+    image: registry.example.com/team/app-worker:1.0.0
+app:
+  tag: "1.0.0" # swarm-cd-image: registry.example.com/team/app
+`)
+	image := "registry.example.com/team/app"
+	if tag := findImageTag(contents, image); tag != "1.0.0" {
+		t.Errorf("unexpected tag: %s", tag)
+	}
+	want := `services:
+  app:
+    image: registry.example.com/team/app:1.1.0
+  other:
+    image: registry.example.com/team/app-worker:1.0.0
+app:
+  tag: "1.1.0" # swarm-cd-image: registry.example.com/team/app
+`
+	if got := string(replaceImageTag(contents, image, "1.1.0")); got != want {
+		t.Errorf("unexpected contents:\n%s", got)
+	}
+}
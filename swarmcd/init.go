@@ -1,11 +1,15 @@
 package swarmcd
 
 import (
+	"crypto/md5"
 	"fmt"
 	"log/slog"
 	"os"
 	"path"
+	"slices"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/docker/cli/cli/command"
 	"github.com/docker/cli/cli/flags"
@@ -14,17 +18,54 @@ import (
 )
 
 type StackStatus struct {
-	Error    string
-	Revision string
-	RepoURL  string
+	Error string
+	// Error, or Timeout if the update ran out of time
+	FailureReason string
+	Revision      string
+	RepoURL       string
+	// cluster the stack is deployed to, empty for the default one
+	Cluster string
+	// Synced or OutOfSync, compares the deployed revision
+	// with the one pulled from the repo
+	SyncStatus      string
+	PendingRevision string
+	// whether syncing is blocked by sync windows, and when they allow it next
+	Blocked        bool
+	NextSyncWindow *time.Time
+	// set while the stack, or the whole instance, is suspended
+	Suspension *Suspension
+	// differences between the live services and the last deployment
+	Drift       []FieldDrift
+	Deployments []Deployment
 }
 
-var config *util.Config = &util.Configs
+// Deployment records what was deployed by a successful stack update
+type Deployment struct {
+	Revision   string
+	DeployedAt time.Time
+	// service images mapped to the digests they pointed to
+	Images map[string]string
+}
+
+// the config in use. Reloads replace it as a whole, callers
+// that need several values consistently keep the one they got
+var config atomic.Pointer[util.Config]
+
+func init() {
+	config.Store(&util.Configs)
+}
+
+func getConfig() *util.Config {
+	return config.Load()
+}
 
 var logger *slog.Logger = util.Logger
 
 var repos map[string]*stackRepo = map[string]*stackRepo{}
 
+// configs the repos were created with, to tell when they change
+var repoConfigs map[string]util.RepoConfig = map[string]util.RepoConfig{}
+
 var dockerCli *command.DockerCli
 
 func Init() (err error) {
@@ -32,92 +73,246 @@ func Init() (err error) {
 	if err != nil {
 		return err
 	}
+	err = initSecretProviders()
+	if err != nil {
+		return err
+	}
+	err = initStacksSource()
+	if err != nil {
+		return err
+	}
+	err = initGenerators()
+	if err != nil {
+		return err
+	}
 	err = initStacks()
 	if err != nil {
 		return err
 	}
+	err = loadState()
+	if err != nil {
+		return err
+	}
 	err = initDockerCli()
 	if err != nil {
 		return err
 	}
+	err = initClusters()
+	if err != nil {
+		return err
+	}
+	err = initLeaderElection()
+	if err != nil {
+		return err
+	}
 	return
 }
 
 func initRepos() error {
-	for repoName, repoConfig := range config.RepoConfigs {
-		repoPath := path.Join(config.ReposPath, repoName)
-		auth, err := createHTTPBasicAuth(repoName)
-		if err != nil {
-			return err
-		}
-		repos[repoName], err = newStackRepo(repoName, repoPath, repoConfig.Url, auth)
+	for repoName, repoConfig := range getConfig().RepoConfigs {
+		repo, err := newRepoFromConfig(repoName, repoConfig)
 		if err != nil {
 			return err
 		}
+		repos[repoName] = repo
+		repoConfigs[repoName] = *repoConfig
 	}
 	return nil
 }
 
-func createHTTPBasicAuth(repoName string) (*http.BasicAuth, error) {
-	repoConfig := config.RepoConfigs[repoName]
+func newRepoFromConfig(repoName string, repoConfig *util.RepoConfig) (*stackRepo, error) {
+	auth, err := createHTTPBasicAuth(repoName, repoConfig)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := newStackRepo(repoName, repoPath(repoName, repoConfig.Url), repoConfig.Url, auth)
+	if err != nil {
+		return nil, err
+	}
+	repo.pushAuth, err = createPushAuth(repoName, repoConfig, auth)
+	if err != nil {
+		return nil, err
+	}
+	repo.commitAuthorName = repoConfig.CommitAuthorName
+	repo.commitAuthorEmail = repoConfig.CommitAuthorEmail
+	repo.commitMessage = repoConfig.CommitMessage
+	return repo, nil
+}
+
+// repoUpdateFromConfig returns a function that applies the credentials and
+// commit settings of a changed repo config to a repo of the same url. The
+// repo keeps its checkout and its lock, since stacks may be syncing from it
+func repoUpdateFromConfig(repo *stackRepo, repoConfig *util.RepoConfig) (func(), error) {
+	auth, err := createHTTPBasicAuth(repo.name, repoConfig)
+	if err != nil {
+		return nil, err
+	}
+	pushAuth, err := createPushAuth(repo.name, repoConfig, auth)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		repo.lock.Lock()
+		defer repo.lock.Unlock()
+		repo.auth = auth
+		repo.pushAuth = pushAuth
+		repo.commitAuthorName = repoConfig.CommitAuthorName
+		repo.commitAuthorEmail = repoConfig.CommitAuthorEmail
+		repo.commitMessage = repoConfig.CommitMessage
+	}, nil
+}
+
+// repoPath returns where a repo is checked out. If the repo's directory
+// holds a checkout of another url, the repo is cloned next to it instead
+func repoPath(repoName string, url string) string {
+	repoPath := path.Join(getConfig().ReposPath, repoName)
+	originURL, ok := checkoutOrigin(repoPath)
+	if !ok || originURL == url {
+		return repoPath
+	}
+	return repoPath + "-" + fmt.Sprintf("%x", md5.Sum([]byte(url)))[:8]
+}
+
+func createHTTPBasicAuth(repoName string, repoConfig *util.RepoConfig) (*http.BasicAuth, error) {
+	return newHTTPBasicAuth(repoName, "", repoConfig.Username, repoConfig.Password, repoConfig.PasswordFile)
+}
+
+// createPushAuth returns the credentials used to push image updates,
+// which default to the ones used to pull the repo
+func createPushAuth(repoName string, repoConfig *util.RepoConfig, pullAuth *http.BasicAuth) (*http.BasicAuth, error) {
+	if repoConfig.PushUsername == "" && repoConfig.PushPassword == "" && repoConfig.PushPasswordFile == "" {
+		return pullAuth, nil
+	}
+	return newHTTPBasicAuth(repoName, "push_", repoConfig.PushUsername, repoConfig.PushPassword, repoConfig.PushPasswordFile)
+}
+
+func newHTTPBasicAuth(repoName string, propertyPrefix string, username string, password string, passwordFile string) (*http.BasicAuth, error) {
 	// assume repo is public and no auth is required
-	if repoConfig.Username == "" && repoConfig.Password == "" && repoConfig.PasswordFile == "" {
+	if username == "" && password == "" && passwordFile == "" {
 		return nil, nil
 	}
 
-	if repoConfig.Username == "" {
-		return nil, fmt.Errorf("you must set username for the repo %s", repoName)
+	if username == "" {
+		return nil, fmt.Errorf("you must set %susername for the repo %s", propertyPrefix, repoName)
 	}
 
-	if repoConfig.Password == "" && repoConfig.PasswordFile == "" {
-		return nil, fmt.Errorf("you must set one of password or password_file properties for the repo %s", repoName)
+	if password == "" && passwordFile == "" {
+		return nil, fmt.Errorf("you must set one of %spassword or %spassword_file properties for the repo %s", propertyPrefix, propertyPrefix, repoName)
 	}
 
-	var password string
-	if repoConfig.Password != "" {
-		password = repoConfig.Password
-	} else {
-		passwordBytes, err := os.ReadFile(repoConfig.PasswordFile)
+	if password == "" {
+		passwordBytes, err := os.ReadFile(passwordFile)
 		if err != nil {
-			return nil, fmt.Errorf("could not read password file %s for repo %s", repoConfig.PasswordFile, repoName)
+			return nil, fmt.Errorf("could not read password file %s for repo %s", passwordFile, repoName)
 		}
 		// trim newline and whitespaces
 		password = strings.TrimSpace(string(passwordBytes))
 	}
 
 	return &http.BasicAuth{
-		Username: repoConfig.Username,
+		Username: username,
 		Password: password,
 	}, nil
 }
 
-func initStacks() error {
-	for stack, stackConfig := range config.StackConfigs {
-		stackRepo, ok := repos[stackConfig.Repo]
-		if !ok {
-			return fmt.Errorf("error initializing %s stack, no such repo: %s", stack, stackConfig.Repo)
+// checkSopsKeys only lets stacks use the key files the operator allows.
+// Stacks defined by the stacks source, or using a repo it defines, only
+// get the key files allowed for the stacks source, even through their repo
+func checkSopsKeys(stack string, repo string, keys util.SopsKeys) error {
+	err := util.ValidateSopsKeyFiles(getConfig().SopsKeyFiles, keys)
+	if err != nil {
+		return err
+	}
+	if !definedByStacksSource(stack, repo) {
+		return nil
+	}
+	err = util.ValidateSopsKeyFiles(getConfig().StacksSource.SopsKeyFiles, keys)
+	if err != nil {
+		return fmt.Errorf("%w of stacks_source", err)
+	}
+	return nil
+}
+
+// checkRegistries only lets stacks defined by the stacks source, or using
+// a repo it defines, send the credentials of the registries allowed for it
+func checkRegistries(stack string, repo string, registries []string) error {
+	if !definedByStacksSource(stack, repo) {
+		return nil
+	}
+	for _, registry := range registries {
+		if !slices.Contains(getConfig().StacksSource.Registries, registry) {
+			return fmt.Errorf("registry %s is not listed in registries of stacks_source", registry)
 		}
-		discoverSecrets := config.SopsSecretsDiscovery || stackConfig.SopsSecretsDiscovery
-		swarmStack := newSwarmStack(stack, stackRepo, stackConfig.Branch, stackConfig.ComposeFile, stackConfig.SopsFiles, stackConfig.ValuesFile, discoverSecrets)
-		stacks = append(stacks, swarmStack)
-		stackStatus[stack] = &StackStatus{}
-		stackStatus[stack].RepoURL = stackRepo.url
 	}
 	return nil
 }
 
-func initDockerCli() (err error) {
-	// suppress command outputs (errors are returned as objects)
-	nullFile, _ := os.Open("/dev/null")
-	defer nullFile.Close()
-	dockerCli, err = command.NewDockerCli(command.WithOutputStream(nullFile), command.WithErrorStream(nullFile))
+// definedByStacksSource tells if the stack, or its repo, is defined by the
+// stacks source rather than by the config. Stacks are identified by stack@cluster
+func definedByStacksSource(stack string, repo string) bool {
+	stackName, _ := splitClusterStackName(stack)
+	_, isSourceRepo := sourceRepoConfigs[repo]
+	_, isLocalRepo := getConfig().RepoConfigs[repo]
+	return sourceStacks[stackName] || (isSourceRepo && !isLocalRepo)
+}
+
+func initStacks() error {
+	return reconcileStacks(getConfig().StackConfigs)
+}
+
+func newStackFromConfig(stack string, stackConfig *util.StackConfig) (*swarmStack, error) {
+	stackRepo, ok := repos[stackConfig.Repo]
+	if !ok {
+		return nil, fmt.Errorf("error initializing %s stack, no such repo: %s", stack, stackConfig.Repo)
+	}
+	discoverSecrets := getConfig().SopsSecretsDiscovery || stackConfig.SopsSecretsDiscovery
+	swarmStack := newSwarmStack(stack, stackRepo, stackConfig.Branch, stackConfig.ComposeFile, stackConfig.SopsFiles, stackConfig.ValuesFile, discoverSecrets)
+	swarmStack.dependsOn = stackConfig.DependsOn
+	swarmStack.preDeployHooks = stackConfig.Hooks.PreDeploy
+	swarmStack.postDeployHooks = stackConfig.Hooks.PostDeploy
+	swarmStack.imageUpdates = stackConfig.ImageUpdates
+	swarmStack.pinImageDigests = getConfig().PinImageDigests || stackConfig.PinImageDigests
+	swarmStack.manualSync = stackConfig.SyncPolicy == "manual"
+	swarmStack.selfHeal = getConfig().SelfHeal
+	if stackConfig.SelfHeal != nil {
+		swarmStack.selfHeal = *stackConfig.SelfHeal
+	}
+	swarmStack.ignoreDifferences = stackConfig.IgnoreDifferences
+	swarmStack.timeouts = getConfig().Timeouts.Override(stackConfig.Timeouts)
+	// stacks only get the keys and registries of their own repo
+	repoConfig := repoConfigs[stackConfig.Repo]
+	swarmStack.registries = append(append([]string{}, repoConfig.Registries...), stackConfig.Registries...)
+	swarmStack.sopsKeys = util.SopsKeys{AgeKeyFile: repoConfig.SopsAgeKeyFile, GPGKeyFile: repoConfig.SopsGPGKeyFile}
+	if stackConfig.SopsAgeKeyFile != "" || stackConfig.SopsGPGKeyFile != "" {
+		swarmStack.sopsKeys = util.SopsKeys{AgeKeyFile: stackConfig.SopsAgeKeyFile, GPGKeyFile: stackConfig.SopsGPGKeyFile}
+	}
+	// once the operator allows some key files, no stack falls back to the keys of the environment
+	swarmStack.sopsKeys.KeyFilesOnly = len(getConfig().SopsKeyFiles) > 0
+	err := checkSopsKeys(stack, stackConfig.Repo, swarmStack.sopsKeys)
 	if err != nil {
-		return fmt.Errorf("could not create a docker cli object: %w", err)
+		return nil, fmt.Errorf("error initializing %s stack: %w", stack, err)
 	}
-	err = dockerCli.Initialize(flags.NewClientOptions())
-
+	err = checkRegistries(stack, stackConfig.Repo, swarmStack.registries)
 	if err != nil {
-		return fmt.Errorf("could not initialize docker cli object: %w", err)
+		return nil, fmt.Errorf("error initializing %s stack: %w", stack, err)
 	}
-	return nil
+	swarmStack.syncWindows, err = util.ParseSyncWindows(append(append([]util.SyncWindowConfig{}, getConfig().SyncWindows...), stackConfig.SyncWindows...))
+	if err != nil {
+		return nil, fmt.Errorf("error initializing %s stack: %w", stack, err)
+	}
+	swarmStack.sopsFormats = stackConfig.SopsFormats
+	swarmStack.skipPlaintextFiles = getConfig().SopsPlaintext == "skip"
+	if stackConfig.SopsPlaintext != "" {
+		swarmStack.skipPlaintextFiles = stackConfig.SopsPlaintext == "skip"
+	}
+	swarmStack.hookTimeout = time.Duration(getConfig().HookTimeout) * time.Second
+	if stackConfig.Hooks.Timeout > 0 {
+		swarmStack.hookTimeout = time.Duration(stackConfig.Hooks.Timeout) * time.Second
+	}
+	return swarmStack, nil
+}
+
+func initDockerCli() (err error) {
+	dockerCli, err = newDockerCli(flags.NewClientOptions())
+	return err
 }
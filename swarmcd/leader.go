@@ -0,0 +1,285 @@
+package swarmcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// labels of the swarm spec that hold the lease of the leader,
+// and the state it shares with the other instances
+const (
+	leaderLabel       = "swarm-cd.leader"
+	leaderExpiryLabel = "swarm-cd.leader.expires"
+	stateLabel        = "swarm-cd.state"
+)
+
+// how often writes of the shared state are tried, since
+// renewals of the lease can update the swarm in between
+const stateWriteAttempts = 3
+
+// how often followers check whether they became the leader
+const leaderPollInterval = time.Second
+
+var ErrNotLeader = errors.New("not the leader")
+
+type leaderElection struct {
+	identity      string
+	leaseDuration time.Duration
+	lock          sync.RWMutex
+	// last known holder of the lease
+	leader string
+	// this instance acts as the leader until then, which is a
+	// third of the lease before other instances can take it over
+	leaderUntil time.Time
+	// cancelled with ErrNotLeader once the lease is lost,
+	// updates of stacks derive their context from it
+	leadership       context.Context
+	cancelLeadership context.CancelCauseFunc
+}
+
+// nil when leader election is disabled
+var election *leaderElection
+
+// LeaderStatus is the leader election as seen by this instance
+type LeaderStatus struct {
+	Enabled  bool
+	Identity string
+	Leader   string
+	IsLeader bool
+	// followers neither refresh stacks nor their status,
+	// the status they serve is as of when they last led
+	StaleStatus bool
+}
+
+func initLeaderElection() error {
+	election = nil
+	if !getConfig().LeaderElection.Enabled {
+		return nil
+	}
+	identity := getConfig().LeaderElection.Identity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("could not get the identity of the instance for leader election: %w", err)
+		}
+		identity = hostname
+	}
+	// instances start as followers, until they acquire the lease
+	leadership, cancelLeadership := context.WithCancelCause(context.Background())
+	cancelLeadership(fmt.Errorf("%w, no instance holds the lease", ErrNotLeader))
+	election = &leaderElection{
+		identity:         identity,
+		leaseDuration:    time.Duration(getConfig().LeaderElection.LeaseDuration) * time.Second,
+		leadership:       leadership,
+		cancelLeadership: cancelLeadership,
+	}
+	return nil
+}
+
+// isLeader reports whether this instance may sync stacks,
+// which is always the case without leader election
+func isLeader() bool {
+	if election == nil {
+		return true
+	}
+	election.lock.RLock()
+	defer election.lock.RUnlock()
+	return time.Now().Before(election.leaderUntil)
+}
+
+// checkLeader returns ErrNotLeader if another instance syncs the stacks
+func checkLeader() error {
+	if isLeader() {
+		return nil
+	}
+	leader := GetLeaderStatus().Leader
+	if leader == "" {
+		return fmt.Errorf("%w, no instance holds the lease", ErrNotLeader)
+	}
+	return fmt.Errorf("%w, the leader is %s", ErrNotLeader, leader)
+}
+
+// leadershipContext returns a context that is cancelled with ErrNotLeader
+// once this instance loses the lease. Without leader election it never is
+func leadershipContext() context.Context {
+	if election == nil {
+		return context.Background()
+	}
+	election.lock.RLock()
+	defer election.lock.RUnlock()
+	return election.leadership
+}
+
+// checkLeadership returns ErrNotLeader if ctx was cancelled because the
+// lease was lost, or if another instance syncs the stacks. Updates check it
+// before every step that changes the swarm or the repo
+func checkLeadership(ctx context.Context) error {
+	if cause := context.Cause(ctx); errors.Is(cause, ErrNotLeader) {
+		return cause
+	}
+	return checkLeader()
+}
+
+func GetLeaderStatus() LeaderStatus {
+	if election == nil {
+		return LeaderStatus{IsLeader: true}
+	}
+	leading := isLeader()
+	election.lock.RLock()
+	defer election.lock.RUnlock()
+	return LeaderStatus{
+		Enabled:     true,
+		Identity:    election.identity,
+		Leader:      election.leader,
+		IsLeader:    leading,
+		StaleStatus: !leading,
+	}
+}
+
+// waitForLeadership blocks until this instance becomes the leader.
+// Configuration reloads are still applied meanwhile
+func waitForLeadership() {
+	if isLeader() {
+		return
+	}
+	logger.Info("waiting to become the leader", "identity", election.identity)
+	for !isLeader() {
+		select {
+		case <-time.After(leaderPollInterval):
+		case <-reloadRequests:
+			reloadConfig()
+		}
+	}
+}
+
+// campaign acquires or renews the lease every third of its duration
+func (election *leaderElection) campaign() {
+	for {
+		election.renewLease()
+		time.Sleep(election.leaseDuration / 3)
+	}
+}
+
+func (election *leaderElection) renewLease() {
+	now := time.Now()
+	following := !isLeader()
+	leader, labels, err := election.acquireLease(now)
+	if err == nil && following {
+		// the leader's state is the one it shared, followers keep it up to
+		// date and an instance taking over starts from it
+		if err := loadSharedState(labels); err != nil {
+			logger.Error(err.Error())
+		}
+	}
+	election.updateLeader(now, leader, err)
+}
+
+// updateLeader records the outcome of a renewal of the lease at now
+func (election *leaderElection) updateLeader(now time.Time, leader string, err error) {
+	election.lock.Lock()
+	defer election.lock.Unlock()
+	wasLeader := now.Before(election.leaderUntil)
+	if err != nil {
+		logger.Warn(err.Error(), "identity", election.identity)
+		// a leader keeps leading until its lease runs out,
+		// unless it runs out before the next renewal
+		if wasLeader && !now.Add(election.leaseDuration/3).Before(election.leaderUntil) {
+			election.leaderUntil = time.Time{}
+			election.cancelLeadership(fmt.Errorf("%w, the lease could not be renewed", ErrNotLeader))
+			logger.Warn("lost the leadership, the lease could not be renewed")
+		}
+		return
+	}
+	election.leader = leader
+	if leader != election.identity {
+		election.leaderUntil = time.Time{}
+		election.cancelLeadership(fmt.Errorf("%w, the leader is %s", ErrNotLeader, leader))
+		if wasLeader {
+			logger.Warn("lost the leadership", "leader", leader)
+		}
+		return
+	}
+	election.leaderUntil = now.Add(election.leaseDuration * 2 / 3)
+	if !wasLeader {
+		// updates of a lapsed leadership don't carry over
+		election.cancelLeadership(fmt.Errorf("%w, the lease lapsed", ErrNotLeader))
+		election.leadership, election.cancelLeadership = context.WithCancelCause(context.Background())
+		logger.Info("became the leader", "identity", election.identity)
+	}
+}
+
+// acquireLease takes the lease, or renews it, unless another instance
+// holds a valid one. Returns the instance holding the lease and the
+// labels of the swarm it was read from
+func (election *leaderElection) acquireLease(now time.Time) (string, map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), election.leaseDuration/3)
+	defer cancel()
+	swarmInfo, err := dockerCli.Client().SwarmInspect(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not read the leader lease: %w", err)
+	}
+	if holder, valid := leaseHolder(swarmInfo.Spec.Labels, now); valid && holder != election.identity {
+		return holder, swarmInfo.Spec.Labels, nil
+	}
+	spec := swarmInfo.Spec
+	spec.Labels = maps.Clone(spec.Labels)
+	if spec.Labels == nil {
+		spec.Labels = map[string]string{}
+	}
+	spec.Labels[leaderLabel] = election.identity
+	spec.Labels[leaderExpiryLabel] = now.Add(election.leaseDuration).UTC().Format(time.RFC3339Nano)
+	// the version makes the update fail if another instance
+	// updated the lease since it was read
+	err = dockerCli.Client().SwarmUpdate(ctx, swarmInfo.Version, spec, swarm.UpdateFlags{})
+	if err != nil {
+		return "", nil, fmt.Errorf("could not write the leader lease: %w", err)
+	}
+	return election.identity, spec.Labels, nil
+}
+
+// saveState stores the state in the swarm labels next to the lease,
+// so that it survives a failover. Only the leader writes it
+func (election *leaderElection) saveState(stateBytes []byte) error {
+	if !isLeader() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), election.leaseDuration/3)
+	defer cancel()
+	var err error
+	for attempt := 0; attempt < stateWriteAttempts; attempt++ {
+		var swarmInfo swarm.Swarm
+		swarmInfo, err = dockerCli.Client().SwarmInspect(ctx)
+		if err != nil {
+			return fmt.Errorf("could not read the shared state: %w", err)
+		}
+		spec := swarmInfo.Spec
+		spec.Labels = maps.Clone(spec.Labels)
+		if spec.Labels == nil {
+			spec.Labels = map[string]string{}
+		}
+		spec.Labels[stateLabel] = string(stateBytes)
+		err = dockerCli.Client().SwarmUpdate(ctx, swarmInfo.Version, spec, swarm.UpdateFlags{})
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("could not write the shared state: %w", err)
+}
+
+// leaseHolder returns the instance holding the lease in
+// the swarm labels, and whether the lease is still valid
+func leaseHolder(labels map[string]string, now time.Time) (string, bool) {
+	holder := labels[leaderLabel]
+	expiry, err := time.Parse(time.RFC3339Nano, labels[leaderExpiryLabel])
+	if holder == "" || err != nil {
+		return holder, false
+	}
+	return holder, now.Before(expiry)
+}
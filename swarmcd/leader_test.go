@@ -0,0 +1,124 @@
+package swarmcd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLeaseHolder(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		labels map[string]string
+		holder string
+		valid  bool
+	}{
+		{nil, "", false},
+		{map[string]string{leaderLabel: "a", leaderExpiryLabel: "2024-05-01T12:00:30Z"}, "a", true},
+		{map[string]string{leaderLabel: "a", leaderExpiryLabel: "2024-05-01T11:59:30Z"}, "a", false},
+		{map[string]string{leaderLabel: "a", leaderExpiryLabel: "soon"}, "a", false},
+		{map[string]string{leaderExpiryLabel: "2024-05-01T12:00:30Z"}, "", false},
+	}
+	for _, test := range tests {
+		holder, valid := leaseHolder(test.labels, now)
+		if holder != test.holder || valid != test.valid {
+			t.Errorf("%v: expected %q, %t, got %q, %t", test.labels, test.holder, test.valid, holder, valid)
+		}
+	}
+}
+
+// Followers reject syncs and suspensions until they hold the lease
+func TestFollowerRejectsChanges(t *testing.T) {
+	election = &leaderElection{identity: "b", leaseDuration: 30 * time.Second, leader: "a"}
+	defer func() { election = nil }()
+
+	err := Suspend("incident", nil)
+	if !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("expected ErrNotLeader, got %v", err)
+	}
+	if err.Error() != "not the leader, the leader is a" {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	election.leaderUntil = time.Now().Add(time.Minute)
+	if err := checkLeader(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	status := GetLeaderStatus()
+	if !status.Enabled || !status.IsLeader || status.Identity != "b" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+// Updates started while leading are stopped once the lease is lost
+func TestLosingLeaseStopsUpdates(t *testing.T) {
+	lastConfig := *getConfig()
+	defer func() { *getConfig() = lastConfig; election = nil }()
+	getConfig().LeaderElection.Enabled = true
+	getConfig().LeaderElection.Identity = "b"
+	getConfig().LeaderElection.LeaseDuration = 30
+	err := initLeaderElection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(checkLeadership(leadershipContext()), ErrNotLeader) {
+		t.Fatal("expected followers not to be leading")
+	}
+
+	now := time.Now()
+	election.updateLeader(now, "b", nil)
+	swarmStack := newSwarmStack("web", newTestRepo("repo"), "main", "compose.yaml", nil, "", false)
+	ctx, cancel := swarmStack.stackContext()
+	defer cancel()
+	if err := checkLeadership(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	election.updateLeader(now.Add(10*time.Second), "a", nil)
+	if ctx.Err() == nil {
+		t.Fatal("expected the update to be stopped")
+	}
+	ran := false
+	err = swarmStack.runPhase(ctx, phaseDeploy, func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+	if ran || !errors.Is(err, ErrNotLeader) || err.Error() != "not the leader, the leader is a" {
+		t.Errorf("expected the deploy phase not to run, got %v", err)
+	}
+	err = swarmStack.wrapTimeout(ctx, ctx.Err())
+	if !errors.Is(err, ErrNotLeader) {
+		t.Errorf("expected stopped updates to fail with ErrNotLeader, got %v", err)
+	}
+
+	election.updateLeader(now.Add(20*time.Second), "b", nil)
+	if err := checkLeadership(leadershipContext()); err != nil {
+		t.Errorf("expected a new leadership after taking over the lease, got %v", err)
+	}
+}
+
+// A leader that can't renew its lease in time stops leading
+func TestFailedRenewalStopsUpdates(t *testing.T) {
+	lastConfig := *getConfig()
+	defer func() { *getConfig() = lastConfig; election = nil }()
+	getConfig().LeaderElection.Enabled = true
+	getConfig().LeaderElection.Identity = "b"
+	getConfig().LeaderElection.LeaseDuration = 30
+	err := initLeaderElection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	election.updateLeader(now, "b", nil)
+	ctx := leadershipContext()
+
+	election.updateLeader(now.Add(5*time.Second), "", errors.New("swarm unavailable"))
+	if ctx.Err() != nil {
+		t.Fatal("expected the leader to keep leading while its lease is valid")
+	}
+	election.updateLeader(now.Add(15*time.Second), "", errors.New("swarm unavailable"))
+	if !errors.Is(context.Cause(ctx), ErrNotLeader) {
+		t.Errorf("expected the leadership to end, got %v", context.Cause(ctx))
+	}
+}
@@ -0,0 +1,244 @@
+package swarmcd
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// swarmObject is a config or secret that SwarmCD creates through the
+// Docker API, so that its decrypted contents never touch the disk
+type swarmObject struct {
+	// configs or secrets
+	objectType string
+	name       string
+	data       []byte
+	// labels and template_driver of the compose file
+	labels         map[string]string
+	templateDriver string
+}
+
+// externalizeObjects rewrites the configs and secrets whose files were
+// decrypted in memory as external objects, and returns the objects to create.
+// Decrypted files that no config or secret uses are an error, since their
+// contents would otherwise have to be written to disk
+func (swarmStack *swarmStack) externalizeObjects(composeMap map[string]any, decryptedFiles map[string][]byte) ([]swarmObject, error) {
+	objectsDir := path.Dir(path.Join(swarmStack.repo.path, swarmStack.composePath))
+	usedFiles := map[string]bool{}
+	var objects []swarmObject
+	for _, objectType := range []string{"configs", "secrets"} {
+		objectMaps, ok := composeMap[objectType].(map[string]any)
+		if !ok {
+			continue
+		}
+		objectNames := make([]string, 0, len(objectMaps))
+		for objectName := range objectMaps {
+			objectNames = append(objectNames, objectName)
+		}
+		sort.Strings(objectNames)
+		for _, objectName := range objectNames {
+			objectMap, ok := objectMaps[objectName].(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("invalid compose file: %s object must be a map", objectName)
+			}
+			objectFile, ok := objectMap["file"].(string)
+			if !ok {
+				continue
+			}
+			objectFilePath := path.Join(objectsDir, objectFile)
+			data, ok := decryptedFiles[objectFilePath]
+			if !ok {
+				continue
+			}
+			name, ok := objectMap["name"].(string)
+			if !ok {
+				// docker stack deploy names objects the same way
+				name = swarmStack.namespace + "_" + objectName
+			}
+			object, err := newSwarmObject(objectType, objectName, name, objectMap, data)
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, object)
+			usedFiles[objectFilePath] = true
+			objectMaps[objectName] = map[string]any{"external": true, "name": name}
+		}
+	}
+	var unusedFiles []string
+	for filePath := range decryptedFiles {
+		if !usedFiles[filePath] {
+			unusedFiles = append(unusedFiles, filePath)
+		}
+	}
+	if len(unusedFiles) > 0 {
+		sort.Strings(unusedFiles)
+		return nil, fmt.Errorf("no config or secret of %s stack uses the sops files %s", swarmStack.name, strings.Join(unusedFiles, ", "))
+	}
+	return objects, nil
+}
+
+// newSwarmObject takes the fields of a compose file object that SwarmCD
+// creates itself. Fields it can't apply to the object are an error
+func newSwarmObject(objectType string, objectName string, name string, objectMap map[string]any, data []byte) (swarmObject, error) {
+	object := swarmObject{objectType: objectType, name: name, data: data}
+	for field, value := range objectMap {
+		switch field {
+		case "file", "name":
+		case "labels":
+			labels, err := parseLabels(value)
+			if err != nil {
+				return object, fmt.Errorf("invalid compose file: labels of %s object: %w", objectName, err)
+			}
+			object.labels = labels
+		case "template_driver":
+			templateDriver, ok := value.(string)
+			if !ok {
+				return object, fmt.Errorf("invalid compose file: template_driver of %s object must be a string", objectName)
+			}
+			object.templateDriver = templateDriver
+		default:
+			return object, fmt.Errorf("%s field of %s object is not supported with decrypted files", field, objectName)
+		}
+	}
+	return object, nil
+}
+
+// parseLabels reads labels given as a map or as a list of key=value
+func parseLabels(value any) (map[string]string, error) {
+	labels := map[string]string{}
+	switch value := value.(type) {
+	case map[string]any:
+		for key, labelValue := range value {
+			labels[key] = fmt.Sprint(labelValue)
+		}
+	case []any:
+		for _, label := range value {
+			label, ok := label.(string)
+			if !ok {
+				return nil, fmt.Errorf("list labels must be strings")
+			}
+			key, labelValue, _ := strings.Cut(label, "=")
+			labels[key] = labelValue
+		}
+	default:
+		return nil, fmt.Errorf("labels must be a map or a list")
+	}
+	return labels, nil
+}
+
+func (swarmStack *swarmStack) objectLabels() map[string]string {
+	return map[string]string{
+		stackNamespaceLabel: swarmStack.namespace,
+		managedLabel:        getConfig().InstanceName,
+	}
+}
+
+// createObjects creates the objects that don't exist yet. Names
+// contain the hash of the contents, so existing objects are up to date
+func (swarmStack *swarmStack) createObjects(ctx context.Context, objects []swarmObject) error {
+	cli, err := swarmStack.cli()
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		nameFilter := filters.NewArgs(filters.Arg("name", object.name))
+		labels := maps.Clone(object.labels)
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		maps.Copy(labels, swarmStack.objectLabels())
+		annotations := swarm.Annotations{Name: object.name, Labels: labels}
+		var templating *swarm.Driver
+		if object.templateDriver != "" {
+			templating = &swarm.Driver{Name: object.templateDriver}
+		}
+		switch object.objectType {
+		case "secrets":
+			existing, err := cli.Client().SecretList(ctx, types.SecretListOptions{Filters: nameFilter})
+			if err != nil {
+				return fmt.Errorf("could not list secrets of %s stack: %w", swarmStack.name, err)
+			}
+			if hasObjectNamed(len(existing), func(i int) string { return existing[i].Spec.Name }, object.name) {
+				continue
+			}
+			_, err = cli.Client().SecretCreate(ctx, swarm.SecretSpec{Annotations: annotations, Data: object.data, Templating: templating})
+			if err != nil {
+				return fmt.Errorf("could not create secret %s of %s stack: %w", object.name, swarmStack.name, err)
+			}
+		case "configs":
+			existing, err := cli.Client().ConfigList(ctx, types.ConfigListOptions{Filters: nameFilter})
+			if err != nil {
+				return fmt.Errorf("could not list configs of %s stack: %w", swarmStack.name, err)
+			}
+			if hasObjectNamed(len(existing), func(i int) string { return existing[i].Spec.Name }, object.name) {
+				continue
+			}
+			_, err = cli.Client().ConfigCreate(ctx, swarm.ConfigSpec{Annotations: annotations, Data: object.data, Templating: templating})
+			if err != nil {
+				return fmt.Errorf("could not create config %s of %s stack: %w", object.name, swarmStack.name, err)
+			}
+		}
+		logger.Debug(fmt.Sprintf("created %s %s", object.objectType, object.name), "stack", swarmStack.name)
+	}
+	return nil
+}
+
+// the name filter of the Docker API matches prefixes
+func hasObjectNamed(count int, name func(i int) string, objectName string) bool {
+	for i := 0; i < count; i++ {
+		if name(i) == objectName {
+			return true
+		}
+	}
+	return false
+}
+
+// removeUnusedObjects removes the objects SwarmCD created for the stack
+// that are not in objects anymore. Objects still used by tasks that are
+// being replaced can't be removed yet, and are removed on a later deploy
+func (swarmStack *swarmStack) removeUnusedObjects(ctx context.Context, objects []swarmObject) {
+	cli, err := swarmStack.cli()
+	if err != nil {
+		logger.Warn(err.Error())
+		return
+	}
+	used := map[string]bool{}
+	for _, object := range objects {
+		used[object.objectType+"/"+object.name] = true
+	}
+	labelFilter := filters.NewArgs(
+		filters.Arg("label", stackNamespaceLabel+"="+swarmStack.namespace),
+		filters.Arg("label", managedLabel+"="+getConfig().InstanceName),
+	)
+	secrets, err := cli.Client().SecretList(ctx, types.SecretListOptions{Filters: labelFilter})
+	if err != nil {
+		logger.Warn(fmt.Sprintf("could not list secrets of %s stack: %s", swarmStack.name, err))
+	}
+	for _, secret := range secrets {
+		if !used["secrets/"+secret.Spec.Name] {
+			err = cli.Client().SecretRemove(ctx, secret.ID)
+			if err != nil {
+				logger.Debug(fmt.Sprintf("could not remove unused secret %s: %s", secret.Spec.Name, err), "stack", swarmStack.name)
+			}
+		}
+	}
+	configs, err := cli.Client().ConfigList(ctx, types.ConfigListOptions{Filters: labelFilter})
+	if err != nil {
+		logger.Warn(fmt.Sprintf("could not list configs of %s stack: %s", swarmStack.name, err))
+	}
+	for _, swarmConfig := range configs {
+		if !used["configs/"+swarmConfig.Spec.Name] {
+			err = cli.Client().ConfigRemove(ctx, swarmConfig.ID)
+			if err != nil {
+				logger.Debug(fmt.Sprintf("could not remove unused config %s: %s", swarmConfig.Spec.Name, err), "stack", swarmStack.name)
+			}
+		}
+	}
+}
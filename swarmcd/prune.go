@@ -0,0 +1,191 @@
+package swarmcd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/docker/cli/cli/command"
+	"github.com/docker/cli/cli/command/stack"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// label added to every service deployed by SwarmCD so that it can tell
+// which stacks it owns. Its value is the name of the SwarmCD instance,
+// so that instances sharing a cluster leave each other's stacks alone
+const managedLabel = "swarm-cd.managed"
+
+// label set by docker stack deploy on every stack object
+const stackNamespaceLabel = "com.docker.stack.namespace"
+
+// stacks owned by SwarmCD that are no longer in the
+// config, and the time they were first noticed
+var orphanedStacks map[string]time.Time = map[string]time.Time{}
+
+func addManagedLabel(composeMap map[string]any) error {
+	services, ok := composeMap["services"].(map[string]any)
+	if !ok {
+		return nil
+	}
+	for serviceName, service := range services {
+		serviceMap, ok := service.(map[string]any)
+		if !ok {
+			return fmt.Errorf("invalid compose file: %s service must be a map", serviceName)
+		}
+		deploy, ok := serviceMap["deploy"].(map[string]any)
+		if !ok {
+			deploy = map[string]any{}
+			serviceMap["deploy"] = deploy
+		}
+		switch labels := deploy["labels"].(type) {
+		case nil:
+			deploy["labels"] = map[string]any{managedLabel: getConfig().InstanceName}
+		case map[string]any:
+			labels[managedLabel] = getConfig().InstanceName
+		case []any:
+			deploy["labels"] = append(labels, managedLabel+"="+getConfig().InstanceName)
+		default:
+			return fmt.Errorf("invalid compose file: %s service deploy labels must be a map or a list", serviceName)
+		}
+	}
+	return nil
+}
+
+// pruneStacks removes the stacks owned by SwarmCD that are no longer in the
+// config from every cluster. Stacks are identified by stack@cluster. Listing
+// and removing stacks are each bounded by the deploy timeout
+func pruneStacks() {
+	timeout := getConfig().Timeouts.Deploy
+	var managedStacks []string
+	for _, cluster := range prunedClusters() {
+		ctx, cancel := withTimeout(context.Background(), timeout)
+		clusterStacks, err := listManagedStacks(ctx, cluster)
+		cancel()
+		err = wrapTimeout(ctx, "listing of stacks", err)
+		if err != nil {
+			logger.Error(fmt.Sprintf("could not list stacks managed by SwarmCD: %s", err), "cluster", cluster)
+			continue
+		}
+		for _, stackName := range clusterStacks {
+			managedStacks = append(managedStacks, clusterStackName(stackName, cluster))
+		}
+	}
+	configuredStacks := map[string]bool{}
+	stacksLock.RLock()
+	for _, swarmStack := range stacks {
+		configuredStacks[clusterStackName(swarmStack.namespace, swarmStack.cluster)] = true
+	}
+	stacksLock.RUnlock()
+	gracePeriod := time.Duration(getConfig().PruneGracePeriod) * time.Second
+	expiredStacks := findExpiredStacks(managedStacks, configuredStacks, orphanedStacks, time.Now(), gracePeriod)
+	for _, expiredStack := range expiredStacks {
+		log := logger.With(slog.String("stack", expiredStack))
+		if !getConfig().PruneStacks {
+			log.Warn("stack is no longer in the config, enable prune_stacks to remove it")
+			continue
+		}
+		log.Info("removing stack that is no longer in the config...")
+		err := pruneStack(expiredStack, timeout)
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+		delete(orphanedStacks, expiredStack)
+	}
+}
+
+// pruneStack removes a stack identified by stack@cluster. The removal
+// stops once the lease is lost
+func pruneStack(clusterStack string, timeout int) error {
+	ctx, cancel := withTimeout(leadershipContext(), timeout)
+	defer cancel()
+	stackName, cluster := splitClusterStackName(clusterStack)
+	cli, err := clusterCli(cluster)
+	if err != nil {
+		return err
+	}
+	err = checkLeadership(ctx)
+	if err != nil {
+		return err
+	}
+	return wrapTimeout(ctx, "removal of stack "+clusterStack, removeStack(ctx, cli, stackName))
+}
+
+func listManagedStacks(ctx context.Context, cluster string) ([]string, error) {
+	cli, err := clusterCli(cluster)
+	if err != nil {
+		return nil, err
+	}
+	services, err := cli.Client().ServiceList(ctx, types.ServiceListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", managedLabel+"="+getConfig().InstanceName)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	stackNames := map[string]bool{}
+	for _, service := range services {
+		if stackName, ok := service.Spec.Labels[stackNamespaceLabel]; ok {
+			stackNames[stackName] = true
+		}
+	}
+	var managedStacks []string
+	for stackName := range stackNames {
+		managedStacks = append(managedStacks, stackName)
+	}
+	sort.Strings(managedStacks)
+	return managedStacks, nil
+}
+
+// findExpiredStacks records managed stacks missing from the config
+// in orphaned and returns the ones orphaned for longer than gracePeriod
+func findExpiredStacks(managed []string, configured map[string]bool, orphaned map[string]time.Time, now time.Time, gracePeriod time.Duration) []string {
+	isManaged := map[string]bool{}
+	var expired []string
+	for _, stackName := range managed {
+		isManaged[stackName] = true
+		if configured[stackName] {
+			delete(orphaned, stackName)
+			continue
+		}
+		orphanedSince, ok := orphaned[stackName]
+		if !ok {
+			orphaned[stackName] = now
+			orphanedSince = now
+		}
+		if now.Sub(orphanedSince) >= gracePeriod {
+			expired = append(expired, stackName)
+		}
+	}
+	// forget stacks that have been removed in the meantime
+	for stackName := range orphaned {
+		if !isManaged[stackName] {
+			delete(orphaned, stackName)
+		}
+	}
+	return expired
+}
+
+func removeStack(ctx context.Context, cli *command.DockerCli, stackName string) error {
+	return runStackRemove(ctx, cli, stackName, true)
+}
+
+// removeStackAndWait removes a stack and waits until its tasks are
+// gone. Stacks that don't exist are left as they are
+func removeStackAndWait(ctx context.Context, cli *command.DockerCli, stackName string) error {
+	return runStackRemove(ctx, cli, stackName, false)
+}
+
+func runStackRemove(ctx context.Context, cli *command.DockerCli, stackName string, detach bool) error {
+	cmd := stack.NewStackCommand(cli)
+	cmd.SetArgs([]string{"rm", fmt.Sprintf("--detach=%t", detach), stackName})
+	cmd.SilenceErrors = true
+	cmd.SilenceUsage = true
+	err := cmd.ExecuteContext(ctx)
+	if err != nil {
+		return fmt.Errorf("could not remove stack %s: %w", stackName, err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package swarmcd
+
+import (
+	"testing"
+	"time"
+)
+
+// Managed stacks missing from the config are only
+// returned once the grace period has passed
+func TestFindExpiredStacks(t *testing.T) {
+	now := time.Now()
+	orphaned := map[string]time.Time{
+		"old":     now.Add(-10 * time.Minute),
+		"removed": now.Add(-10 * time.Minute),
+	}
+	configured := map[string]bool{"configured": true}
+	managed := []string{"configured", "new", "old"}
+	expired := findExpiredStacks(managed, configured, orphaned, now, 5*time.Minute)
+	if len(expired) != 1 || expired[0] != "old" {
+		t.Errorf("unexpected expired stacks: %v", expired)
+	}
+	if _, ok := orphaned["new"]; !ok {
+		t.Errorf("new orphaned stack was not recorded")
+	}
+	if _, ok := orphaned["removed"]; ok {
+		t.Errorf("stack that is no longer managed was not forgotten")
+	}
+	if _, ok := orphaned["configured"]; ok {
+		t.Errorf("configured stack was recorded as orphaned")
+	}
+}
+
+// The managed label is added to map and list service labels
+func TestAddManagedLabel(t *testing.T) {
+	composeMap := map[string]any{
+		"services": map[string]any{
+			"no-labels":   map[string]any{"image": "my-image"},
+			"map-labels":  map[string]any{"deploy": map[string]any{"labels": map[string]any{"a": "b"}}},
+			"list-labels": map[string]any{"deploy": map[string]any{"labels": []any{"a=b"}}},
+		},
+	}
+	getConfig().InstanceName = "swarm-cd"
+	err := addManagedLabel(composeMap)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	services := composeMap["services"].(map[string]any)
+	noLabels := services["no-labels"].(map[string]any)["deploy"].(map[string]any)["labels"].(map[string]any)
+	if noLabels[managedLabel] != "swarm-cd" {
+		t.Errorf("managed label missing: %v", noLabels)
+	}
+	mapLabels := services["map-labels"].(map[string]any)["deploy"].(map[string]any)["labels"].(map[string]any)
+	if mapLabels[managedLabel] != "swarm-cd" || mapLabels["a"] != "b" {
+		t.Errorf("unexpected labels: %v", mapLabels)
+	}
+	listLabels := services["list-labels"].(map[string]any)["deploy"].(map[string]any)["labels"].([]any)
+	if len(listLabels) != 2 || listLabels[1] != managedLabel+"=swarm-cd" {
+		t.Errorf("unexpected labels: %v", listLabels)
+	}
+}
@@ -0,0 +1,194 @@
+package swarmcd
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+	"sync"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// guards the stacks slice and the stack status map,
+// which change when stacks are added or removed at runtime
+var stacksLock sync.RWMutex
+
+// refreshStacks adds and removes stacks according to the config, the stacks
+// source and the generators. On errors, the current stacks are kept as they are
+func refreshStacks() error {
+	stackConfigs, err := resolveStackConfigs()
+	if err != nil {
+		return fmt.Errorf("could not update stacks: %w", err)
+	}
+	err = reconcileStacks(stackConfigs)
+	if err != nil {
+		return fmt.Errorf("could not update stacks: %w", err)
+	}
+	return nil
+}
+
+// resolveStackConfigs returns the stacks of the config,
+// the stacks source and the generators
+func resolveStackConfigs() (map[string]*util.StackConfig, error) {
+	stackConfigs := maps.Clone(getConfig().StackConfigs)
+	if stackConfigs == nil {
+		stackConfigs = map[string]*util.StackConfig{}
+	}
+	newSourceStacks := map[string]bool{}
+	if stacksSourceRepo != nil {
+		err := addSourceStacks(stackConfigs, newSourceStacks)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sourceStacks = newSourceStacks
+	addGeneratedStacks(stackConfigs)
+	err := util.ValidateStackConfigs(stackConfigs)
+	if err != nil {
+		return nil, err
+	}
+	return stackConfigs, nil
+}
+
+// reloadConfig reads the configuration files again and applies them.
+// If they are invalid, or can't be applied, the last good config is kept
+func reloadConfig() {
+	logger.Info("reloading configuration...")
+	newConfig, err := util.ReadConfigs()
+	if err != nil {
+		logger.Error(fmt.Sprintf("keeping the last good configuration: %s", err))
+		return
+	}
+	lastGoodConfig := getConfig()
+	config.Store(newConfig)
+	err = applyConfig()
+	if err != nil {
+		logger.Error(fmt.Sprintf("keeping the last good configuration: %s", err))
+		config.Store(lastGoodConfig)
+		err = applyConfig()
+		if err != nil {
+			logger.Error(fmt.Sprintf("could not restore the last good configuration: %s", err))
+		}
+		return
+	}
+	logger.Info("reloaded configuration")
+}
+
+// applyConfig updates the repos, the secret providers, the stacks
+// source, the generators, the clusters and the stacks to match the config
+func applyConfig() error {
+	err := applyStackSources()
+	if err != nil {
+		return err
+	}
+	err = initClusters()
+	if err != nil {
+		return err
+	}
+	return refreshStacks()
+}
+
+// applyStackSources updates the repos, the secret providers, the stacks
+// source and the generators, which stacks are resolved and rendered from
+func applyStackSources() error {
+	repoConfigs := maps.Clone(getConfig().RepoConfigs)
+	for repoName, repoConfig := range sourceRepoConfigs {
+		if _, ok := repoConfigs[repoName]; !ok {
+			repoConfigs[repoName] = repoConfig
+		}
+	}
+	err := reconcileRepos(repoConfigs)
+	if err != nil {
+		return err
+	}
+	err = initSecretProviders()
+	if err != nil {
+		return err
+	}
+	err = initStacksSource()
+	if err != nil {
+		return err
+	}
+	return initGenerators()
+}
+
+// addSourceStacks adds the stacks and repos of the stacks source, and records
+// the names of the stacks it added in addedStacks. Stacks and repos defined
+// locally take precedence over the ones with the same name
+func addSourceStacks(stackConfigs map[string]*util.StackConfig, addedStacks map[string]bool) error {
+	sourceStackConfigs, newSourceRepoConfigs, err := readStacksSource()
+	if err != nil {
+		return err
+	}
+	newRepoConfigs := maps.Clone(getConfig().RepoConfigs)
+	for repoName, repoConfig := range newSourceRepoConfigs {
+		if _, ok := newRepoConfigs[repoName]; ok {
+			logger.Error(fmt.Sprintf("%s repo from stacks source is already defined, ignoring it", repoName))
+			continue
+		}
+		newRepoConfigs[repoName] = repoConfig
+	}
+	err = reconcileRepos(newRepoConfigs)
+	if err != nil {
+		return err
+	}
+	sourceRepoConfigs = newSourceRepoConfigs
+	for stack, stackConfig := range sourceStackConfigs {
+		if _, ok := stackConfigs[stack]; ok {
+			logger.Error(fmt.Sprintf("%s stack from stacks source is already defined, ignoring it", stack))
+			continue
+		}
+		stackConfigs[stack] = stackConfig
+		addedStacks[stack] = true
+	}
+	return nil
+}
+
+// reconcileStacks replaces the stacks with the ones in stackConfigs. Stacks
+// that already exist keep their status and the state of their last deployment
+func reconcileStacks(stackConfigs map[string]*util.StackConfig) error {
+	stackNames := make([]string, 0, len(stackConfigs))
+	for stack := range stackConfigs {
+		stackNames = append(stackNames, stack)
+	}
+	sort.Strings(stackNames)
+
+	newStacks := make([]*swarmStack, 0, len(stackNames))
+	for _, stack := range stackNames {
+		clusterStacks, err := newClusterStacks(stack, stackConfigs)
+		if err != nil {
+			return err
+		}
+		newStacks = append(newStacks, clusterStacks...)
+	}
+
+	stacksLock.Lock()
+	defer stacksLock.Unlock()
+	currentStacks := map[string]*swarmStack{}
+	for _, swarmStack := range stacks {
+		currentStacks[swarmStack.name] = swarmStack
+	}
+	for _, swarmStack := range newStacks {
+		current, ok := currentStacks[swarmStack.name]
+		if !ok {
+			logger.Info(fmt.Sprintf("added %s stack", swarmStack.name))
+			stackStatus[swarmStack.name] = &StackStatus{}
+		} else {
+			// a stack being synced hands its state over once done,
+			// meanwhile the new stack is not synced alongside
+			if !current.syncing {
+				swarmStack.adoptDeploymentState(current)
+			}
+			swarmStack.syncing = current.syncing
+			delete(currentStacks, swarmStack.name)
+		}
+		stackStatus[swarmStack.name].RepoURL = swarmStack.repo.url
+		stackStatus[swarmStack.name].Cluster = swarmStack.cluster
+	}
+	for stack := range currentStacks {
+		logger.Info(fmt.Sprintf("removed %s stack", stack))
+		delete(stackStatus, stack)
+	}
+	stacks = newStacks
+	return nil
+}
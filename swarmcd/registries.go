@@ -0,0 +1,97 @@
+package swarmcd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/docker/cli/cli/command"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/cli/cli/config/types"
+	"github.com/docker/cli/cli/flags"
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// address docker uses for the credentials of docker hub
+const dockerHubAuthAddress = "https://index.docker.io/v1/"
+
+// deployCli returns the docker client to deploy the stack with. Stacks
+// with registries get a client that only knows the credentials of those
+// registries, instead of the ones of the docker config of the environment
+func (swarmStack *swarmStack) deployCli() (*command.DockerCli, error) {
+	cli, err := swarmStack.cli()
+	if err != nil || len(swarmStack.registries) == 0 {
+		return cli, err
+	}
+	authConfigFile, err := registryAuthConfigFile(swarmStack.registries)
+	if err != nil {
+		return nil, fmt.Errorf("could not load registry credentials of %s stack: %w", swarmStack.name, err)
+	}
+	nullFile, _ := os.Open("/dev/null")
+	defer nullFile.Close()
+	stackCli, err := command.NewDockerCli(command.WithOutputStream(nullFile), command.WithErrorStream(nullFile), command.WithAPIClient(cli.Client()))
+	if err != nil {
+		return nil, fmt.Errorf("could not create a docker cli object: %w", err)
+	}
+	err = stackCli.Initialize(flags.NewClientOptions())
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize docker cli object: %w", err)
+	}
+	// the config file is loaded for every cli object, so changing it
+	// doesn't affect other stacks
+	configFile := stackCli.ConfigFile()
+	configFile.AuthConfigs = authConfigFile.AuthConfigs
+	configFile.CredentialHelpers = authConfigFile.CredentialHelpers
+	configFile.CredentialsStore = ""
+	return stackCli, nil
+}
+
+// registryAuthConfigFile returns a docker config file holding only the
+// credentials, or the credential helpers, of the given registries
+func registryAuthConfigFile(registries []string) (*configfile.ConfigFile, error) {
+	configFile := configfile.New("")
+	configFile.CredentialHelpers = map[string]string{}
+	for _, registry := range registries {
+		registryConfig, ok := getConfig().Registries[registry]
+		if !ok {
+			return nil, fmt.Errorf("no such registry: %s", registry)
+		}
+		address := registryAuthAddress(registryConfig.Address)
+		if registryConfig.CredentialHelper != "" {
+			configFile.CredentialHelpers[address] = registryConfig.CredentialHelper
+			continue
+		}
+		password, err := os.ReadFile(registryConfig.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read password file of %s registry: %w", registry, err)
+		}
+		util.RedactSecret("password of "+registry+" registry", strings.TrimSpace(string(password)))
+		configFile.AuthConfigs[address] = types.AuthConfig{
+			Username:      registryConfig.Username,
+			Password:      strings.TrimSpace(string(password)),
+			ServerAddress: address,
+		}
+	}
+	return configFile, nil
+}
+
+// registryAuthAddress returns the address docker looks up the credentials of a registry with
+func registryAuthAddress(address string) string {
+	if address == "docker.io" || address == "index.docker.io" || address == "registry-1.docker.io" {
+		return dockerHubAuthAddress
+	}
+	return address
+}
+
+// configuredRegistries returns the registries of the config with the given address
+func configuredRegistries(host string) []string {
+	var registries []string
+	for registry, registryConfig := range getConfig().Registries {
+		if registryAuthAddress(registryConfig.Address) == registryAuthAddress(host) {
+			registries = append(registries, registry)
+		}
+	}
+	sort.Strings(registries)
+	return registries
+}
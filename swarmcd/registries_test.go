@@ -0,0 +1,43 @@
+package swarmcd
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// Only the credentials of the given registries are in the config file
+func TestRegistryAuthConfigFile(t *testing.T) {
+	passwordFile := path.Join(t.TempDir(), "password")
+	err := os.WriteFile(passwordFile, []byte("s3cr3t\n"), 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	lastConfig := *getConfig()
+	defer func() { *getConfig() = lastConfig }()
+	getConfig().Registries = map[string]*util.RegistryConfig{
+		"hub":  {Address: "docker.io", Username: "me", PasswordFile: passwordFile},
+		"ecr":  {Address: "123.dkr.ecr.eu-west-1.amazonaws.com", CredentialHelper: "ecr-login"},
+		"ghcr": {Address: "ghcr.io", Username: "other", PasswordFile: passwordFile},
+	}
+	configFile, err := registryAuthConfigFile([]string{"hub", "ecr"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	authConfig, ok := configFile.AuthConfigs[dockerHubAuthAddress]
+	if !ok || authConfig.Username != "me" || authConfig.Password != "s3cr3t" {
+		t.Errorf("unexpected docker hub credentials: %v", authConfig)
+	}
+	if _, ok := configFile.AuthConfigs["ghcr.io"]; ok {
+		t.Errorf("unexpected credentials of a registry the stack doesn't use")
+	}
+	if configFile.CredentialHelpers["123.dkr.ecr.eu-west-1.amazonaws.com"] != "ecr-login" {
+		t.Errorf("unexpected credential helpers: %v", configFile.CredentialHelpers)
+	}
+	_, err = registryAuthConfigFile([]string{"missing"})
+	if err == nil {
+		t.Errorf("expected an error for a missing registry")
+	}
+}
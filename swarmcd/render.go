@@ -0,0 +1,138 @@
+package swarmcd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/goccy/go-yaml"
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// RenderStack returns the compose file SwarmCD would deploy for a stack, and
+// the contents of the sops files it decrypted, by path. Stacks are resolved
+// like Run does, so stacks of the stacks source, of generators and of several
+// clusters can be rendered too. If localPath is set, the stack's files are
+// read from there instead of its repo, and no repo is cloned or pulled.
+// With redactSecrets, decrypted values of the compose file and values of the
+// secret function are replaced with util.RedactedValue. Nothing is written
+// to the repo and nothing is deployed
+func RenderStack(name string, localPath string, redactSecrets bool) ([]byte, map[string][]byte, error) {
+	stack, _ := splitClusterStackName(name)
+	stackConfigs, err := renderedStackConfigs(stack, localPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := stackConfigs[stack]; !ok {
+		return nil, nil, fmt.Errorf("%w: %s", ErrStackNotFound, name)
+	}
+	clusterStacks, err := newClusterStacks(stack, stackConfigs)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, swarmStack := range clusterStacks {
+		if swarmStack.name != name {
+			continue
+		}
+		swarmStack.redactSecrets = redactSecrets
+		if localPath == "" {
+			err = swarmStack.pullStack()
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return swarmStack.renderStack()
+	}
+	return nil, nil, fmt.Errorf("%w: %s", ErrStackNotFound, name)
+}
+
+// renderedStackConfigs resolves the stacks like Run does. With a local
+// checkout, no repo is cloned or pulled: only the stacks of the config can
+// be rendered, and the repo of the stack is the checkout
+func renderedStackConfigs(stack string, localPath string) (map[string]*util.StackConfig, error) {
+	if localPath == "" {
+		err := applyStackSources()
+		if err != nil {
+			return nil, err
+		}
+		return resolveStackConfigs()
+	}
+	err := initSecretProviders()
+	if err != nil {
+		return nil, err
+	}
+	stackConfig, ok := getConfig().StackConfigs[stack]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s, stacks from a stacks source or a generator can't be rendered from a local checkout", ErrStackNotFound, stack)
+	}
+	repoConfig, ok := getConfig().RepoConfigs[stackConfig.Repo]
+	if !ok {
+		return nil, fmt.Errorf("error initializing %s stack, no such repo: %s", stack, stackConfig.Repo)
+	}
+	repos = map[string]*stackRepo{stackConfig.Repo: {name: stackConfig.Repo, path: localPath, url: repoConfig.Url, lock: &sync.Mutex{}}}
+	repoConfigs = map[string]util.RepoConfig{stackConfig.Repo: *repoConfig}
+	return getConfig().StackConfigs, nil
+}
+
+// pullStack pulls the branch of the stack's repo
+func (swarmStack *swarmStack) pullStack() error {
+	swarmStack.repo.lock.Lock()
+	defer swarmStack.repo.lock.Unlock()
+	return swarmStack.runPhase(context.Background(), phasePull, func(ctx context.Context) error {
+		_, err := swarmStack.repo.pullChanges(ctx, swarmStack.branch)
+		return err
+	})
+}
+
+// renderStack runs the steps of fetchStack and applyStack that
+// produce the final compose file, without side effects
+func (swarmStack *swarmStack) renderStack() ([]byte, map[string][]byte, error) {
+	stackBytes, err := swarmStack.readStack()
+	if err != nil {
+		return nil, nil, err
+	}
+	stackBytes, err = swarmStack.renderCompose(context.Background(), stackBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	stackContents, err := swarmStack.parseStackString(stackBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	decryptedFiles, err := swarmStack.decryptSopsFiles(context.Background(), stackContents)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt one or more sops files for %s stack: %w", swarmStack.name, err)
+	}
+	err = swarmStack.resolveProviderSecrets(context.Background(), stackContents, decryptedFiles)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = swarmStack.rotateConfigsAndSecrets(stackContents, decryptedFiles)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = swarmStack.externalizeObjects(stackContents, decryptedFiles)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the digests are only part of the compose file when pinned
+	if swarmStack.pinImageDigests {
+		_, err = swarmStack.resolveImageDigests(context.Background(), stackContents)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	_, err = swarmStack.extractHooks(stackContents)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = addManagedLabel(stackContents)
+	if err != nil {
+		return nil, nil, err
+	}
+	composeFileBytes, err := yaml.Marshal(stackContents)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not encode compose file of %s stack: %w", swarmStack.name, err)
+	}
+	return composeFileBytes, decryptedFiles, nil
+}
@@ -0,0 +1,223 @@
+package swarmcd
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/aes"
+	sopsage "github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/cmd/sops/common"
+	"github.com/getsops/sops/v3/cmd/sops/formats"
+	sopsconfig "github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/keyservice"
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// Rendering templates the compose file, rotates configs and
+// labels services, without changing the files in the repo
+func TestRenderStack(t *testing.T) {
+	repoPath := t.TempDir()
+	composeFile := "services:\n  web:\n    image: nginx:{{ .Values.tag }}\nconfigs:\n  conf:\n    file: nginx.conf\n"
+	files := map[string]string{
+		"app/compose.yaml": composeFile,
+		"app/values.yaml":  "tag: \"1.27\"\n",
+		"app/nginx.conf":   "worker_processes 1;\n",
+	}
+	for filePath, contents := range files {
+		err := os.MkdirAll(path.Dir(path.Join(repoPath, filePath)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path.Join(repoPath, filePath), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo := newTestRepo(repoPath)
+	stack := newSwarmStack("web", repo, "main", "app/compose.yaml", nil, "app/values.yaml", false)
+
+	rendered, decryptedFiles, err := stack.renderStack()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(decryptedFiles) != 0 {
+		t.Errorf("expected no decrypted files, got %v", decryptedFiles)
+	}
+	for _, expected := range []string{"image: nginx:1.27", "name: web-conf-", managedLabel} {
+		if !strings.Contains(string(rendered), expected) {
+			t.Errorf("expected rendered compose file to contain %q, got:\n%s", expected, rendered)
+		}
+	}
+	composeBytes, err := os.ReadFile(path.Join(repoPath, "app/compose.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(composeBytes) != composeFile {
+		t.Errorf("compose file in the repo was changed")
+	}
+}
+
+// Generated stacks deployed to several clusters are resolved like Run does
+func TestRenderGeneratedClusterStack(t *testing.T) {
+	sourcePath := t.TempDir()
+	initTestRepo(t, sourcePath, map[string]string{
+		"stacks/web/compose.yaml": "services:\n  web:\n    image: nginx:1.27\n",
+	})
+	lastConfig := getConfig()
+	lastRepos, lastRepoConfigs, lastGenerators := repos, repoConfigs, generators
+	defer func() {
+		config.Store(lastConfig)
+		repos, repoConfigs, generators = lastRepos, lastRepoConfigs, lastGenerators
+	}()
+	config.Store(&util.Config{
+		ReposPath:    t.TempDir(),
+		InstanceName: "swarm-cd",
+		RepoConfigs:  map[string]*util.RepoConfig{"apps": {Url: sourcePath}},
+		Clusters:     map[string]*util.ClusterConfig{"eu": {}, "us": {}},
+		GeneratorConfigs: map[string]*util.GeneratorConfig{
+			"apps": {
+				Repo:   "apps",
+				Branch: "main",
+				Glob:   "stacks/*/compose.yaml",
+				Template: util.GeneratorTemplate{
+					Name:        "{{ .DirName }}",
+					StackConfig: util.StackConfig{Cluster: []string{"eu", "us"}},
+				},
+			},
+		},
+	})
+
+	rendered, _, err := RenderStack("web@eu", "", true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(string(rendered), "image: nginx:1.27") {
+		t.Errorf("unexpected rendered compose file:\n%s", rendered)
+	}
+	_, _, err = RenderStack("web", "", true)
+	if !errors.Is(err, ErrStackNotFound) {
+		t.Errorf("expected stacks of several clusters to be rendered by cluster, got %v", err)
+	}
+}
+
+// Stacks are rendered from a local checkout without cloning their repo
+func TestRenderStackFromLocalPath(t *testing.T) {
+	localPath := t.TempDir()
+	err := os.WriteFile(path.Join(localPath, "compose.yaml"), []byte("services:\n  web:\n    image: nginx:1.27\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reposPath := t.TempDir()
+	lastConfig := getConfig()
+	lastRepos, lastRepoConfigs := repos, repoConfigs
+	defer func() {
+		config.Store(lastConfig)
+		repos, repoConfigs = lastRepos, lastRepoConfigs
+	}()
+	config.Store(&util.Config{
+		ReposPath:    reposPath,
+		InstanceName: "swarm-cd",
+		RepoConfigs:  map[string]*util.RepoConfig{"apps": {Url: "https://example.invalid/apps.git"}},
+		StackConfigs: map[string]*util.StackConfig{"web": {Repo: "apps", Branch: "main", ComposeFile: "compose.yaml"}},
+	})
+
+	rendered, _, err := RenderStack("web", localPath, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(string(rendered), "image: nginx:1.27") {
+		t.Errorf("unexpected rendered compose file:\n%s", rendered)
+	}
+	entries, err := os.ReadDir(reposPath)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("expected no repo to be cloned, got %v, error %v", entries, err)
+	}
+}
+
+// Values of a compose file encrypted with encrypted_regex are hidden
+// from the rendered compose file unless secrets are shown, however short
+func TestRenderStackRedactsEncryptedCompose(t *testing.T) {
+	repoPath := t.TempDir()
+	keyFile := path.Join(t.TempDir(), "age.key")
+	composeFile := "services:\n  web:\n    image: nginx\n    environment:\n      PASSWORD: render-test-password\n      PIN: \"42\"\n"
+	encrypted := encryptYAML(t, []byte(composeFile), "^environment$", keyFile)
+	err := os.WriteFile(path.Join(repoPath, "compose.yaml"), encrypted, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := newTestRepo(repoPath)
+	stack := newSwarmStack("web", repo, "main", "compose.yaml", nil, "", false)
+	stack.sopsKeys = util.SopsKeys{AgeKeyFile: keyFile}
+
+	rendered, _, err := stack.renderStack()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(string(rendered), "render-test-password") {
+		t.Fatalf("expected the compose file to be decrypted, got:\n%s", rendered)
+	}
+	stack.redactSecrets = true
+	redacted, _, err := stack.renderStack()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, value := range []string{"render-test-password", "42"} {
+		if strings.Contains(string(redacted), value) {
+			t.Errorf("expected the decrypted value %s to be redacted, got:\n%s", value, redacted)
+		}
+	}
+	if !strings.Contains(string(redacted), "PIN: "+util.RedactedValue) {
+		t.Errorf("expected decrypted values to be replaced with %s, got:\n%s", util.RedactedValue, redacted)
+	}
+	if !strings.Contains(string(redacted), "image: nginx") {
+		t.Errorf("expected values that were not encrypted to be kept, got:\n%s", redacted)
+	}
+}
+
+// encryptYAML encrypts the values matching encryptedRegex like sops does,
+// with a new age key that is written to keyFile
+func encryptYAML(t *testing.T, plaintext []byte, encryptedRegex string, keyFile string) []byte {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, []byte(identity.String()), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterKey, err := sopsage.MasterKeyFromRecipient(identity.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := common.StoreForFormat(formats.Yaml, sopsconfig.NewStoresConfig())
+	branches, err := store.LoadPlainFile(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := sops.Tree{
+		Branches: branches,
+		Metadata: sops.Metadata{
+			KeyGroups:      []sops.KeyGroup{{masterKey}},
+			EncryptedRegex: encryptedRegex,
+			Version:        "3.9.0",
+		},
+	}
+	dataKey, errs := tree.GenerateDataKeyWithKeyServices([]keyservice.KeyServiceClient{keyservice.NewLocalClient()})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	err = common.EncryptTree(common.EncryptTreeOpts{Tree: &tree, Cipher: aes.NewCipher(), DataKey: dataKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := store.EmitEncryptedFile(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypted
+}
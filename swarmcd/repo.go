@@ -1,23 +1,31 @@
 package swarmcd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
 	"sync"
+	"time"
 
 	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 )
 
 type stackRepo struct {
-	name          string
-	lock          *sync.Mutex
-	url           string
-	gitRepoObject *git.Repository
-	auth          *http.BasicAuth
-	path          string
+	name              string
+	lock              *sync.Mutex
+	url               string
+	gitRepoObject     *git.Repository
+	auth              *http.BasicAuth
+	path              string
+	pushAuth          *http.BasicAuth
+	commitAuthorName  string
+	commitAuthorEmail string
+	commitMessage     string
 }
 
 func newStackRepo(name string, path string, url string, auth *http.BasicAuth) (*stackRepo, error) {
@@ -54,7 +62,21 @@ func newStackRepo(name string, path string, url string, auth *http.BasicAuth) (*
 	}, nil
 }
 
-func (repo *stackRepo) pullChanges(branch string) (revision string, err error) {
+// checkoutOrigin returns the url of the origin of the checkout at path,
+// if there is one
+func checkoutOrigin(path string) (string, bool) {
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return "", false
+	}
+	origin, err := repo.Remote("origin")
+	if err != nil || len(origin.Config().URLs) == 0 {
+		return "", false
+	}
+	return origin.Config().URLs[0], true
+}
+
+func (repo *stackRepo) pullChanges(ctx context.Context, branch string) (revision string, err error) {
 	log := logger.With(slog.String("repo", repo.name), slog.String("branch", branch))
 
 	log.Debug("getting repo worktree...")
@@ -79,7 +101,7 @@ func (repo *stackRepo) pullChanges(branch string) (revision string, err error) {
 	}
 
 	log.Debug("pulling changes...")
-	err = workTree.Pull(pullOptions)
+	err = workTree.PullContext(ctx, pullOptions)
 	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
 		// we get this error when provided creds are invalid
 		// which can mislead users into thinking they
@@ -91,6 +113,10 @@ func (repo *stackRepo) pullChanges(branch string) (revision string, err error) {
 	}
 
 	log.Debug("getting revision...")
+	return repo.headRevision(branch)
+}
+
+func (repo *stackRepo) headRevision(branch string) (string, error) {
 	ref, err := repo.gitRepoObject.Head()
 	if err != nil {
 		return "", fmt.Errorf("could not get HEAD commit hash of %s branch in %s repo: %w", branch, repo.name, err)
@@ -98,3 +124,53 @@ func (repo *stackRepo) pullChanges(branch string) (revision string, err error) {
 	// return HEAD commit short hash
 	return ref.Hash().String()[:8], nil
 }
+
+// commitAndPush commits the given files on top of the checked out
+// revision and pushes the commit to the branch
+func (repo *stackRepo) commitAndPush(ctx context.Context, branch string, files []string, message string) error {
+	log := logger.With(slog.String("repo", repo.name), slog.String("branch", branch))
+
+	workTree, err := repo.gitRepoObject.Worktree()
+	if err != nil {
+		return fmt.Errorf("could not get %s repo worktree: %w", repo.name, err)
+	}
+	for _, file := range files {
+		_, err = workTree.Add(file)
+		if err != nil {
+			return fmt.Errorf("could not stage %s in %s repo: %w", file, repo.name, err)
+		}
+	}
+
+	log.Debug("committing changes...")
+	author := &object.Signature{
+		Name:  repo.commitAuthorName,
+		Email: repo.commitAuthorEmail,
+		When:  time.Now(),
+	}
+	if author.Name == "" {
+		author.Name = "SwarmCD"
+	}
+	if author.Email == "" {
+		author.Email = "swarm-cd@localhost"
+	}
+	hash, err := workTree.Commit(message, &git.CommitOptions{Author: author})
+	if err != nil {
+		return fmt.Errorf("could not commit changes in %s repo: %w", repo.name, err)
+	}
+
+	log.Debug("pushing changes...", "commit", hash.String())
+	err = repo.gitRepoObject.PushContext(ctx, &git.PushOptions{
+		RemoteName: "origin",
+		Auth:       repo.pushAuth,
+		RefSpecs: []gitconfig.RefSpec{
+			gitconfig.RefSpec(hash.String() + ":" + plumbing.NewBranchReferenceName(branch).String()),
+		},
+	})
+	if err != nil {
+		if err.Error() == "authentication required" {
+			err = fmt.Errorf("authentication failed")
+		}
+		return fmt.Errorf("could not push %s branch in %s repo: %w", branch, repo.name, err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package swarmcd
+
+import (
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+func initTestCheckout(t *testing.T, checkoutPath string, url string) {
+	repo, err := git.PlainInit(checkoutPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{url}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// initTestRepo commits files to a new repo on the main branch
+func initTestRepo(t *testing.T, repoPath string, files map[string]string) {
+	repo, err := git.PlainInitWithOptions(repoPath, &git.PlainInitOptions{
+		InitOptions: git.InitOptions{DefaultBranch: plumbing.NewBranchReferenceName("main")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	workTree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for filePath, contents := range files {
+		err = os.MkdirAll(path.Dir(path.Join(repoPath, filePath)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path.Join(repoPath, filePath), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = workTree.Add(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	signature := &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}
+	_, err = workTree.Commit("add stacks", &git.CommitOptions{Author: signature})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Repos of the same url keep their checkout and lock on reload
+func TestReconcileReposUpdatesInPlace(t *testing.T) {
+	lastRepos, lastRepoConfigs := repos, repoConfigs
+	defer func() { repos, repoConfigs = lastRepos, lastRepoConfigs }()
+	url := "https://example.com/stacks.git"
+	repo := &stackRepo{name: "stacks", path: "stacks", url: url, lock: &sync.Mutex{}}
+	repos = map[string]*stackRepo{"stacks": repo}
+	repoConfigs = map[string]util.RepoConfig{"stacks": {Url: url}}
+
+	err := reconcileRepos(map[string]*util.RepoConfig{
+		"stacks": {Url: url, Username: "deploy", Password: "hunter22", CommitMessage: "bump images"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repos["stacks"] != repo {
+		t.Fatal("expected the repo to be kept")
+	}
+	if repo.auth == nil || repo.auth.Username != "deploy" || repo.pushAuth != repo.auth || repo.commitMessage != "bump images" {
+		t.Errorf("expected the repo settings to be updated, got %+v", repo)
+	}
+
+	err = reconcileRepos(map[string]*util.RepoConfig{"stacks": {Url: url, Username: "deploy"}})
+	if err == nil {
+		t.Fatal("expected an invalid repo config to fail")
+	}
+	if repo.auth.Password != "hunter22" {
+		t.Error("expected a failed reload not to change the repo")
+	}
+}
+
+// A repo whose url changed is cloned next to the old checkout
+func TestRepoPath(t *testing.T) {
+	lastReposPath := getConfig().ReposPath
+	defer func() { getConfig().ReposPath = lastReposPath }()
+	getConfig().ReposPath = t.TempDir()
+	checkoutPath := path.Join(getConfig().ReposPath, "stacks")
+	if repoPath("stacks", "https://example.com/old.git") != checkoutPath {
+		t.Error("expected a new repo to be cloned into its directory")
+	}
+	initTestCheckout(t, checkoutPath, "https://example.com/old.git")
+	if repoPath("stacks", "https://example.com/old.git") != checkoutPath {
+		t.Error("expected a checkout of the same url to be reused")
+	}
+	newPath := repoPath("stacks", "https://example.com/new.git")
+	if newPath == checkoutPath || path.Dir(newPath) != getConfig().ReposPath {
+		t.Errorf("expected a checkout of another url to be left alone, got %s", newPath)
+	}
+}
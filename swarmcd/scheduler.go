@@ -0,0 +1,236 @@
+package swarmcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// how often the main loop looks for stacks that are due
+const scheduleInterval = time.Second
+
+// scheduler queues each stack when its sync is due. A stack is
+// never queued twice, nor while a worker is syncing it
+type scheduler struct {
+	lock  sync.Mutex
+	ready *sync.Cond
+	queue []string
+	// stacks that are queued or being synced
+	pending  map[string]bool
+	nextSync map[string]time.Time
+	// whether the last sync of each stack left it in sync
+	synced map[string]bool
+}
+
+func newScheduler() *scheduler {
+	scheduler := &scheduler{
+		pending:  map[string]bool{},
+		nextSync: map[string]time.Time{},
+		synced:   map[string]bool{},
+	}
+	scheduler.ready = sync.NewCond(&scheduler.lock)
+	return scheduler
+}
+
+// add queues a stack, returns false if it is already pending
+func (scheduler *scheduler) add(name string) bool {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	if scheduler.pending[name] {
+		return false
+	}
+	scheduler.pending[name] = true
+	scheduler.queue = append(scheduler.queue, name)
+	scheduler.ready.Signal()
+	return true
+}
+
+// next blocks until a stack is queued and takes it from the queue
+func (scheduler *scheduler) next() string {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	for len(scheduler.queue) == 0 {
+		scheduler.ready.Wait()
+	}
+	name := scheduler.queue[0]
+	scheduler.queue = scheduler.queue[1:]
+	return name
+}
+
+// done records the result of a sync and when the stack is due next
+func (scheduler *scheduler) done(name string, success bool, nextSync time.Time) {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	delete(scheduler.pending, name)
+	scheduler.synced[name] = success
+	scheduler.nextSync[name] = nextSync
+}
+
+func (scheduler *scheduler) isSynced(name string) bool {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	return scheduler.synced[name]
+}
+
+// syncAll makes every stack due right away
+func (scheduler *scheduler) syncAll() {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	clear(scheduler.nextSync)
+}
+
+// scheduleDue queues the stacks that are due. Stacks wait for
+// their dependencies that are due or pending to be synced first.
+// Stacks that are not in the given ones are forgotten
+func (scheduler *scheduler) scheduleDue(swarmStacks []*swarmStack, now time.Time) {
+	var due []string
+	scheduler.lock.Lock()
+	names := map[string]bool{}
+	for _, swarmStack := range swarmStacks {
+		names[swarmStack.name] = true
+	}
+	for name := range scheduler.nextSync {
+		if !names[name] {
+			delete(scheduler.nextSync, name)
+			delete(scheduler.synced, name)
+		}
+	}
+	isDue := func(name string) bool {
+		return !scheduler.pending[name] && !now.Before(scheduler.nextSync[name])
+	}
+	for _, swarmStack := range swarmStacks {
+		if !isDue(swarmStack.name) {
+			continue
+		}
+		waiting := false
+		for _, dependency := range swarmStack.dependsOn {
+			if names[dependency] && (scheduler.pending[dependency] || isDue(dependency)) {
+				waiting = true
+				break
+			}
+		}
+		if !waiting {
+			due = append(due, swarmStack.name)
+		}
+	}
+	scheduler.lock.Unlock()
+	for _, name := range due {
+		scheduler.add(name)
+	}
+}
+
+// runWorker syncs the stacks taken from the queue, one at a time
+func runWorker(scheduler *scheduler) {
+	for {
+		name := scheduler.next()
+		success := false
+		swarmStack, err := claimStack(name)
+		switch {
+		case err == nil:
+			success = syncScheduledStack(swarmStack, scheduler)
+			releaseStack(swarmStack)
+		case errors.Is(err, ErrSyncInProgress):
+			// a manual sync is running, the stack is checked again later
+			success = scheduler.isSynced(name)
+		}
+		scheduler.done(name, success, time.Now().Add(time.Duration(getConfig().UpdateInterval)*time.Second))
+	}
+}
+
+func syncScheduledStack(swarmStack *swarmStack, scheduler *scheduler) bool {
+	ctx, cancel := swarmStack.stackContext()
+	defer cancel()
+	if err := checkLeader(); err != nil {
+		logger.Warn(fmt.Sprintf("skipped updating %s stack: %s", swarmStack.name, err))
+		return false
+	}
+	err := swarmStack.wrapTimeout(ctx, waitForDependencies(ctx, swarmStack, scheduler))
+	if err != nil {
+		updateStatus(swarmStack.name, func(status *StackStatus) { setStatusError(status, err) })
+		logger.Error(err.Error())
+		return false
+	}
+
+	repoLock := swarmStack.repo.lock
+	repoLock.Lock()
+	defer repoLock.Unlock()
+
+	return syncStack(ctx, swarmStack)
+}
+
+// waitForDependencies checks that the last sync of each dependency
+// succeeded, and waits for them to become healthy
+func waitForDependencies(ctx context.Context, swarmStack *swarmStack, scheduler *scheduler) error {
+	timeout := time.Duration(getConfig().DependencyTimeout) * time.Second
+	for _, dependency := range swarmStack.dependsOn {
+		dependencyStack := findStack(dependency)
+		if dependencyStack == nil || !scheduler.isSynced(dependency) {
+			return fmt.Errorf("skipped updating %s stack, dependency %s was not synced", swarmStack.name, dependency)
+		}
+		logger.Debug(fmt.Sprintf("waiting for %s stack to become healthy", dependency), "stack", swarmStack.name)
+		cli, err := dependencyStack.cli()
+		if err != nil {
+			return fmt.Errorf("skipped updating %s stack: %w", swarmStack.name, err)
+		}
+		err = waitForStackHealthy(ctx, cli, dependencyStack.namespace, timeout)
+		if err != nil {
+			return fmt.Errorf("skipped updating %s stack: %w", swarmStack.name, err)
+		}
+	}
+	return nil
+}
+
+// claimStack marks the current stack with the given name as being
+// synced, so that reloads leave its deployment state to the sync,
+// and no other sync of the stack runs meanwhile
+func claimStack(name string) (*swarmStack, error) {
+	stacksLock.Lock()
+	defer stacksLock.Unlock()
+	for _, swarmStack := range stacks {
+		if swarmStack.name != name {
+			continue
+		}
+		if swarmStack.syncing {
+			return nil, fmt.Errorf("%w: %s stack", ErrSyncInProgress, name)
+		}
+		swarmStack.syncing = true
+		return swarmStack, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrStackNotFound, name)
+}
+
+// releaseStack hands the deployment state of a synced stack
+// over to the stack that replaced it during the sync, if any
+func releaseStack(swarmStack *swarmStack) {
+	stacksLock.Lock()
+	defer stacksLock.Unlock()
+	swarmStack.syncing = false
+	for _, current := range stacks {
+		if current.name == swarmStack.name && current != swarmStack {
+			current.adoptDeploymentState(swarmStack)
+			current.syncing = false
+		}
+	}
+}
+
+// updateStatus changes the status of a stack. Statuses are only changed
+// through it, under the stacks lock that GetStackStatus reads them with.
+// Updates of stacks removed in the meantime are dropped
+func updateStatus(name string, update func(status *StackStatus)) {
+	stacksLock.Lock()
+	defer stacksLock.Unlock()
+	if status, ok := stackStatus[name]; ok {
+		update(status)
+	}
+}
+
+// isStatusSynced reports whether the last update of
+// a stack succeeded and left it in sync
+func isStatusSynced(name string) bool {
+	stacksLock.RLock()
+	defer stacksLock.RUnlock()
+	status, ok := stackStatus[name]
+	return ok && status.Error == "" && status.SyncStatus == syncStatusSynced
+}
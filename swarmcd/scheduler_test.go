@@ -0,0 +1,64 @@
+package swarmcd
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// Stacks that are queued or being synced are not queued again
+func TestSchedulerQueuesStacksOnce(t *testing.T) {
+	scheduler := newScheduler()
+	if !scheduler.add("nginx") {
+		t.Fatal("expected nginx to be queued")
+	}
+	if scheduler.add("nginx") {
+		t.Error("nginx was queued twice")
+	}
+	if name := scheduler.next(); name != "nginx" {
+		t.Fatalf("expected nginx, got %s", name)
+	}
+	if scheduler.add("nginx") {
+		t.Error("nginx was queued while being synced")
+	}
+	scheduler.done("nginx", true, time.Now())
+	if !scheduler.add("nginx") {
+		t.Error("expected nginx to be queued once synced")
+	}
+}
+
+// Stacks are queued when due, after their dependencies
+func TestSchedulerScheduleDue(t *testing.T) {
+	now := time.Now()
+	database := &swarmStack{name: "database"}
+	api := &swarmStack{name: "api", dependsOn: []string{"database"}}
+	web := &swarmStack{name: "web"}
+	swarmStacks := []*swarmStack{api, database, web}
+	scheduler := newScheduler()
+
+	scheduler.scheduleDue(swarmStacks, now)
+	if !slices.Equal(scheduler.queue, []string{"database", "web"}) {
+		t.Fatalf("expected database and web to be queued, got %v", scheduler.queue)
+	}
+	scheduler.next()
+	scheduler.next()
+	scheduler.done("web", true, now.Add(time.Minute))
+	scheduler.scheduleDue(swarmStacks, now)
+	if len(scheduler.queue) != 0 {
+		t.Fatalf("expected api to wait for database, got %v", scheduler.queue)
+	}
+
+	scheduler.done("database", true, now.Add(time.Minute))
+	scheduler.scheduleDue(swarmStacks, now)
+	if !slices.Equal(scheduler.queue, []string{"api"}) {
+		t.Fatalf("expected api to be queued, got %v", scheduler.queue)
+	}
+	if !scheduler.isSynced("database") {
+		t.Error("expected database to be synced")
+	}
+
+	scheduler.scheduleDue([]*swarmStack{api}, now)
+	if _, ok := scheduler.nextSync["web"]; ok {
+		t.Error("expected removed web stack to be forgotten")
+	}
+}
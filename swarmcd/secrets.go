@@ -0,0 +1,163 @@
+package swarmcd
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// compose secrets extension that reads the secret from a provider
+const providerSecretKey = "x-swarm-cd-secret"
+
+// scopedSecretProvider is a provider with the
+// paths the stacks and repos may read from it
+type scopedSecretProvider struct {
+	util.SecretProvider
+	config *util.SecretProviderConfig
+}
+
+var secretProviders map[string]scopedSecretProvider = map[string]scopedSecretProvider{}
+
+func initSecretProviders() error {
+	providers := map[string]scopedSecretProvider{}
+	cacheTTL := time.Duration(getConfig().SecretCacheTTL) * time.Second
+	for providerName, providerConfig := range getConfig().SecretProviders {
+		provider, err := util.NewSecretProvider(providerConfig)
+		if err != nil {
+			return fmt.Errorf("error initializing %s secret provider: %w", providerName, err)
+		}
+		providers[providerName] = scopedSecretProvider{util.NewCachingProvider(providerName, provider, cacheTTL), providerConfig}
+	}
+	secretProviders = providers
+	return nil
+}
+
+// getSecret reads a secret for the stack, if the provider
+// grants the stack, or its repo, access to the path
+func (swarmStack *swarmStack) getSecret(ctx context.Context, providerName string, secretPath string, key string) (string, error) {
+	provider, ok := secretProviders[providerName]
+	if !ok {
+		return "", fmt.Errorf("no such secret provider: %s", providerName)
+	}
+	stack, _ := splitClusterStackName(swarmStack.name)
+	if !provider.config.Allows(stack, swarmStack.repo.name, secretPath) {
+		return "", fmt.Errorf("%s secret provider does not grant %s stack access to %s", providerName, swarmStack.name, secretPath)
+	}
+	return provider.GetSecret(ctx, secretPath, key)
+}
+
+// secretTemplateFuncs are available in compose templates:
+// {{ secret "provider" "path" "key" }}, the key is optional
+func (swarmStack *swarmStack) secretTemplateFuncs(ctx context.Context) template.FuncMap {
+	return template.FuncMap{
+		"secret": func(providerName string, secretPath string, key ...string) (string, error) {
+			if len(key) > 1 {
+				return "", fmt.Errorf("secret takes at most one key")
+			}
+			value, err := swarmStack.getSecret(ctx, providerName, secretPath, append(key, "")[0])
+			if err == nil && swarmStack.redactSecrets {
+				return util.RedactedValue, nil
+			}
+			return value, err
+		},
+	}
+}
+
+// callsSecret tells if a compose file calls the secret function. Compose
+// files are only rendered as templates with a values file, so that the
+// templates of docker, like {{.Task.Slot}}, are left as they are
+func callsSecret(composeFile []byte) bool {
+	templ, err := template.New("").Funcs(template.FuncMap{"secret": func() string { return "" }}).Parse(string(composeFile))
+	if err != nil {
+		return false
+	}
+	for _, namedTemplate := range templ.Templates() {
+		if namedTemplate.Tree != nil && nodeCallsSecret(namedTemplate.Tree.Root) {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeCallsSecret(node parse.Node) bool {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return false
+		}
+		return slices.ContainsFunc(node.Nodes, nodeCallsSecret)
+	case *parse.ActionNode:
+		return nodeCallsSecret(node.Pipe)
+	case *parse.TemplateNode:
+		return nodeCallsSecret(node.Pipe)
+	case *parse.IfNode:
+		return nodeCallsSecret(node.Pipe) || nodeCallsSecret(node.List) || nodeCallsSecret(node.ElseList)
+	case *parse.RangeNode:
+		return nodeCallsSecret(node.Pipe) || nodeCallsSecret(node.List) || nodeCallsSecret(node.ElseList)
+	case *parse.WithNode:
+		return nodeCallsSecret(node.Pipe) || nodeCallsSecret(node.List) || nodeCallsSecret(node.ElseList)
+	case *parse.PipeNode:
+		if node == nil {
+			return false
+		}
+		for _, command := range node.Cmds {
+			if slices.ContainsFunc(command.Args, nodeCallsSecret) {
+				return true
+			}
+		}
+	case *parse.IdentifierNode:
+		return node.Ident == "secret"
+	}
+	return false
+}
+
+// resolveProviderSecrets reads the compose secrets that come from a provider
+// into decryptedFiles, and points their file to where they are written
+func (swarmStack *swarmStack) resolveProviderSecrets(ctx context.Context, composeMap map[string]any, decryptedFiles map[string][]byte) error {
+	secrets, ok := composeMap["secrets"].(map[string]any)
+	if !ok {
+		return nil
+	}
+	secretNames := make([]string, 0, len(secrets))
+	for secretName := range secrets {
+		secretNames = append(secretNames, secretName)
+	}
+	sort.Strings(secretNames)
+	for _, secretName := range secretNames {
+		secretMap, ok := secrets[secretName].(map[string]any)
+		if !ok {
+			continue
+		}
+		source, ok := secretMap[providerSecretKey]
+		if !ok {
+			continue
+		}
+		sourceMap, ok := source.(map[string]any)
+		if !ok {
+			return fmt.Errorf("invalid compose file: %s of %s secret must be a map", providerSecretKey, secretName)
+		}
+		providerName, _ := sourceMap["provider"].(string)
+		secretPath, _ := sourceMap["path"].(string)
+		key, _ := sourceMap["key"].(string)
+		if providerName == "" || secretPath == "" {
+			return fmt.Errorf("invalid compose file: %s of %s secret requires provider and path", providerSecretKey, secretName)
+		}
+		value, err := swarmStack.getSecret(ctx, providerName, secretPath, key)
+		if err != nil {
+			return fmt.Errorf("could not read %s secret of %s stack: %w", secretName, swarmStack.name, err)
+		}
+		secretFile := fmt.Sprintf(".%s-secret-%s", swarmStack.name, secretName)
+		secretFilePath := path.Join(swarmStack.repo.path, path.Dir(swarmStack.composePath), secretFile)
+		decryptedFiles[secretFilePath] = []byte(value)
+		delete(secretMap, providerSecretKey)
+		secretMap["file"] = secretFile
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package swarmcd
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"text/template"
+
+	sopsage "github.com/getsops/sops/v3/age"
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+func useEnvSecretProvider(t *testing.T) {
+	providers := secretProviders
+	t.Cleanup(func() { secretProviders = providers })
+	providerConfig := &util.SecretProviderConfig{
+		Type:    "env",
+		Allowed: []string{"DB_PASSWORD", "API_TOKEN"},
+		Stacks:  map[string][]string{"app": {"DB_*"}},
+	}
+	provider, err := util.NewSecretProvider(providerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretProviders = map[string]scopedSecretProvider{"env": {provider, providerConfig}}
+	t.Setenv("DB_PASSWORD", "hunter22")
+	t.Setenv("API_TOKEN", "abcd1234")
+}
+
+// Compose secrets from providers are read into memory and
+// pointed to the file they are written to before deploying
+func TestResolveProviderSecrets(t *testing.T) {
+	useEnvSecretProvider(t)
+	repo := newTestRepo("repo")
+	stack := newSwarmStack("app", repo, "main", "stacks/compose.yaml", nil, "", true)
+	composeMap := map[string]any{
+		"secrets": map[string]any{
+			"db_password": map[string]any{
+				providerSecretKey: map[string]any{"provider": "env", "path": "DB_PASSWORD"},
+			},
+		},
+	}
+	sopsFiles, err := discoverSecrets(composeMap, stack.composePath)
+	if err != nil || len(sopsFiles) != 0 {
+		t.Fatalf("expected provider secrets not to be discovered, got %v, error %v", sopsFiles, err)
+	}
+	decryptedFiles := map[string][]byte{}
+	err = stack.resolveProviderSecrets(context.Background(), composeMap, decryptedFiles)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	secret := composeMap["secrets"].(map[string]any)["db_password"].(map[string]any)
+	if secret["file"] != ".app-secret-db_password" {
+		t.Errorf("unexpected secret file %v", secret["file"])
+	}
+	if _, ok := secret[providerSecretKey]; ok {
+		t.Errorf("expected the provider extension to be removed")
+	}
+	if string(decryptedFiles["repo/stacks/.app-secret-db_password"]) != "hunter22" {
+		t.Errorf("unexpected decrypted files %v", decryptedFiles)
+	}
+}
+
+func TestSecretTemplateFunc(t *testing.T) {
+	useEnvSecretProvider(t)
+	stack := newSwarmStack("app@prod", newTestRepo("repo"), "main", "compose.yaml", nil, "", false)
+	templ, err := template.New("app").Funcs(stack.secretTemplateFuncs(context.Background())).Parse(`password: {{ secret "env" "DB_PASSWORD" }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rendered strings.Builder
+	err = templ.Execute(&rendered, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if rendered.String() != "password: hunter22" {
+		t.Errorf("unexpected rendered template %q", rendered.String())
+	}
+
+	stack.redactSecrets = true
+	rendered.Reset()
+	err = templ.Funcs(stack.secretTemplateFuncs(context.Background())).Execute(&rendered, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if rendered.String() != "password: "+util.RedactedValue {
+		t.Errorf("expected the secret to be redacted when rendering, got %q", rendered.String())
+	}
+}
+
+// Stacks only read the paths their provider grants them or their repo
+func TestSecretProviderScope(t *testing.T) {
+	useEnvSecretProvider(t)
+	secretProviders["env"].config.Repos = map[string][]string{"shared": {"API_TOKEN"}}
+	app := newSwarmStack("app", newTestRepo("repo"), "main", "compose.yaml", nil, "", false)
+	other := newSwarmStack("other", newTestRepo("repo"), "main", "compose.yaml", nil, "", false)
+	sharedRepo := newTestRepo("shared")
+	sharedRepo.name = "shared"
+	shared := newSwarmStack("other", sharedRepo, "main", "compose.yaml", nil, "", false)
+	ctx := context.Background()
+
+	if _, err := app.getSecret(ctx, "env", "DB_PASSWORD", ""); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err := app.getSecret(ctx, "env", "API_TOKEN", ""); err == nil {
+		t.Errorf("expected paths that are not granted to the stack to be rejected")
+	}
+	if _, err := other.getSecret(ctx, "env", "DB_PASSWORD", ""); err == nil {
+		t.Errorf("expected stacks without grants to be rejected")
+	}
+	if _, err := shared.getSecret(ctx, "env", "API_TOKEN", ""); err != nil {
+		t.Errorf("unexpected error for a path granted to the repo: %s", err)
+	}
+}
+
+// Compose files that call secret fail without a values file,
+// instead of being deployed with the call left in them
+func TestRenderComposeWithoutValuesFile(t *testing.T) {
+	stack := newSwarmStack("app", newTestRepo("repo"), "main", "compose.yaml", nil, "", false)
+	tests := []struct {
+		compose string
+		wantErr bool
+	}{
+		{"hostname: \"{{.Service.Name}}-{{.Task.Slot}}\"", false},
+		{"password: {{ secret \"env\" \"DB_PASSWORD\" }}", true},
+		{"{{ if true }}password: {{ secret \"env\" \"DB_PASSWORD\" | printf \"%s\" }}{{ end }}", true},
+		{"password: {{ .Values.secret }}", false},
+		{"not a template {{", false},
+	}
+	for _, tt := range tests {
+		rendered, err := stack.renderCompose(context.Background(), []byte(tt.compose))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("renderCompose(%q) error = %v, want error %t", tt.compose, err, tt.wantErr)
+		}
+		if err == nil && string(rendered) != tt.compose {
+			t.Errorf("expected %q to be left as it is, got %q", tt.compose, rendered)
+		}
+	}
+}
+
+// Stacks only use allowed key files, and stacks or repos of the stacks
+// source only the ones allowed for it, even through a repo of the config
+func TestCheckSopsKeys(t *testing.T) {
+	lastSourceStacks, lastSourceRepoConfigs := sourceStacks, sourceRepoConfigs
+	getConfig().SopsKeyFiles = []string{"/secrets/team-a.key", "/secrets/team-b.key"}
+	getConfig().StacksSource = &util.StacksSourceConfig{SopsKeyFiles: []string{"/secrets/team-a.key"}}
+	getConfig().RepoConfigs = map[string]*util.RepoConfig{"team-b": {}}
+	sourceStacks = map[string]bool{"source-app": true}
+	sourceRepoConfigs = map[string]*util.RepoConfig{"source-repo": {}, "team-b": {}}
+	defer func() {
+		getConfig().SopsKeyFiles = nil
+		getConfig().StacksSource = nil
+		getConfig().RepoConfigs = nil
+		sourceStacks, sourceRepoConfigs = lastSourceStacks, lastSourceRepoConfigs
+	}()
+	teamA := util.SopsKeys{AgeKeyFile: "/secrets/team-a.key"}
+	teamB := util.SopsKeys{AgeKeyFile: "/secrets/team-b.key"}
+
+	if err := checkSopsKeys("app", "team-b", util.SopsKeys{AgeKeyFile: "/secrets/team-c.key"}); err == nil {
+		t.Errorf("expected key files that are not allowed to be rejected")
+	}
+	if err := checkSopsKeys("app@prod", "team-b", teamB); err != nil {
+		t.Errorf("unexpected error for a stack of the config: %s", err)
+	}
+	if err := checkSopsKeys("source-app@prod", "team-b", teamB); err == nil {
+		t.Errorf("expected stacks of the stacks source to be rejected with the keys of a repo of the config")
+	}
+	if err := checkSopsKeys("app", "source-repo", teamB); err == nil {
+		t.Errorf("expected repos of the stacks source to be rejected with keys not allowed for it")
+	}
+	if err := checkSopsKeys("source-app", "source-repo", teamA); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+// Stacks and repos of the stacks source only send the
+// credentials of the registries allowed for it
+func TestCheckRegistries(t *testing.T) {
+	lastSourceStacks := sourceStacks
+	getConfig().StacksSource = &util.StacksSourceConfig{Registries: []string{"ghcr"}}
+	sourceStacks = map[string]bool{"source-app": true}
+	defer func() {
+		getConfig().StacksSource = nil
+		sourceStacks = lastSourceStacks
+	}()
+
+	if err := checkRegistries("app", "team-b", []string{"ecr"}); err != nil {
+		t.Errorf("unexpected error for a stack of the config: %s", err)
+	}
+	if err := checkRegistries("source-app", "team-b", []string{"ghcr", "ecr"}); err == nil {
+		t.Errorf("expected registries not allowed for the stacks source to be rejected")
+	}
+	if err := checkRegistries("source-app", "team-b", []string{"ghcr"}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+// Once sops_key_files is set, stacks without key files of
+// their own don't decrypt with the keys of the environment
+func TestKeyFilesOnly(t *testing.T) {
+	repoPath := t.TempDir()
+	keyFile := path.Join(t.TempDir(), "age.key")
+	encrypted := encryptYAML(t, []byte("services:\n  web:\n    image: nginx\n    environment:\n      PASSWORD: hunter22\n"), "^environment$", keyFile)
+	err := os.WriteFile(path.Join(repoPath, "compose.yaml"), encrypted, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(sopsage.SopsAgeKeyFileEnv, keyFile)
+	stack := newSwarmStack("web", newTestRepo(repoPath), "main", "compose.yaml", nil, "", false)
+
+	if _, err := stack.readStack(); err != nil {
+		t.Fatalf("expected the key of the environment to be used by default, got %s", err)
+	}
+	stack.sopsKeys = util.SopsKeys{KeyFilesOnly: true}
+	if _, err := stack.readStack(); err == nil {
+		t.Errorf("expected the key of the environment not to be used")
+	}
+}
@@ -0,0 +1,118 @@
+package swarmcd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// repo holding the stacks file, and optionally the repos file
+var stacksSourceRepo *stackRepo
+
+// repos read from the stacks source last time
+var sourceRepoConfigs map[string]*util.RepoConfig
+
+// names of the stacks defined by the stacks source, rather than the config
+var sourceStacks map[string]bool
+
+func initStacksSource() error {
+	stacksSourceRepo = nil
+	if getConfig().StacksSource == nil {
+		return nil
+	}
+	repo, ok := repos[getConfig().StacksSource.Repo]
+	if !ok {
+		return fmt.Errorf("error initializing stacks source, no such repo: %s", getConfig().StacksSource.Repo)
+	}
+	stacksSourceRepo = repo
+	return nil
+}
+
+// readStacksSource pulls the stacks source repo and
+// reads the stacks and repos defined in it
+func readStacksSource() (map[string]*util.StackConfig, map[string]*util.RepoConfig, error) {
+	stacksSourceRepo.lock.Lock()
+	defer stacksSourceRepo.lock.Unlock()
+	ctx, cancel := withTimeout(context.Background(), getConfig().Timeouts.Pull)
+	defer cancel()
+	_, err := stacksSourceRepo.pullChanges(ctx, getConfig().StacksSource.Branch)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read stacks source: %w", err)
+	}
+	stackConfigs, err := readSourceFile(getConfig().StacksSource.StacksFile, util.ParseStackConfigs)
+	if err != nil {
+		return nil, nil, err
+	}
+	var repoConfigs map[string]*util.RepoConfig
+	if getConfig().StacksSource.ReposFile != "" {
+		repoConfigs, err = readSourceFile(getConfig().StacksSource.ReposFile, util.ParseRepoConfigs)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return stackConfigs, repoConfigs, nil
+}
+
+func readSourceFile[T any](filePath string, parse func([]byte) (T, error)) (T, error) {
+	var result T
+	data, err := os.ReadFile(path.Join(stacksSourceRepo.path, filePath))
+	if err != nil {
+		return result, fmt.Errorf("could not read %s from stacks source: %w", filePath, err)
+	}
+	result, err = parse(data)
+	if err != nil {
+		return result, fmt.Errorf("could not parse %s from stacks source: %w", filePath, err)
+	}
+	return result, nil
+}
+
+// reconcileRepos replaces the repos with the ones in newRepoConfigs.
+// Repos whose config hasn't changed are kept as they are, and repos whose
+// url hasn't changed are updated in place. Repos with a new url are cloned
+// again, next to the checkout of the old url that stacks may still use
+func reconcileRepos(newRepoConfigs map[string]*util.RepoConfig) error {
+	newRepos := map[string]*stackRepo{}
+	// repos are updated in place only once every repo config is valid
+	updates := []func(){}
+	for repoName, repoConfig := range newRepoConfigs {
+		repo, ok := repos[repoName]
+		if ok && reflect.DeepEqual(repoConfigs[repoName], *repoConfig) {
+			newRepos[repoName] = repo
+			continue
+		}
+		if ok && repo.url == repoConfig.Url {
+			update, err := repoUpdateFromConfig(repo, repoConfig)
+			if err != nil {
+				return err
+			}
+			updates = append(updates, update)
+			logger.Info(fmt.Sprintf("updated %s repo", repoName))
+			newRepos[repoName] = repo
+			continue
+		}
+		repo, err := newRepoFromConfig(repoName, repoConfig)
+		if err != nil {
+			return err
+		}
+		logger.Info(fmt.Sprintf("added %s repo", repoName))
+		newRepos[repoName] = repo
+	}
+	for repoName := range repos {
+		if _, ok := newRepos[repoName]; !ok {
+			logger.Info(fmt.Sprintf("removed %s repo", repoName))
+		}
+	}
+	for _, update := range updates {
+		update()
+	}
+	repos = newRepos
+	repoConfigs = map[string]util.RepoConfig{}
+	for repoName, repoConfig := range newRepoConfigs {
+		repoConfigs[repoName] = *repoConfig
+	}
+	return nil
+}
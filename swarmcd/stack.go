@@ -2,16 +2,29 @@ package swarmcd
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"path"
+	"slices"
+	"sort"
+	"strings"
 	"text/template"
+	"time"
 
-	"github.com/docker/cli/cli/command/stack"
+	"github.com/docker/cli/cli/command"
+	"github.com/docker/cli/cli/command/stack/options"
+	stackswarm "github.com/docker/cli/cli/command/stack/swarm"
+	composeloader "github.com/docker/cli/cli/compose/loader"
+	"github.com/docker/cli/cli/compose/schema"
+	composetypes "github.com/docker/cli/cli/compose/types"
+	"github.com/docker/docker/api/types/swarm"
 	"github.com/goccy/go-yaml"
 	"github.com/m-adawi/swarm-cd/util"
+	"github.com/spf13/pflag"
 )
 
 type swarmStack struct {
@@ -22,11 +35,48 @@ type swarmStack struct {
 	sopsFiles       []string
 	valuesFile      string
 	discoverSecrets bool
+	sopsKeys        util.SopsKeys
+	dependsOn       []string
+	preDeployHooks  []string
+	postDeployHooks []string
+	hookTimeout     time.Duration
+	imageUpdates    []util.ImageUpdateConfig
+	pinImageDigests bool
+	syncWindows     []*util.SyncWindow
+	manualSync      bool
+	// format overrides of sops files, and whether to skip
+	// sops files that are not encrypted rather than failing
+	sopsFormats        map[string]string
+	skipPlaintextFiles bool
+	// name of the stack in docker and the cluster it is deployed to.
+	// Stacks deployed to several clusters are named stack@cluster
+	namespace string
+	cluster   string
+	// registries whose credentials are sent when deploying
+	registries []string
+	// whether to redeploy the stack when it drifts,
+	// and the service fields not considered drift
+	selfHeal          bool
+	ignoreDifferences []string
+	// service specs and hash of the compose file of the last
+	// deployment, to detect drift and skip unchanged deployments
+	desiredSpecs map[string]swarm.ServiceSpec
+	deployedHash string
+	// images and digests of the last deployment
+	deployedImages map[string]string
+	// set when rendering, to replace the decrypted values of the compose
+	// file and the values of the secret function with util.RedactedValue
+	redactSecrets bool
+	// set while a worker syncs the stack, guarded by stacksLock
+	syncing bool
+	// timeouts of the update phases and of whole updates
+	timeouts util.TimeoutsConfig
 }
 
 func newSwarmStack(name string, repo *stackRepo, branch string, composePath string, sopsFiles []string, valuesFile string, discoverSecrets bool) *swarmStack {
 	return &swarmStack{
 		name:            name,
+		namespace:       name,
 		repo:            repo,
 		branch:          branch,
 		composePath:     composePath,
@@ -36,18 +86,49 @@ func newSwarmStack(name string, repo *stackRepo, branch string, composePath stri
 	}
 }
 
-func (swarmStack *swarmStack) updateStack() (revision string, err error) {
+// adoptDeploymentState takes over what another instance
+// of the same stack recorded about its last deployment
+func (swarmStack *swarmStack) adoptDeploymentState(previous *swarmStack) {
+	swarmStack.deployedImages = previous.deployedImages
+	swarmStack.deployedHash = previous.deployedHash
+	swarmStack.desiredSpecs = previous.desiredSpecs
+}
+
+// fetchStack pulls the stack's repo and renders its compose file. Image
+// updates are only committed and pushed if updateImages is set, which
+// callers only do once they know the stack is going to be deployed
+func (swarmStack *swarmStack) fetchStack(ctx context.Context, updateImages bool) (revision string, stackContents map[string]any, err error) {
 	log := logger.With(
 		slog.String("stack", swarmStack.name),
 		slog.String("branch", swarmStack.branch),
 	)
 
-	log.Debug("pulling changes...")
-	revision, err = swarmStack.repo.pullChanges(swarmStack.branch)
+	err = swarmStack.runPhase(ctx, phasePull, func(ctx context.Context) (err error) {
+		log.Debug("pulling changes...")
+		revision, err = swarmStack.repo.pullChanges(ctx, swarmStack.branch)
+		if err != nil {
+			return
+		}
+		log.Debug("changes pulled", "revision", revision)
+		if !updateImages {
+			return
+		}
+
+		log.Debug("checking for image updates...")
+		imagesUpdated, err := swarmStack.updateImages(ctx)
+		if err != nil || !imagesUpdated {
+			return
+		}
+		revision, err = swarmStack.repo.headRevision(swarmStack.branch)
+		if err != nil {
+			return
+		}
+		log.Debug("image updates pushed", "revision", revision)
+		return
+	})
 	if err != nil {
 		return
 	}
-	log.Debug("changes pulled", "revision", revision)
 
 	log.Debug("reading stack file...")
 	stackBytes, err := swarmStack.readStack()
@@ -55,40 +136,128 @@ func (swarmStack *swarmStack) updateStack() (revision string, err error) {
 		return
 	}
 
-	if swarmStack.valuesFile != "" {
-		log.Debug("rendering template...")
-		stackBytes, err = swarmStack.renderComposeTemplate(stackBytes)
-	}
+	log.Debug("rendering compose file...")
+	stackBytes, err = swarmStack.renderCompose(ctx, stackBytes)
 	if err != nil {
 		return
 	}
 
 	log.Debug("parsing stack content...")
-	stackContents, err := swarmStack.parseStackString([]byte(stackBytes))
+	stackContents, err = swarmStack.parseStackString([]byte(stackBytes))
+	return
+}
+
+// applyStack deploys the rendered compose file of the stack. Unless redeploy
+// is set, stacks that haven't changed since the last deployment are skipped
+func (swarmStack *swarmStack) applyStack(ctx context.Context, stackContents map[string]any, redeploy bool) (err error) {
+	log := logger.With(
+		slog.String("stack", swarmStack.name),
+		slog.String("branch", swarmStack.branch),
+	)
+
+	var decryptedFiles map[string][]byte
+	err = swarmStack.runPhase(ctx, phaseDecrypt, func(ctx context.Context) (err error) {
+		log.Debug("decrypting secrets...")
+		decryptedFiles, err = swarmStack.decryptSopsFiles(ctx, stackContents)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt one or more sops files for %s stack: %w", swarmStack.name, err)
+		}
+
+		log.Debug("reading secrets from providers...")
+		return swarmStack.resolveProviderSecrets(ctx, stackContents, decryptedFiles)
+	})
 	if err != nil {
 		return
 	}
 
-	log.Debug("decrypting secrets...")
-	err = swarmStack.decryptSopsFiles(stackContents)
+	log.Debug("rotating configs and secrets...")
+	err = swarmStack.rotateConfigsAndSecrets(stackContents, decryptedFiles)
 	if err != nil {
-		return "", fmt.Errorf("failed to decrypt one or more sops files for %s stack: %w", swarmStack.name, err)
+		return
 	}
 
-	log.Debug("rotating configs and secrets...")
-	err = swarmStack.rotateConfigsAndSecrets(stackContents)
+	log.Debug("externalizing decrypted configs and secrets...")
+	objects, err := swarmStack.externalizeObjects(stackContents, decryptedFiles)
 	if err != nil {
 		return
 	}
 
-	log.Debug("writing stack to file...")
-	err = swarmStack.writeStack(stackContents)
+	log.Debug("resolving image digests...")
+	images, err := swarmStack.resolveImageDigests(ctx, stackContents)
 	if err != nil {
 		return
 	}
 
-	log.Debug("deploying stack...")
-	err = swarmStack.deployStack()
+	log.Debug("extracting hooks...")
+	hooks, err := swarmStack.extractHooks(stackContents)
+	if err != nil {
+		return
+	}
+
+	log.Debug("labeling services...")
+	err = addManagedLabel(stackContents)
+	if err != nil {
+		return
+	}
+
+	stackHash, err := hashStack(stackContents, images)
+	if err != nil {
+		return
+	}
+	if stackHash == swarmStack.deployedHash && !redeploy {
+		log.Debug("stack is unchanged since the last deployment")
+		return
+	}
+	log.Debug("creating configs and secrets...")
+	err = swarmStack.runPhase(ctx, phaseDeploy, func(ctx context.Context) error {
+		return swarmStack.createObjects(ctx, objects)
+	})
+	if err != nil {
+		return
+	}
+
+	log.Debug("running pre-deploy hooks...")
+	err = swarmStack.runHooks(ctx, swarmStack.preDeployHooks, hooks)
+	if err != nil {
+		return
+	}
+
+	err = swarmStack.runPhase(ctx, phaseDeploy, func(ctx context.Context) error {
+		log.Debug("deploying stack...")
+		err := swarmStack.deployStack(ctx, stackContents)
+		if err != nil {
+			return err
+		}
+		swarmStack.deployedImages = images
+		swarmStack.deployedHash = stackHash
+
+		log.Debug("removing unused configs and secrets...")
+		swarmStack.removeUnusedObjects(ctx, objects)
+
+		log.Debug("recording deployed services...")
+		return swarmStack.recordDesiredState(ctx)
+	})
+	if err != nil {
+		return
+	}
+
+	if len(swarmStack.postDeployHooks) > 0 {
+		// deployments are detached, hooks run once the rollout is done
+		log.Debug("waiting for the rollout to finish...")
+		err = swarmStack.runPhase(ctx, phaseDeploy, func(ctx context.Context) error {
+			cli, err := swarmStack.cli()
+			if err != nil {
+				return err
+			}
+			return waitForStackHealthy(ctx, cli, swarmStack.namespace, 0)
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	log.Debug("running post-deploy hooks...")
+	err = swarmStack.runHooks(ctx, swarmStack.postDeployHooks, hooks)
 	return
 }
 
@@ -98,10 +267,35 @@ func (swarmStack *swarmStack) readStack() ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not read compose file %s: %w", composeFile, err)
 	}
+	// the compose file itself can be encrypted, or partially with encrypted_regex
+	if util.IsSopsEncrypted(composeFile, composeFileBytes) {
+		format := swarmStack.sopsFormats[swarmStack.composePath]
+		decryptedBytes, err := util.DecryptData(composeFile, composeFileBytes, format, swarmStack.sopsKeys)
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt compose file of %s stack: %w", swarmStack.name, err)
+		}
+		if swarmStack.redactSecrets {
+			// decrypted all the same, so that rendering fails like syncing would
+			return util.RedactData(composeFile, composeFileBytes, format)
+		}
+		return decryptedBytes, nil
+	}
 	return composeFileBytes, nil
 }
 
-func (swarmStack *swarmStack) renderComposeTemplate(templateContents []byte) ([]byte, error) {
+// renderCompose renders the compose file as a template if the stack
+// has a values file. Compose files that call secret require one
+func (swarmStack *swarmStack) renderCompose(ctx context.Context, composeFile []byte) ([]byte, error) {
+	if swarmStack.valuesFile != "" {
+		return swarmStack.renderComposeTemplate(ctx, composeFile)
+	}
+	if callsSecret(composeFile) {
+		return nil, fmt.Errorf("compose file of %s stack calls secret, which requires values_file to render it as a template", swarmStack.name)
+	}
+	return composeFile, nil
+}
+
+func (swarmStack *swarmStack) renderComposeTemplate(ctx context.Context, templateContents []byte) ([]byte, error) {
 	valuesFile := path.Join(swarmStack.repo.path, swarmStack.valuesFile)
 	valuesBytes, err := os.ReadFile(valuesFile)
 	if err != nil {
@@ -109,7 +303,7 @@ func (swarmStack *swarmStack) renderComposeTemplate(templateContents []byte) ([]
 	}
 	var valuesMap map[string]any
 	yaml.Unmarshal(valuesBytes, &valuesMap)
-	templ, err := template.New(swarmStack.name).Parse(string(templateContents[:]))
+	templ, err := template.New(swarmStack.name).Funcs(swarmStack.secretTemplateFuncs(ctx)).Parse(string(templateContents[:]))
 	if err != nil {
 		return nil, fmt.Errorf("could not parse %s stack compose file as a Go template: %w", swarmStack.name, err)
 	}
@@ -130,7 +324,9 @@ func (swarmStack *swarmStack) parseStackString(stackContent []byte) (map[string]
 	return composeMap, nil
 }
 
-func (swarmStack *swarmStack) decryptSopsFiles(composeMap map[string]any) (err error) {
+// decryptSopsFiles decrypts the stack's sops files in memory,
+// returns their contents by path
+func (swarmStack *swarmStack) decryptSopsFiles(ctx context.Context, composeMap map[string]any) (decryptedFiles map[string][]byte, err error) {
 	var sopsFiles []string
 	if !swarmStack.discoverSecrets {
 		sopsFiles = swarmStack.sopsFiles
@@ -140,20 +336,68 @@ func (swarmStack *swarmStack) decryptSopsFiles(composeMap map[string]any) (err e
 			return
 		}
 	}
+	encryptedConfigs, err := swarmStack.discoverEncryptedConfigs(composeMap)
+	if err != nil {
+		return
+	}
+	for _, configFile := range encryptedConfigs {
+		if !slices.Contains(sopsFiles, configFile) {
+			sopsFiles = append(sopsFiles, configFile)
+		}
+	}
 	log := logger.With(
 		slog.String("stack", swarmStack.name),
 		slog.String("branch", swarmStack.branch),
 	)
+	decryptedFiles = map[string][]byte{}
 	for _, sopsFile := range sopsFiles {
 		log.Debug("decrypting secret...", "secret", sopsFile)
-		err = util.DecryptFile(path.Join(swarmStack.repo.path, sopsFile))
+		filePath := path.Join(swarmStack.repo.path, sopsFile)
+		// sops takes no context, key services that hang are left behind
+		textBytes, err := withContext(ctx, func() ([]byte, error) {
+			return util.DecryptFileContents(filePath, swarmStack.sopsFormats[sopsFile], swarmStack.sopsKeys)
+		})
+		if errors.Is(err, util.ErrNotSopsFile) && swarmStack.skipPlaintextFiles {
+			log.Debug("skipping secret without sops metadata", "secret", sopsFile)
+			continue
+		}
 		if err != nil {
-			return
+			return nil, err
 		}
+		decryptedFiles[filePath] = textBytes
 	}
 	return
 }
 
+// discoverEncryptedConfigs returns the config files of the stack that have sops metadata
+func (swarmStack *swarmStack) discoverEncryptedConfigs(composeMap map[string]any) ([]string, error) {
+	configs, ok := composeMap["configs"].(map[string]any)
+	if !ok {
+		return nil, nil
+	}
+	var configFiles []string
+	for configName, swarmConfig := range configs {
+		configMap, ok := swarmConfig.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid compose file: %s config must be a map", configName)
+		}
+		configFile, ok := configMap["file"].(string)
+		if !ok {
+			continue
+		}
+		configFile = path.Join(path.Dir(swarmStack.composePath), configFile)
+		configBytes, err := os.ReadFile(path.Join(swarmStack.repo.path, configFile))
+		if err != nil {
+			return nil, fmt.Errorf("could not read config file %s: %w", configFile, err)
+		}
+		if util.IsSopsEncrypted(configFile, configBytes) {
+			configFiles = append(configFiles, configFile)
+		}
+	}
+	sort.Strings(configFiles)
+	return configFiles, nil
+}
+
 func discoverSecrets(composeMap map[string]any, composePath string) ([]string, error) {
 	var sopsFiles []string
 	if secrets, ok := composeMap["secrets"].(map[string]any); ok {
@@ -166,6 +410,10 @@ func discoverSecrets(composeMap map[string]any, composePath string) ([]string, e
 			if ok && isExternal {
 				continue
 			}
+			// read from a secret provider rather than a file
+			if _, ok := secretMap[providerSecretKey]; ok {
+				continue
+			}
 			secretFile, ok := secretMap["file"].(string)
 			if !ok {
 				return nil, fmt.Errorf("invalid compose file: %s file field must be a string", secretName)
@@ -177,15 +425,17 @@ func discoverSecrets(composeMap map[string]any, composePath string) ([]string, e
 	return sopsFiles, nil
 }
 
-func (swarmStack *swarmStack) rotateConfigsAndSecrets(composeMap map[string]any) error {
+// rotateConfigsAndSecrets names configs and secrets after the hash of their
+// contents, decryptedFiles take precedence over the files in the repo
+func (swarmStack *swarmStack) rotateConfigsAndSecrets(composeMap map[string]any, decryptedFiles map[string][]byte) error {
 	if configs, ok := composeMap["configs"].(map[string]any); ok {
-		err := swarmStack.rotateObjects(configs, "configs")
+		err := swarmStack.rotateObjects(configs, "configs", decryptedFiles)
 		if err != nil {
 			return fmt.Errorf("could not rotate one or more config files of stack %s: %w", swarmStack.name, err)
 		}
 	}
 	if secrets, ok := composeMap["secrets"].(map[string]any); ok {
-		err := swarmStack.rotateObjects(secrets, "secrets")
+		err := swarmStack.rotateObjects(secrets, "secrets", decryptedFiles)
 		if err != nil {
 			return fmt.Errorf("could not rotate one or more secret files of stack %s: %w", swarmStack.name, err)
 		}
@@ -193,7 +443,7 @@ func (swarmStack *swarmStack) rotateConfigsAndSecrets(composeMap map[string]any)
 	return nil
 }
 
-func (swarmStack *swarmStack) rotateObjects(objects map[string]any, objectType string) error {
+func (swarmStack *swarmStack) rotateObjects(objects map[string]any, objectType string, decryptedFiles map[string][]byte) error {
 	objectsDir := path.Dir(path.Join(swarmStack.repo.path, swarmStack.composePath))
 	for objectName, object := range objects {
 		log := logger.With(
@@ -215,44 +465,102 @@ func (swarmStack *swarmStack) rotateObjects(objects map[string]any, objectType s
 		}
 		log.Debug("reading...", "file", objectFile)
 		objectFilePath := path.Join(objectsDir, objectFile)
-		configFileBytes, err := os.ReadFile(objectFilePath)
-		if err != nil {
-			return fmt.Errorf("could not read file %s for rotation: %w", objectFilePath, err)
+		configFileBytes, ok := decryptedFiles[objectFilePath]
+		if !ok {
+			var err error
+			configFileBytes, err = os.ReadFile(objectFilePath)
+			if err != nil {
+				return fmt.Errorf("could not read file %s for rotation: %w", objectFilePath, err)
+			}
 		}
 		log.Debug("computing hash...", "file", objectFile)
 		hash := fmt.Sprintf("%x", md5.Sum(configFileBytes))[:8]
-		newObjectName := swarmStack.name + "-" + objectName + "-" + hash
+		newObjectName := swarmStack.namespace + "-" + objectName + "-" + hash
 		log.Debug("renaming...", "new_name", newObjectName)
 		objectMap["name"] = newObjectName
 	}
 	return nil
 }
 
-func (swarmStack *swarmStack) writeStack(composeMap map[string]any) error {
+// hashStack hashes the final compose file and the digests of its images,
+// which make up the desired state of the stack
+func hashStack(composeMap map[string]any, images map[string]string) (string, error) {
 	composeFileBytes, err := yaml.Marshal(composeMap)
 	if err != nil {
-		return fmt.Errorf("could not store compose file as yaml after calculating hashes for stack %s", swarmStack.name)
+		return "", fmt.Errorf("could not encode compose file to compute its hash: %w", err)
 	}
-	composeFile := path.Join(swarmStack.repo.path, swarmStack.composePath)
-	fileInfo, _ := os.Stat(composeFile)
-	os.WriteFile(composeFile, composeFileBytes, fileInfo.Mode())
-	return nil
+	// fmt prints maps sorted by key
+	imagesBytes := []byte(fmt.Sprint(images))
+	return fmt.Sprintf("%x", md5.Sum(append(composeFileBytes, imagesBytes...))), nil
 }
 
-func (swarmStack *swarmStack) deployStack() error {
-	cmd := stack.NewStackCommand(dockerCli)
-	cmd.SetArgs([]string{
-		"deploy", "--detach", "--with-registry-auth", "-c",
-		path.Join(swarmStack.repo.path, swarmStack.composePath),
-		swarmStack.name,
-	})
-	// To stop printing errors and
-	// usage message to stdout
-	cmd.SilenceErrors = true
-	cmd.SilenceUsage = true
-	err := cmd.Execute()
+// deployStack deploys the final compose file, which never touches the disk
+func (swarmStack *swarmStack) deployStack(ctx context.Context, composeMap map[string]any) error {
+	cli, err := swarmStack.deployCli()
 	if err != nil {
-		return fmt.Errorf("could not deploy stack %s: %s", swarmStack.name, err)
+		return err
+	}
+	return deployCompose(ctx, cli, composeMap, swarmStack.composeDir(), swarmStack.namespace)
+}
+
+// composeDir is the directory of the compose file in the repo,
+// relative paths of the final compose file resolve from there
+func (swarmStack *swarmStack) composeDir() string {
+	return path.Dir(path.Join(swarmStack.repo.path, swarmStack.composePath))
+}
+
+// cli returns the docker client of the stack's cluster
+func (swarmStack *swarmStack) cli() (*command.DockerCli, error) {
+	return clusterCli(swarmStack.cluster)
+}
+
+// deployCompose deploys a compose map like docker stack deploy --detach
+// --with-registry-auth, loading it from memory rather than from a file.
+// Relative paths resolve from workingDir
+func deployCompose(ctx context.Context, cli *command.DockerCli, composeMap map[string]any, workingDir string, stackName string) error {
+	config, err := loadCompose(composeMap, workingDir, stackName)
+	if err != nil {
+		return fmt.Errorf("could not deploy stack %s: %w", stackName, err)
+	}
+	// the detach flag is marked as set, so that the cli
+	// doesn't warn that detaching is the default
+	flags := pflag.NewFlagSet("deploy", pflag.ContinueOnError)
+	flags.Bool("detach", true, "")
+	flags.Set("detach", "true")
+	opts := &options.Deploy{
+		Namespace:        stackName,
+		ResolveImage:     stackswarm.ResolveImageAlways,
+		SendRegistryAuth: true,
+		Detach:           true,
+	}
+	err = stackswarm.RunDeploy(ctx, cli, flags, opts, config)
+	if err != nil {
+		return fmt.Errorf("could not deploy stack %s: %w", stackName, err)
 	}
 	return nil
 }
+
+// loadCompose loads a compose map like docker stack deploy loads compose files
+func loadCompose(composeMap map[string]any, workingDir string, stackName string) (*composetypes.Config, error) {
+	// round trip through yaml, so that the loader gets the types it parses
+	composeFileBytes, err := yaml.Marshal(composeMap)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode compose file: %w", err)
+	}
+	composeDict, err := composeloader.ParseYAML(composeFileBytes)
+	if err != nil {
+		return nil, err
+	}
+	environment := map[string]string{}
+	for _, variable := range os.Environ() {
+		if name, value, ok := strings.Cut(variable, "="); ok && name != "" {
+			environment[name] = value
+		}
+	}
+	return composeloader.Load(composetypes.ConfigDetails{
+		Version:     schema.Version(composeDict),
+		WorkingDir:  workingDir,
+		ConfigFiles: []composetypes.ConfigFile{{Filename: stackName + ".yaml", Config: composeDict}},
+		Environment: environment,
+	})
+}
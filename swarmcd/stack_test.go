@@ -1,18 +1,26 @@
 package swarmcd
 
 import (
+	"os"
+	"path"
+	"strings"
 	"sync"
 	"testing"
 )
 
+// newTestRepo returns a repo checked out at path, without a remote
+func newTestRepo(path string) *stackRepo {
+	return &stackRepo{name: "test", path: path, lock: &sync.Mutex{}}
+}
+
 // External objects are ignored by the rotation
 func TestRotateExternalObjects(t *testing.T) {
-	repo := &stackRepo{name: "test", path: "test", url: "", auth: nil, lock: &sync.Mutex{}, gitRepoObject: nil}
+	repo := newTestRepo("test")
 	stack := newSwarmStack("test", repo, "main", "docker-compose.yaml", nil, "", false)
 	objects := map[string]any{
 		"my-secret": map[string]any{"external": true},
 	}
-	err := stack.rotateObjects(objects, "secrets")
+	err := stack.rotateObjects(objects, "secrets", nil)
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 	}
@@ -20,7 +28,7 @@ func TestRotateExternalObjects(t *testing.T) {
 
 // Secrets are discovered, external secrets are ignored
 func TestSecretDiscovery(t *testing.T) {
-	repo := &stackRepo{name: "test", path: "test", url: "", auth: nil, lock: &sync.Mutex{}, gitRepoObject: nil}
+	repo := newTestRepo("test")
 	stack := newSwarmStack("test", repo, "main", "stacks/docker-compose.yaml", nil, "", false)
 	stackString := []byte(`services:
   my-service:
@@ -48,3 +56,127 @@ secrets:
 		t.Errorf("unexpected sops file: %s", sopsFiles[0])
 	}
 }
+
+// Decrypted configs and secrets become external objects
+func TestExternalizeObjects(t *testing.T) {
+	repo := newTestRepo("repo")
+	stack := newSwarmStack("test", repo, "main", "stacks/docker-compose.yaml", nil, "", false)
+	composeMap := map[string]any{
+		"secrets": map[string]any{
+			"my-secret":       map[string]any{"file": "secrets/secret.yaml", "name": "test_my-secret-0123"},
+			"plain-secret":    map[string]any{"file": "secrets/plain.yaml"},
+			"external-secret": map[string]any{"external": true},
+		},
+		"configs": map[string]any{
+			"my-config": map[string]any{"file": "config.yaml", "labels": []any{"team=web"}, "template_driver": "golang"},
+		},
+	}
+	decryptedFiles := map[string][]byte{
+		"repo/stacks/secrets/secret.yaml": []byte("secret"),
+		"repo/stacks/config.yaml":         []byte("config"),
+	}
+	objects, err := stack.externalizeObjects(composeMap, decryptedFiles)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []swarmObject{
+		{objectType: "configs", name: "test_my-config", data: []byte("config")},
+		{objectType: "secrets", name: "test_my-secret-0123", data: []byte("secret")},
+	}
+	if len(objects) != len(expected) {
+		t.Fatalf("unexpected objects: %v", objects)
+	}
+	for i := range expected {
+		if objects[i].objectType != expected[i].objectType || objects[i].name != expected[i].name || string(objects[i].data) != string(expected[i].data) {
+			t.Errorf("unexpected object: %v", objects[i])
+		}
+	}
+	if objects[0].labels["team"] != "web" || objects[0].templateDriver != "golang" {
+		t.Errorf("fields of the config were not kept: %v", objects[0])
+	}
+	secret := composeMap["secrets"].(map[string]any)["my-secret"].(map[string]any)
+	if secret["external"] != true || secret["name"] != "test_my-secret-0123" || secret["file"] != nil {
+		t.Errorf("secret was not made external: %v", secret)
+	}
+	plainSecret := composeMap["secrets"].(map[string]any)["plain-secret"].(map[string]any)
+	if plainSecret["file"] != "secrets/plain.yaml" {
+		t.Errorf("plain secret was changed: %v", plainSecret)
+	}
+
+	_, err = stack.externalizeObjects(map[string]any{}, map[string][]byte{"repo/stacks/other.yaml": []byte("other")})
+	if err == nil || !strings.Contains(err.Error(), "repo/stacks/other.yaml") {
+		t.Errorf("expected an error for the unused sops file, got: %v", err)
+	}
+	composeMap = map[string]any{
+		"secrets": map[string]any{"my-secret": map[string]any{"file": "secret.yaml", "driver": "vault"}},
+	}
+	_, err = stack.externalizeObjects(composeMap, map[string][]byte{"repo/stacks/secret.yaml": []byte("secret")})
+	if err == nil || !strings.Contains(err.Error(), "driver") {
+		t.Errorf("expected an error for the unsupported field, got: %v", err)
+	}
+}
+
+// Config files with sops metadata are decrypted, the others are left as they are
+func TestDiscoverEncryptedConfigs(t *testing.T) {
+	repoPath := t.TempDir()
+	err := os.MkdirAll(path.Join(repoPath, "stacks/configs"), 0755)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	files := map[string]string{
+		"stacks/configs/encrypted.yaml": "key: ENC[AES256_GCM,data:abc,type:str]\nsops:\n    mac: ENC[AES256_GCM,data:abc,type:str]\n",
+		"stacks/configs/plain.yaml":     "key: value\n",
+	}
+	for file, contents := range files {
+		err = os.WriteFile(path.Join(repoPath, file), []byte(contents), 0644)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	repo := newTestRepo(repoPath)
+	stack := newSwarmStack("test", repo, "main", "stacks/docker-compose.yaml", nil, "", false)
+	composeMap := map[string]any{
+		"configs": map[string]any{
+			"encrypted": map[string]any{"file": "configs/encrypted.yaml"},
+			"plain":     map[string]any{"file": "configs/plain.yaml"},
+			"external":  map[string]any{"external": true},
+		},
+	}
+	configFiles, err := stack.discoverEncryptedConfigs(composeMap)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(configFiles) != 1 || configFiles[0] != "stacks/configs/encrypted.yaml" {
+		t.Errorf("unexpected encrypted configs: %v", configFiles)
+	}
+}
+
+// Compose files are loaded from memory, with relative
+// paths resolved from the directory of the compose file
+func TestLoadCompose(t *testing.T) {
+	workingDir := t.TempDir()
+	t.Setenv("NGINX_TAG", "1.27")
+	composeMap := map[string]any{
+		"version": "3.8",
+		"services": map[string]any{
+			"nginx": map[string]any{"image": "nginx:${NGINX_TAG}"},
+		},
+		"configs": map[string]any{
+			"nginx_conf": map[string]any{"file": "nginx.conf"},
+		},
+	}
+	config, err := loadCompose(composeMap, workingDir, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if config.Services[0].Image != "nginx:1.27" {
+		t.Errorf("expected environment variables to be interpolated, got %s", config.Services[0].Image)
+	}
+	if config.Configs["nginx_conf"].File != path.Join(workingDir, "nginx.conf") {
+		t.Errorf("expected the config file to resolve from the compose directory, got %s", config.Configs["nginx_conf"].File)
+	}
+	entries, err := os.ReadDir(workingDir)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("expected nothing to be written next to the compose file, got %v, error %v", entries, err)
+	}
+}
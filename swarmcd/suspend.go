@@ -0,0 +1,202 @@
+package swarmcd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrStackSuspended = errors.New("stack is suspended")
+
+// Suspension stops a stack, or all of them, from being synced
+type Suspension struct {
+	Reason      string
+	SuspendedAt time.Time
+	// the suspension expires at this time if set
+	Until *time.Time
+	// whether the whole instance is suspended rather than a single stack
+	Global bool
+}
+
+// state persisted across restarts in the state file, or
+// in the swarm labels when leader election is enabled
+type persistedState struct {
+	Suspension       *Suspension
+	StackSuspensions map[string]*Suspension
+}
+
+var state persistedState = persistedState{StackSuspensions: map[string]*Suspension{}}
+
+var stateLock sync.Mutex
+
+func (suspension *Suspension) isExpired(now time.Time) bool {
+	return suspension.Until != nil && !now.Before(*suspension.Until)
+}
+
+func loadState() error {
+	// the state is read from the swarm labels once the lease is
+	if getConfig().LeaderElection.Enabled {
+		return nil
+	}
+	stateBytes, err := os.ReadFile(getConfig().StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read state file %s: %w", getConfig().StateFile, err)
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	err = json.Unmarshal(stateBytes, &state)
+	if err != nil {
+		return fmt.Errorf("could not parse state file %s: %w", getConfig().StateFile, err)
+	}
+	if state.StackSuspensions == nil {
+		state.StackSuspensions = map[string]*Suspension{}
+	}
+	return nil
+}
+
+// loadSharedState replaces the state with the one the leader shared in the swarm labels
+func loadSharedState(labels map[string]string) error {
+	sharedState := persistedState{}
+	if stateJSON := labels[stateLabel]; stateJSON != "" {
+		err := json.Unmarshal([]byte(stateJSON), &sharedState)
+		if err != nil {
+			return fmt.Errorf("could not parse the state shared in the swarm labels: %w", err)
+		}
+	}
+	if sharedState.StackSuspensions == nil {
+		sharedState.StackSuspensions = map[string]*Suspension{}
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	state = sharedState
+	return nil
+}
+
+// saveState must be called with the state lock held
+func saveState() error {
+	if election != nil {
+		stateBytes, err := json.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("could not encode state: %w", err)
+		}
+		return election.saveState(stateBytes)
+	}
+	stateBytes, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode state: %w", err)
+	}
+	// write to a temporary file first so that
+	// a crash never leaves a truncated state file
+	tempFile := getConfig().StateFile + ".tmp"
+	err = os.MkdirAll(filepath.Dir(getConfig().StateFile), 0755)
+	if err != nil {
+		return fmt.Errorf("could not create state file directory: %w", err)
+	}
+	err = os.WriteFile(tempFile, stateBytes, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write state file %s: %w", tempFile, err)
+	}
+	err = os.Rename(tempFile, getConfig().StateFile)
+	if err != nil {
+		return fmt.Errorf("could not write state file %s: %w", getConfig().StateFile, err)
+	}
+	return nil
+}
+
+// activeSuspension returns the suspension that applies to a stack, the
+// instance's one first, or nil. Expired suspensions are removed
+func activeSuspension(stackName string, now time.Time) *Suspension {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	changed := false
+	defer func() {
+		if changed {
+			if err := saveState(); err != nil {
+				logger.Error(err.Error())
+			}
+		}
+	}()
+	if state.Suspension != nil {
+		if !state.Suspension.isExpired(now) {
+			return state.Suspension
+		}
+		logger.Info("suspension of SwarmCD expired")
+		state.Suspension = nil
+		changed = true
+	}
+	if suspension, ok := state.StackSuspensions[stackName]; ok {
+		if !suspension.isExpired(now) {
+			return suspension
+		}
+		logger.Info(fmt.Sprintf("suspension of %s stack expired", stackName))
+		delete(state.StackSuspensions, stackName)
+		changed = true
+	}
+	return nil
+}
+
+// SuspendStack stops syncing a stack until it is resumed, or until the given time if set
+func SuspendStack(name string, reason string, until *time.Time) error {
+	if findStack(name) == nil {
+		return fmt.Errorf("%w: %s", ErrStackNotFound, name)
+	}
+	// suspensions are kept by the leader
+	if err := checkLeader(); err != nil {
+		return err
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	state.StackSuspensions[name] = &Suspension{Reason: reason, SuspendedAt: time.Now(), Until: until}
+	logger.Info(fmt.Sprintf("suspended %s stack", name), "reason", reason, "until", until)
+	return saveState()
+}
+
+func ResumeStack(name string) error {
+	if findStack(name) == nil {
+		return fmt.Errorf("%w: %s", ErrStackNotFound, name)
+	}
+	if err := checkLeader(); err != nil {
+		return err
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	delete(state.StackSuspensions, name)
+	logger.Info(fmt.Sprintf("resumed %s stack", name))
+	return saveState()
+}
+
+// Suspend stops syncing all stacks until resumed, or until the given time if set
+func Suspend(reason string, until *time.Time) error {
+	if err := checkLeader(); err != nil {
+		return err
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	state.Suspension = &Suspension{Reason: reason, SuspendedAt: time.Now(), Until: until, Global: true}
+	logger.Info("suspended SwarmCD", "reason", reason, "until", until)
+	return saveState()
+}
+
+func Resume() error {
+	if err := checkLeader(); err != nil {
+		return err
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	state.Suspension = nil
+	logger.Info("resumed SwarmCD")
+	return saveState()
+}
+
+func isSuspended(now time.Time) bool {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	return state.Suspension != nil && !state.Suspension.isExpired(now)
+}
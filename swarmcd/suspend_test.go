@@ -0,0 +1,138 @@
+package swarmcd
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"testing"
+	"time"
+)
+
+// Suspensions are persisted, and expire after their until time
+func TestSuspendStack(t *testing.T) {
+	getConfig().StateFile = path.Join(t.TempDir(), "state.json")
+	repo := newTestRepo("test")
+	stacks = []*swarmStack{newSwarmStack("test", repo, "main", "docker-compose.yaml", nil, "", false)}
+	defer func() {
+		stacks = nil
+		state = persistedState{StackSuspensions: map[string]*Suspension{}}
+	}()
+
+	until := time.Now().Add(time.Hour)
+	err := SuspendStack("test", "incident", &until)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	state = persistedState{}
+	err = loadState()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	suspension := activeSuspension("test", time.Now())
+	if suspension == nil || suspension.Reason != "incident" {
+		t.Fatalf("unexpected suspension after reloading state: %v", suspension)
+	}
+	if activeSuspension("test", until.Add(time.Second)) != nil {
+		t.Errorf("suspension did not expire")
+	}
+	if _, ok := state.StackSuspensions["test"]; ok {
+		t.Errorf("expired suspension was not removed")
+	}
+
+	err = Suspend("maintenance", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	suspension = activeSuspension("test", time.Now())
+	if suspension == nil || !suspension.Global {
+		t.Errorf("global suspension does not apply to stack: %v", suspension)
+	}
+	err = Resume()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if activeSuspension("test", time.Now()) != nil {
+		t.Errorf("stack is still suspended after resuming")
+	}
+}
+
+// Statuses are returned with their suspension, without changing the shared ones
+func TestGetStackStatusSuspension(t *testing.T) {
+	getConfig().StateFile = path.Join(t.TempDir(), "state.json")
+	stackStatus = map[string]*StackStatus{"test": {RepoURL: "repo"}}
+	defer func() {
+		stackStatus = map[string]*StackStatus{}
+		state = persistedState{StackSuspensions: map[string]*Suspension{}}
+	}()
+
+	err := Suspend("maintenance", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	statuses := GetStackStatus()
+	if statuses["test"].Suspension == nil || statuses["test"].RepoURL != "repo" {
+		t.Errorf("unexpected status: %v", statuses["test"])
+	}
+	if statuses["test"] == stackStatus["test"] || stackStatus["test"].Suspension != nil {
+		t.Errorf("expected a copy of the status to be returned")
+	}
+}
+
+// Statuses can be read while workers update them, run with -race
+func TestGetStackStatusConcurrentUpdates(t *testing.T) {
+	stackStatus = map[string]*StackStatus{"test": {}}
+	defer func() { stackStatus = map[string]*StackStatus{} }()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			updateStatus("test", func(status *StackStatus) {
+				setStatusError(status, errors.New("failed"))
+				status.Drift = append(status.Drift, FieldDrift{Field: "Spec.Labels"})
+				recordDeployment(status, Deployment{Revision: fmt.Sprint(i), DeployedAt: time.Now()})
+			})
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		status := GetStackStatus()["test"]
+		_ = status.Error
+		for j := range status.Deployments {
+			status.Deployments[j].Revision = "changed"
+		}
+		for j := range status.Drift {
+			status.Drift[j].Field = "changed"
+		}
+	}
+	<-done
+	for _, deployment := range GetStackStatus()["test"].Deployments {
+		if deployment.Revision == "changed" {
+			t.Fatal("expected the deployments of copies not to be shared")
+		}
+	}
+}
+
+// With leader election, instances take the state the leader shared in the swarm labels
+func TestLoadSharedState(t *testing.T) {
+	defer func() { state = persistedState{StackSuspensions: map[string]*Suspension{}} }()
+	err := loadSharedState(map[string]string{
+		stateLabel: `{"Suspension":null,"StackSuspensions":{"test":{"Reason":"incident"}}}`,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	suspension := activeSuspension("test", time.Now())
+	if suspension == nil || suspension.Reason != "incident" {
+		t.Fatalf("unexpected suspension after loading the shared state: %v", suspension)
+	}
+	err = loadSharedState(map[string]string{leaderLabel: "a"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if activeSuspension("test", time.Now()) != nil {
+		t.Errorf("expected the state to be replaced")
+	}
+	err = loadSharedState(map[string]string{stateLabel: "{"})
+	if err == nil {
+		t.Errorf("expected an invalid shared state to fail")
+	}
+}
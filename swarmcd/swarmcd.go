@@ -1,48 +1,263 @@
 package swarmcd
 
 import (
+	"context"
 	"fmt"
-	"sync"
+	"maps"
+	"slices"
 	"time"
 )
 
+// number of deployments kept in the status of each stack
+const deploymentHistorySize = 10
+
+const (
+	syncStatusSynced    = "Synced"
+	syncStatusOutOfSync = "OutOfSync"
+)
+
 var stackStatus map[string]*StackStatus = map[string]*StackStatus{}
 var stacks []*swarmStack
 
+// signals the refresh loop to reload the configuration
+var reloadRequests = make(chan struct{}, 1)
+
 func Run() {
 	logger.Info("starting SwarmCD")
+	if election != nil {
+		go election.campaign()
+	}
+	scheduler := newScheduler()
+	for i := 0; i < getConfig().Workers; i++ {
+		go runWorker(scheduler)
+	}
+	// refreshes pull the stacks source and generator repos, which workers
+	// hold for as long as a stack update takes, so they run apart from
+	// the scheduling of the other stacks
+	go refreshLoop(scheduler)
 	for {
-		var waitGroup sync.WaitGroup
-		logger.Info("updating stacks...")
-		for _, swarmStack := range stacks {
-			waitGroup.Add(1)
-			go updateStackThread(swarmStack, &waitGroup)
+		if isLeader() {
+			stacksLock.RLock()
+			currentStacks := stacks
+			stacksLock.RUnlock()
+			scheduler.scheduleDue(currentStacks, time.Now())
 		}
-		waitGroup.Wait()
-		logger.Info("waiting for the update interval")
-		time.Sleep(time.Duration(config.UpdateInterval) * time.Second)
+		time.Sleep(scheduleInterval)
+	}
+}
+
+// refreshLoop refreshes the stacks every update interval,
+// prunes the ones that were removed and reloads the config
+func refreshLoop(scheduler *scheduler) {
+	var nextRefresh time.Time
+	for {
+		waitForLeadership()
+		if now := time.Now(); !now.Before(nextRefresh) {
+			nextRefresh = now.Add(time.Duration(getConfig().UpdateInterval) * time.Second)
+			err := refreshStacks()
+			if err != nil {
+				logger.Error(err.Error())
+			}
+			// a stack of another leader could be pruned by mistake
+			if isLeader() && !isSuspended(now) {
+				pruneStacks()
+			}
+		}
+		select {
+		case <-time.After(scheduleInterval):
+		case <-reloadRequests:
+			reloadConfig()
+			nextRefresh = time.Time{}
+			scheduler.syncAll()
+		}
+	}
+}
+
+// ReloadConfig asks SwarmCD to reload the configuration files once the
+// current sync is done. Stacks are synced right after reloading
+func ReloadConfig() {
+	select {
+	case reloadRequests <- struct{}{}:
+	default:
+		// a reload is already pending
 	}
 }
 
-func updateStackThread(swarmStack *swarmStack, waitGroup *sync.WaitGroup) {
-	repoLock := swarmStack.repo.lock
-	repoLock.Lock()
-	defer repoLock.Unlock()
-	defer waitGroup.Done()
+// syncStack runs a scheduled sync of the stack,
+// returns whether the stack is in sync afterwards
+func syncStack(ctx context.Context, swarmStack *swarmStack) bool {
+	if suspension := activeSuspension(swarmStack.name, time.Now()); suspension != nil {
+		logger.Info(fmt.Sprintf("skipped updating %s stack, it is suspended", swarmStack.name), "reason", suspension.Reason)
+		return isStatusSynced(swarmStack.name)
+	}
+	drift, err := swarmStack.detectDrift(ctx)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	updateStatus(swarmStack.name, func(status *StackStatus) { status.Drift = drift })
+	if len(drift) > 0 {
+		logger.Warn(fmt.Sprintf("%s stack has drifted from its last deployment", swarmStack.name), "fields", len(drift))
+	}
+
+	allowed, nextWindow := syncAllowed(swarmStack.syncWindows, time.Now())
+	if !allowed {
+		reportBlockedStack(ctx, swarmStack, nextWindow)
+		return isStatusSynced(swarmStack.name)
+	}
+	updateStatus(swarmStack.name, func(status *StackStatus) {
+		status.Blocked = false
+		status.NextSyncWindow = nil
+	})
 
+	if swarmStack.manualSync {
+		reportPendingChanges(ctx, swarmStack)
+		return isStatusSynced(swarmStack.name)
+	}
+	selfHeal := len(drift) > 0 && swarmStack.selfHeal
+	if selfHeal {
+		logger.Info(fmt.Sprintf("redeploying %s stack to revert drift", swarmStack.name))
+	}
+	return deployStackRevision(ctx, swarmStack, "", selfHeal) == nil
+}
+
+// deployStackRevision fetches and deploys the stack. If revision is set,
+// the stack is only deployed if it matches the revision pulled from the repo,
+// and images are not updated, since that would commit another revision.
+// Unchanged stacks are only deployed again if redeploy is set
+func deployStackRevision(ctx context.Context, swarmStack *swarmStack, revision string, redeploy bool) error {
 	logger.Info(fmt.Sprintf("updating %s stack", swarmStack.name))
-	revision, err := swarmStack.updateStack()
+	fetchedRevision, stackContents, err := swarmStack.fetchStack(ctx, revision == "")
+	err = swarmStack.wrapTimeout(ctx, err)
 	if err != nil {
-		stackStatus[swarmStack.name].Error = err.Error()
+		updateStatus(swarmStack.name, func(status *StackStatus) { setStatusError(status, err) })
 		logger.Error(err.Error())
-		return
+		return err
+	}
+	if revision != "" && !isSameRevision(revision, fetchedRevision) {
+		updateStatus(swarmStack.name, func(status *StackStatus) {
+			clearStatusError(status)
+			setPendingRevision(status, fetchedRevision)
+		})
+		return fmt.Errorf("%w: pending revision of %s stack is %s, not %s", ErrRevisionMismatch, swarmStack.name, fetchedRevision, revision)
+	}
+	err = swarmStack.wrapTimeout(ctx, swarmStack.applyStack(ctx, stackContents, redeploy))
+	if err != nil {
+		updateStatus(swarmStack.name, func(status *StackStatus) { setStatusError(status, err) })
+		logger.Error(err.Error())
+		return err
 	}
 
-	stackStatus[swarmStack.name].Error = ""
-	stackStatus[swarmStack.name].Revision = revision
+	deployment := Deployment{
+		Revision:   fetchedRevision,
+		DeployedAt: time.Now(),
+		Images:     swarmStack.deployedImages,
+	}
+	updateStatus(swarmStack.name, func(status *StackStatus) {
+		clearStatusError(status)
+		status.Revision = fetchedRevision
+		status.SyncStatus = syncStatusSynced
+		status.PendingRevision = ""
+		if redeploy {
+			status.Drift = nil
+		}
+		recordDeployment(status, deployment)
+	})
 	logger.Info(fmt.Sprintf("done updating %s stack", swarmStack.name))
+	return nil
+}
+
+// reportPendingChanges fetches and renders the stack to report
+// whether it is out of sync, without deploying it
+func reportPendingChanges(ctx context.Context, swarmStack *swarmStack) {
+	revision, _, err := swarmStack.fetchStack(ctx, false)
+	if err != nil {
+		updateStatus(swarmStack.name, func(status *StackStatus) { setStatusError(status, err) })
+		logger.Error(err.Error())
+		return
+	}
+	outOfSync := false
+	updateStatus(swarmStack.name, func(status *StackStatus) {
+		clearStatusError(status)
+		setPendingRevision(status, revision)
+		outOfSync = status.SyncStatus == syncStatusOutOfSync
+	})
+	if outOfSync {
+		logger.Info(fmt.Sprintf("%s stack has changes waiting for a manual sync", swarmStack.name), "revision", revision)
+	}
+}
+
+// reportBlockedStack pulls the stack's repo to report whether
+// it is out of sync, without deploying it
+func reportBlockedStack(ctx context.Context, swarmStack *swarmStack, nextWindow time.Time) {
+	updateStatus(swarmStack.name, func(status *StackStatus) {
+		status.Blocked = true
+		status.NextSyncWindow = nil
+		if !nextWindow.IsZero() {
+			status.NextSyncWindow = &nextWindow
+		}
+	})
+	message := fmt.Sprintf("%s stack is blocked by sync windows", swarmStack.name)
+	if !nextWindow.IsZero() {
+		message += fmt.Sprintf(" until %s", nextWindow.Format(time.RFC3339))
+	}
+	logger.Info(message)
+
+	var revision string
+	err := swarmStack.runPhase(ctx, phasePull, func(ctx context.Context) (err error) {
+		revision, err = swarmStack.repo.pullChanges(ctx, swarmStack.branch)
+		return
+	})
+	if err != nil {
+		updateStatus(swarmStack.name, func(status *StackStatus) { setStatusError(status, err) })
+		logger.Error(err.Error())
+		return
+	}
+	updateStatus(swarmStack.name, func(status *StackStatus) {
+		clearStatusError(status)
+		setPendingRevision(status, revision)
+	})
+}
+
+// setPendingRevision records a revision pulled from
+// the repo that has not been deployed yet
+func setPendingRevision(status *StackStatus, revision string) {
+	if revision == status.Revision {
+		status.SyncStatus = syncStatusSynced
+		status.PendingRevision = ""
+		return
+	}
+	status.SyncStatus = syncStatusOutOfSync
+	status.PendingRevision = revision
+}
+
+// recordDeployment adds a deployment to the front of the stack's history
+// and drops the oldest ones. Redeploying the same revision and images is
+// not recorded again
+func recordDeployment(status *StackStatus, deployment Deployment) {
+	if len(status.Deployments) > 0 {
+		last := status.Deployments[0]
+		if last.Revision == deployment.Revision && maps.Equal(last.Images, deployment.Images) {
+			return
+		}
+	}
+	status.Deployments = append([]Deployment{deployment}, status.Deployments...)
+	if len(status.Deployments) > deploymentHistorySize {
+		status.Deployments = status.Deployments[:deploymentHistorySize]
+	}
 }
 
 func GetStackStatus() map[string]*StackStatus {
-	return stackStatus
+	stacksLock.RLock()
+	defer stacksLock.RUnlock()
+	now := time.Now()
+	statuses := make(map[string]*StackStatus, len(stackStatus))
+	for stackName, status := range stackStatus {
+		// copies, so that callers never share the statuses being updated
+		statusCopy := *status
+		statusCopy.Drift = slices.Clone(status.Drift)
+		statusCopy.Deployments = slices.Clone(status.Deployments)
+		statusCopy.Suspension = activeSuspension(stackName, now)
+		statuses[stackName] = &statusCopy
+	}
+	return statuses
 }
@@ -0,0 +1,88 @@
+package swarmcd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrStackNotFound    = errors.New("stack not found")
+	ErrSyncBlocked      = errors.New("sync blocked by sync windows")
+	ErrRevisionMismatch = errors.New("revision mismatch")
+	ErrInvalidRevision  = errors.New("invalid revision")
+	ErrSyncInProgress   = errors.New("sync in progress")
+)
+
+// abbreviated commit hashes are at least as long as git makes them
+const minRevisionLength = 7
+
+// SyncStack deploys a stack right away, regardless of its sync policy.
+// If revision is set, the stack is only deployed if it is the revision
+// pulled from the repo. Sync windows and suspensions are only overridden when forced
+func SyncStack(name string, revision string, force bool) error {
+	if revision != "" && !isRevision(revision) {
+		return fmt.Errorf("%w: %q must be a commit hash of at least %d characters", ErrInvalidRevision, revision, minRevisionLength)
+	}
+	swarmStack, err := claimStack(name)
+	if err != nil {
+		return err
+	}
+	defer releaseStack(swarmStack)
+	if err := checkLeader(); err != nil {
+		return err
+	}
+	repoLock := swarmStack.repo.lock
+	repoLock.Lock()
+	defer repoLock.Unlock()
+
+	if suspension := activeSuspension(name, time.Now()); suspension != nil && !force {
+		return fmt.Errorf("%w: %s stack", ErrStackSuspended, name)
+	}
+	allowed, nextWindow := syncAllowed(swarmStack.syncWindows, time.Now())
+	if !allowed && !force {
+		if nextWindow.IsZero() {
+			return fmt.Errorf("%w: %s stack", ErrSyncBlocked, name)
+		}
+		return fmt.Errorf("%w: %s stack until %s", ErrSyncBlocked, name, nextWindow.Format(time.RFC3339))
+	}
+	logger.Info(fmt.Sprintf("manual sync of %s stack requested", name), "revision", revision, "force", force)
+	ctx, cancel := swarmStack.stackContext()
+	defer cancel()
+	return deployStackRevision(ctx, swarmStack, revision, true)
+}
+
+func findStack(name string) *swarmStack {
+	stacksLock.RLock()
+	defer stacksLock.RUnlock()
+	for _, swarmStack := range stacks {
+		if swarmStack.name == name {
+			return swarmStack
+		}
+	}
+	return nil
+}
+
+// isSameRevision compares two commit hashes,
+// one of which can be abbreviated
+func isSameRevision(a string, b string) bool {
+	if !isRevision(a) || !isRevision(b) {
+		return false
+	}
+	length := min(len(a), len(b))
+	return strings.EqualFold(a[:length], b[:length])
+}
+
+// isRevision reports whether a string is a commit hash, or an abbreviated one
+func isRevision(revision string) bool {
+	if len(revision) < minRevisionLength {
+		return false
+	}
+	for _, char := range revision {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", char) {
+			return false
+		}
+	}
+	return true
+}
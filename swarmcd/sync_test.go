@@ -0,0 +1,68 @@
+package swarmcd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestIsSameRevision(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want bool
+	}{
+		{a: "1234abcd", b: "1234abcd", want: true},
+		{a: "1234abcd5678ef", b: "1234abcd", want: true},
+		{a: "1234abc", b: "1234abcd", want: true},
+		{a: "1234ABCD", b: "1234abcd", want: true},
+		{a: "1234", b: "1234abcd", want: false},
+		{a: "1234abce", b: "1234abcd", want: false},
+		{a: "1234abcz", b: "1234abcz", want: false},
+		{a: "", b: "1234abcd", want: false},
+	}
+	for _, tt := range tests {
+		if got := isSameRevision(tt.a, tt.b); got != tt.want {
+			t.Errorf("isSameRevision(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSyncUnknownStack(t *testing.T) {
+	err := SyncStack("unknown", "", false)
+	if !errors.Is(err, ErrStackNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSyncInvalidRevision(t *testing.T) {
+	err := SyncStack("unknown", "1234", false)
+	if !errors.Is(err, ErrInvalidRevision) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// A stack is synced by one sync at a time, even across reloads
+func TestSyncStackInProgress(t *testing.T) {
+	stacks = []*swarmStack{newSwarmStack("test", newTestRepo("test"), "main", "docker-compose.yaml", nil, "", false)}
+	defer func() { stacks = nil }()
+
+	claimed, err := claimStack("test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	err = SyncStack("test", "", true)
+	if !errors.Is(err, ErrSyncInProgress) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// reloads replace the stack while it is being synced
+	reloaded := newSwarmStack("test", newTestRepo("test"), "main", "docker-compose.yaml", nil, "", false)
+	reloaded.syncing = claimed.syncing
+	stacks = []*swarmStack{reloaded}
+	if _, err := claimStack("test"); !errors.Is(err, ErrSyncInProgress) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	releaseStack(claimed)
+	if _, err := claimStack("test"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package swarmcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// phases of a stack update that have their own timeout
+const (
+	phasePull    = "pull"
+	phaseDecrypt = "decrypt"
+	phaseDeploy  = "deploy"
+)
+
+// reasons of a failed stack update
+const (
+	failureReasonError   = "Error"
+	failureReasonTimeout = "Timeout"
+)
+
+// time given to clean up after a stack update, even if it timed out
+const cleanupTimeout = time.Minute
+
+var ErrTimeout = errors.New("timed out")
+
+// stackContext bounds a whole update of the stack by its stack
+// timeout, and stops it once this instance loses the leadership
+func (swarmStack *swarmStack) stackContext() (context.Context, context.CancelFunc) {
+	return withTimeout(leadershipContext(), swarmStack.timeouts.Stack)
+}
+
+// runPhase runs a phase of a stack update within the phase's timeout.
+// Errors of phases, or updates, that ran out of time wrap ErrTimeout
+func (swarmStack *swarmStack) runPhase(ctx context.Context, phase string, run func(ctx context.Context) error) error {
+	var timeout int
+	switch phase {
+	case phasePull:
+		timeout = swarmStack.timeouts.Pull
+	case phaseDecrypt:
+		timeout = swarmStack.timeouts.Decrypt
+	case phaseDeploy:
+		timeout = swarmStack.timeouts.Deploy
+		// deploy phases change the swarm, which only the leader may do
+		if err := checkLeadership(ctx); err != nil {
+			return err
+		}
+	}
+	phaseCtx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	err := swarmStack.wrapTimeout(ctx, run(phaseCtx))
+	return wrapTimeout(phaseCtx, fmt.Sprintf("%s of %s stack", phase, swarmStack.name), err)
+}
+
+// wrapTimeout wraps the errors of updates of the stack that ran out of
+// time, and ErrNotLeader in the ones stopped by the loss of the lease
+func (swarmStack *swarmStack) wrapTimeout(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); err != nil && errors.Is(cause, ErrNotLeader) && !errors.Is(err, ErrNotLeader) {
+		return fmt.Errorf("update of %s stack stopped, %w: %w", swarmStack.name, cause, err)
+	}
+	return wrapTimeout(ctx, fmt.Sprintf("update of %s stack", swarmStack.name), err)
+}
+
+// wrapTimeout wraps ErrTimeout in errors of work that ran out of time
+func wrapTimeout(ctx context.Context, work string, err error) error {
+	if err == nil || errors.Is(err, ErrTimeout) || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	return fmt.Errorf("%s %w: %w", work, ErrTimeout, err)
+}
+
+// withTimeout returns a context that expires after the given
+// seconds, or that is only canceled if they are zero
+func withTimeout(ctx context.Context, seconds int) (context.Context, context.CancelFunc) {
+	if seconds <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+}
+
+// how many calls without a context can run at once, including the
+// ones whose callers gave up on them and that were left running
+const maxContextlessCalls = 16
+
+var contextlessCalls = make(chan struct{}, maxContextlessCalls)
+
+// withContext runs a call that takes no context, and returns early if
+// ctx is done. The timeout does not stop the call itself, which is left
+// to finish in the background. At most maxContextlessCalls run at once,
+// so calls that hang can't pile up, later calls wait for a slot until
+// ctx is done
+func withContext[T any](ctx context.Context, call func() (T, error)) (T, error) {
+	type result struct {
+		value T
+		err   error
+	}
+	select {
+	case contextlessCalls <- struct{}{}:
+	case <-ctx.Done():
+		var zero T
+		return zero, fmt.Errorf("%d calls that can't be canceled are still running: %w", maxContextlessCalls, ctx.Err())
+	}
+	results := make(chan result, 1)
+	go func() {
+		defer func() { <-contextlessCalls }()
+		value, err := call()
+		results <- result{value, err}
+	}()
+	select {
+	case result := <-results:
+		return result.value, result.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// setStatusError records why the last update of a stack failed
+func setStatusError(status *StackStatus, err error) {
+	status.Error = err.Error()
+	status.FailureReason = failureReasonError
+	if errors.Is(err, ErrTimeout) {
+		status.FailureReason = failureReasonTimeout
+	}
+}
+
+func clearStatusError(status *StackStatus) {
+	status.Error = ""
+	status.FailureReason = ""
+}
@@ -0,0 +1,90 @@
+package swarmcd
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// Phases that run out of time are reported as timeouts, other errors are not
+func TestRunPhaseTimeout(t *testing.T) {
+	swarmStack := &swarmStack{name: "nginx", timeouts: util.TimeoutsConfig{Pull: 1}}
+	started := time.Now()
+	err := swarmStack.runPhase(context.Background(), phasePull, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "pull of nginx stack timed out") {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if time.Since(started) > 5*time.Second {
+		t.Errorf("phase was not canceled after its timeout")
+	}
+	status := &StackStatus{}
+	setStatusError(status, err)
+	if status.FailureReason != failureReasonTimeout {
+		t.Errorf("expected failure reason %s, got %s", failureReasonTimeout, status.FailureReason)
+	}
+
+	err = swarmStack.runPhase(context.Background(), phaseDeploy, func(ctx context.Context) error {
+		return errors.New("could not deploy stack nginx")
+	})
+	if errors.Is(err, ErrTimeout) {
+		t.Fatalf("unexpected timeout: %s", err)
+	}
+	setStatusError(status, err)
+	if status.FailureReason != failureReasonError {
+		t.Errorf("expected failure reason %s, got %s", failureReasonError, status.FailureReason)
+	}
+}
+
+// Updates that run out of time are not blamed on the phase that was running
+func TestRunPhaseStackTimeout(t *testing.T) {
+	swarmStack := &swarmStack{name: "nginx", timeouts: util.TimeoutsConfig{Decrypt: 60}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := swarmStack.runPhase(ctx, phaseDecrypt, func(ctx context.Context) error {
+		_, err := withContext(ctx, func() ([]byte, error) {
+			time.Sleep(time.Second)
+			return nil, nil
+		})
+		return err
+	})
+	if !errors.Is(err, ErrTimeout) || !strings.HasPrefix(err.Error(), "update of nginx stack timed out") {
+		t.Fatalf("expected the update to time out, got %v", err)
+	}
+}
+
+// Calls left running after a timeout are bounded
+func TestWithContextBoundsLeftCalls(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	for i := 0; i < maxContextlessCalls; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		_, err := withContext(ctx, func() (bool, error) {
+			<-release
+			return true, nil
+		})
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected the call to time out, got %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	started := false
+	_, err := withContext(ctx, func() (bool, error) {
+		started = true
+		return true, nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || started {
+		t.Errorf("expected the call not to start while the others are left running, got %v", err)
+	}
+}
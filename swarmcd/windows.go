@@ -0,0 +1,95 @@
+package swarmcd
+
+import (
+	"sort"
+	"time"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+// how far ahead to look for the next sync window
+const syncWindowHorizon = 7 * 24 * time.Hour
+
+type timeInterval struct {
+	start time.Time
+	end   time.Time
+}
+
+func (interval timeInterval) contains(t time.Time) bool {
+	return !t.Before(interval.start) && t.Before(interval.end)
+}
+
+// syncAllowed reports whether the windows allow syncing at now, and if not,
+// the next time they do. Any active deny window blocks syncing, and if there
+// are allow windows, one of them must be active. The next time is zero when
+// syncing is not allowed within the horizon
+func syncAllowed(windows []*util.SyncWindow, now time.Time) (bool, time.Time) {
+	if len(windows) == 0 {
+		return true, time.Time{}
+	}
+	var maxDuration time.Duration
+	hasAllowWindows := false
+	for _, window := range windows {
+		maxDuration = max(maxDuration, window.Duration)
+		hasAllowWindows = hasAllowWindows || window.Allow
+	}
+
+	// collect the intervals of windows that are or will become active
+	var allowIntervals, denyIntervals []timeInterval
+	end := now.Add(syncWindowHorizon)
+	for t := now.Truncate(time.Minute).Add(-maxDuration); !t.After(end); t = t.Add(time.Minute) {
+		for _, window := range windows {
+			if !window.Schedule.Matches(t.In(window.Location)) {
+				continue
+			}
+			interval := timeInterval{start: t, end: t.Add(window.Duration)}
+			if window.Allow {
+				allowIntervals = append(allowIntervals, interval)
+			} else {
+				denyIntervals = append(denyIntervals, interval)
+			}
+		}
+	}
+
+	allowedAt := func(t time.Time) bool {
+		for _, interval := range denyIntervals {
+			if interval.contains(t) {
+				return false
+			}
+		}
+		if !hasAllowWindows {
+			return true
+		}
+		for _, interval := range allowIntervals {
+			if interval.contains(t) {
+				return true
+			}
+		}
+		return false
+	}
+	if allowedAt(now) {
+		return true, time.Time{}
+	}
+
+	// syncing can only become allowed when a deny window ends or an allow window starts
+	var candidates []time.Time
+	for _, interval := range denyIntervals {
+		if interval.end.After(now) {
+			candidates = append(candidates, interval.end)
+		}
+	}
+	for _, interval := range allowIntervals {
+		if interval.start.After(now) {
+			candidates = append(candidates, interval.start)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Before(candidates[j])
+	})
+	for _, candidate := range candidates {
+		if allowedAt(candidate) {
+			return false, candidate
+		}
+	}
+	return false, time.Time{}
+}
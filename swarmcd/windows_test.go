@@ -0,0 +1,67 @@
+package swarmcd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-adawi/swarm-cd/util"
+)
+
+func TestSyncAllowed(t *testing.T) {
+	windows, err := util.ParseSyncWindows([]util.SyncWindowConfig{
+		// no deployments on friday afternoons
+		{Kind: "deny", Schedule: "0 12 * * 5", Duration: "6h", Timezone: "UTC"},
+		// nightly batch on saturdays
+		{Kind: "deny", Schedule: "0 6 * * 6", Duration: "4h", Timezone: "UTC"},
+		// only deploy between 8:00 and 20:00
+		{Kind: "allow", Schedule: "0 8 * * *", Duration: "12h", Timezone: "UTC"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tests := []struct {
+		name        string
+		now         time.Time
+		wantAllowed bool
+		wantNext    time.Time
+	}{
+		{
+			name:        "allowed",
+			now:         time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC),
+			wantAllowed: true,
+		},
+		{
+			name:     "outside allow window",
+			now:      time.Date(2024, 5, 2, 22, 0, 0, 0, time.UTC),
+			wantNext: time.Date(2024, 5, 3, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "in deny window",
+			now:      time.Date(2024, 5, 3, 14, 0, 0, 0, time.UTC),
+			wantNext: time.Date(2024, 5, 3, 18, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "allow window starts in deny window",
+			now:      time.Date(2024, 5, 4, 7, 0, 0, 0, time.UTC),
+			wantNext: time.Date(2024, 5, 4, 10, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, next := syncAllowed(windows, tt.now)
+			if allowed != tt.wantAllowed {
+				t.Errorf("syncAllowed() allowed = %v, want %v", allowed, tt.wantAllowed)
+			}
+			if !next.Equal(tt.wantNext) {
+				t.Errorf("syncAllowed() next = %v, want %v", next, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestSyncAllowedWithoutWindows(t *testing.T) {
+	allowed, _ := syncAllowed(nil, time.Now())
+	if !allowed {
+		t.Errorf("syncing is not allowed without windows")
+	}
+}
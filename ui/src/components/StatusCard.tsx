@@ -5,12 +5,16 @@ function StatusCard({
   name,
   error,
   revision,
-  repoURL
+  repoURL,
+  cluster,
+  failureReason
 }: Readonly<{
   name: string
   error: string
   revision: string
   repoURL: string
+  cluster?: string
+  failureReason?: string
 }>): React.ReactElement {
   return (
     <Box borderWidth="1px" borderRadius="sm" overflow="hidden" p={4} boxShadow="lg">
@@ -20,11 +24,18 @@ function StatusCard({
 
         {error !== "" && (
           <>
-            <KeyText>Error:</KeyText>
+            <KeyText>{failureReason === "Timeout" ? "Timed out:" : "Error:"}</KeyText>
             <Text color="red.500">{error}</Text>
           </>
         )}
 
+        {cluster !== undefined && cluster !== "" && (
+          <>
+            <KeyText>Cluster:</KeyText>
+            <Text>{cluster}</Text>
+          </>
+        )}
+
         <KeyText>Revision:</KeyText>
         <Text>{revision}</Text>
 
@@ -34,4 +34,28 @@ describe("StatusCard", () => {
     const errorText = screen.queryByText(/error/i)
     expect(errorText).toBeInTheDocument()
   })
+
+  it("should render the cluster if it is set", () => {
+    render(
+      <StatusCard name={status.name} error={""} revision={status.revision} repoURL={status.repoURL} cluster={"prod"} />
+    )
+
+    expect(screen.getByText(/cluster/i)).toBeInTheDocument()
+    expect(screen.getByText("prod")).toBeInTheDocument()
+  })
+
+  it("should render timeouts apart from other errors", () => {
+    render(
+      <StatusCard
+        name={status.name}
+        error={"pull of nginx stack timed out"}
+        revision={status.revision}
+        repoURL={status.repoURL}
+        failureReason={"Timeout"}
+      />
+    )
+
+    expect(screen.getByText(/timed out:/i)).toBeInTheDocument()
+    expect(screen.queryByText(/error:/i)).not.toBeInTheDocument()
+  })
 })
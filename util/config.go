@@ -1,8 +1,15 @@
 package util
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/spf13/viper"
 )
@@ -14,81 +21,559 @@ type StackConfig struct {
 	ValuesFile           string   `mapstructure:"values_file"`
 	SopsFiles            []string `mapstructure:"sops_files"`
 	SopsSecretsDiscovery bool     `mapstructure:"sops_secrets_discovery"`
+	DependsOn            []string `mapstructure:"depends_on"`
+	Hooks                HooksConfig
+	ImageUpdates         []ImageUpdateConfig `mapstructure:"image_updates"`
+	PinImageDigests      bool                `mapstructure:"pin_image_digests"`
+	SyncWindows          []SyncWindowConfig  `mapstructure:"sync_windows"`
+	SyncPolicy           string              `mapstructure:"sync_policy"`
+	SelfHeal             *bool               `mapstructure:"self_heal"`
+	IgnoreDifferences    []string            `mapstructure:"ignore_differences"`
+	SopsAgeKeyFile       string              `mapstructure:"sops_age_key_file"`
+	SopsGPGKeyFile       string              `mapstructure:"sops_gpg_key_file"`
+	SopsFormats          map[string]string   `mapstructure:"sops_formats"`
+	SopsPlaintext        string              `mapstructure:"sops_plaintext"`
+	Cluster              []string            `mapstructure:"cluster"`
+	Registries           []string            `mapstructure:"registries"`
+	Timeouts             TimeoutsConfig
+}
+
+// TimeoutsConfig holds the timeouts of stack updates in seconds,
+// for each phase and for the whole update. Zero means no timeout
+type TimeoutsConfig struct {
+	Pull    int
+	Decrypt int
+	Deploy  int
+	Stack   int
+}
+
+// Override returns the timeouts with the ones set in overrides replacing them
+func (timeouts TimeoutsConfig) Override(overrides TimeoutsConfig) TimeoutsConfig {
+	if overrides.Pull > 0 {
+		timeouts.Pull = overrides.Pull
+	}
+	if overrides.Decrypt > 0 {
+		timeouts.Decrypt = overrides.Decrypt
+	}
+	if overrides.Deploy > 0 {
+		timeouts.Deploy = overrides.Deploy
+	}
+	if overrides.Stack > 0 {
+		timeouts.Stack = overrides.Stack
+	}
+	return timeouts
+}
+
+func (timeouts TimeoutsConfig) validate() error {
+	if timeouts.Pull < 0 || timeouts.Decrypt < 0 || timeouts.Deploy < 0 || timeouts.Stack < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	return nil
+}
+
+// GeneratorConfig creates a stack for every file in the repo matching Glob
+type GeneratorConfig struct {
+	Repo     string
+	Branch   string
+	Glob     string
+	Template GeneratorTemplate
+}
+
+// GeneratorTemplate is the config of generated stacks. Name, values_file
+// and sops_files are Go templates rendered for every matching file
+type GeneratorTemplate struct {
+	Name        string
+	StackConfig `mapstructure:",squash"`
+}
+
+// SecretProviderConfig configures a source of secret values, the
+// options that apply depend on the type: vault, file or env
+type SecretProviderConfig struct {
+	Type      string
+	Address   string
+	Token     string
+	TokenFile string `mapstructure:"token_file"`
+	Namespace string
+	Mount     string
+	KVVersion int `mapstructure:"kv_version"`
+	Path      string
+	Allowed   []string
+	// paths each stack and each repo may read, as path.Match
+	// patterns. Stacks not granted any can't use the provider
+	Stacks map[string][]string
+	Repos  map[string][]string
+}
+
+// Allows tells if a stack of the repo may read the secret path
+func (providerConfig *SecretProviderConfig) Allows(stack string, repo string, secretPath string) bool {
+	patterns := append(append([]string{}, providerConfig.Stacks[stack]...), providerConfig.Repos[repo]...)
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, secretPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ClusterConfig is a swarm cluster stacks can be deployed to,
+// reached through a docker host or a docker context
+type ClusterConfig struct {
+	Host      string
+	Context   string
+	TLSVerify bool   `mapstructure:"tls_verify"`
+	TLSCACert string `mapstructure:"tls_ca_cert"`
+	TLSCert   string `mapstructure:"tls_cert"`
+	TLSKey    string `mapstructure:"tls_key"`
+}
+
+// RegistryConfig holds the credentials of a container registry,
+// a username and password file or a docker credential helper
+type RegistryConfig struct {
+	Address          string
+	Username         string
+	PasswordFile     string `mapstructure:"password_file"`
+	CredentialHelper string `mapstructure:"credential_helper"`
+}
+
+// LeaderElectionConfig lets several instances share a swarm,
+// only the leader syncs stacks while the others serve the API
+type LeaderElectionConfig struct {
+	Enabled bool
+	// seconds the leader keeps the lease without renewing it
+	LeaseDuration int `mapstructure:"lease_duration"`
+	// name of the instance in the lease, defaults to the hostname
+	Identity string
+}
+
+// shortest lease duration in seconds, leaders renew
+// their lease every third of its duration
+const minLeaseDuration = 6
+
+// StacksSourceConfig points to stacks and repos files kept in a repo
+type StacksSourceConfig struct {
+	Repo       string
+	Branch     string
+	StacksFile string `mapstructure:"stacks_file"`
+	ReposFile  string `mapstructure:"repos_file"`
+	// key files and registries the stacks and repos of the stacks
+	// source may use, among the ones of the config. None if empty
+	SopsKeyFiles []string `mapstructure:"sops_key_files"`
+	Registries   []string
+}
+
+type HooksConfig struct {
+	PreDeploy  []string `mapstructure:"pre_deploy"`
+	PostDeploy []string `mapstructure:"post_deploy"`
+	Timeout    int
+}
+
+type SyncWindowConfig struct {
+	Kind     string
+	Schedule string
+	Duration string
+	Timezone string
+}
+
+type ImageUpdateConfig struct {
+	Image  string
+	File   string
+	Policy ImagePolicyConfig
+}
+
+type ImagePolicyConfig struct {
+	Semver string
+	Regex  string
+	Latest bool
 }
 
 type RepoConfig struct {
-	Url          string
-	Username     string
-	Password     string
-	PasswordFile string `mapstructure:"password_file"`
+	Url               string
+	Username          string
+	Password          string
+	PasswordFile      string `mapstructure:"password_file"`
+	PushUsername      string `mapstructure:"push_username"`
+	PushPassword      string `mapstructure:"push_password"`
+	PushPasswordFile  string `mapstructure:"push_password_file"`
+	CommitAuthorName  string `mapstructure:"commit_author_name"`
+	CommitAuthorEmail string `mapstructure:"commit_author_email"`
+	CommitMessage     string `mapstructure:"commit_message"`
+	SopsAgeKeyFile    string `mapstructure:"sops_age_key_file"`
+	SopsGPGKeyFile    string `mapstructure:"sops_gpg_key_file"`
+	// registries the stacks of the repo pull images from
+	Registries []string
 }
 
 type Config struct {
-	ReposPath            string                  `mapstructure:"repos_path"`
-	UpdateInterval       int                     `mapstructure:"update_interval"`
-	AutoRotate           bool                    `mapstructure:"auto_rotate"`
-	StackConfigs         map[string]*StackConfig `mapstructure:"stacks"`
-	RepoConfigs          map[string]*RepoConfig  `mapstructure:"repos"`
-	SopsSecretsDiscovery bool                    `mapstructure:"sops_secrets_discovery"`
-	Address              string                  `mapstructure:"address"`
+	ReposPath            string                           `mapstructure:"repos_path"`
+	UpdateInterval       int                              `mapstructure:"update_interval"`
+	AutoRotate           bool                             `mapstructure:"auto_rotate"`
+	StackConfigs         map[string]*StackConfig          `mapstructure:"stacks"`
+	RepoConfigs          map[string]*RepoConfig           `mapstructure:"repos"`
+	SopsSecretsDiscovery bool                             `mapstructure:"sops_secrets_discovery"`
+	Address              string                           `mapstructure:"address"`
+	APIToken             string                           `mapstructure:"api_token"`
+	APITokenFile         string                           `mapstructure:"api_token_file"`
+	InstanceName         string                           `mapstructure:"instance_name"`
+	PruneStacks          bool                             `mapstructure:"prune_stacks"`
+	PruneGracePeriod     int                              `mapstructure:"prune_grace_period"`
+	DependencyTimeout    int                              `mapstructure:"dependency_timeout"`
+	HookTimeout          int                              `mapstructure:"hook_timeout"`
+	PinImageDigests      bool                             `mapstructure:"pin_image_digests"`
+	SyncWindows          []SyncWindowConfig               `mapstructure:"sync_windows"`
+	StateFile            string                           `mapstructure:"state_file"`
+	SelfHeal             bool                             `mapstructure:"self_heal"`
+	GeneratorConfigs     map[string]*GeneratorConfig      `mapstructure:"generators"`
+	StacksSource         *StacksSourceConfig              `mapstructure:"stacks_source"`
+	SecretProviders      map[string]*SecretProviderConfig `mapstructure:"secret_providers"`
+	SecretCacheTTL       int                              `mapstructure:"secret_cache_ttl"`
+	SopsPlaintext        string                           `mapstructure:"sops_plaintext"`
+	SopsKeyFiles         []string                         `mapstructure:"sops_key_files"`
+	Clusters             map[string]*ClusterConfig        `mapstructure:"clusters"`
+	Registries           map[string]*RegistryConfig       `mapstructure:"registries"`
+	LeaderElection       LeaderElectionConfig             `mapstructure:"leader_election"`
+	Workers              int                              `mapstructure:"workers"`
+	Timeouts             TimeoutsConfig                   `mapstructure:"timeouts"`
 }
 
 var Configs Config
 
-func LoadConfigs() (err error) {
-	err = readConfig()
+// ReadAPIToken returns the token that the API endpoints that change stacks
+// require, read from api_token_file if set. It is empty if they are disabled
+func (config *Config) ReadAPIToken() (string, error) {
+	if config.APITokenFile == "" {
+		return config.APIToken, nil
+	}
+	tokenBytes, err := os.ReadFile(config.APITokenFile)
+	if err != nil {
+		return "", fmt.Errorf("could not read api_token_file %s: %w", config.APITokenFile, err)
+	}
+	token := strings.TrimSpace(string(tokenBytes))
+	if token == "" {
+		return "", fmt.Errorf("api_token_file %s is empty", config.APITokenFile)
+	}
+	return token, nil
+}
+
+// Locations of the configuration files. When empty, config, repos,
+// stacks and generators files are looked up in the working directory
+var (
+	ConfigFile     string
+	ReposFile      string
+	StacksFile     string
+	GeneratorsFile string
+	// directory of additional stacks files, ignored if missing
+	StacksDir = "stacks.d"
+)
+
+// prefix of the environment variables that override the configuration
+const envPrefix = "SWARMCD"
+
+// LoadConfigs reads the configuration files into Configs
+func LoadConfigs() error {
+	configs, err := ReadConfigs()
 	if err != nil {
-		return fmt.Errorf("could not read configuration file: %w", err)
+		return err
 	}
-	if Configs.RepoConfigs == nil {
-		err = readRepoConfigs()
+	Configs = *configs
+	return nil
+}
+
+// ReadConfigs reads and validates the configuration files
+func ReadConfigs() (*Config, error) {
+	configs := &Config{}
+	fileErrors := readConfigFiles(configs)
+	if len(fileErrors) > 0 {
+		return nil, fmt.Errorf("could not read %s: %w", fileErrors[0].description, fileErrors[0].err)
+	}
+	// the same checks as the validate command, so that
+	// both accept the same configuration files
+	problems := validateConfigs(configs)
+	if len(problems) > 0 {
+		return nil, errors.Join(problems...)
+	}
+	return configs, nil
+}
+
+type configFileError struct {
+	description string
+	err         error
+}
+
+// readConfigFiles reads all configuration files, like ReadConfigs,
+// and returns the errors of each of them
+func readConfigFiles(configs *Config, options ...viper.DecoderConfigOption) []configFileError {
+	var fileErrors []configFileError
+	err := readConfig(configs, options...)
+	if err != nil {
+		fileErrors = append(fileErrors, configFileError{"configuration file", err})
+	}
+	if configs.RepoConfigs == nil {
+		err = readRepoConfigs(configs, options...)
 		if err != nil {
-			return fmt.Errorf("could not read repos file: %w", err)
+			fileErrors = append(fileErrors, configFileError{"repos file", err})
+		}
+	}
+	if configs.StackConfigs == nil {
+		err = readStackConfigs(configs, options...)
+		// stacks can be defined in a repo or in the stacks directory instead
+		if errors.As(err, &viper.ConfigFileNotFoundError{}) && (configs.StacksSource != nil || isDir(StacksDir)) {
+			err = nil
 		}
+		if err != nil {
+			fileErrors = append(fileErrors, configFileError{"stacks file", err})
+		}
+	}
+	err = readStacksDir(configs, options...)
+	if err != nil {
+		fileErrors = append(fileErrors, configFileError{"stacks directory", err})
 	}
-	if Configs.StackConfigs == nil {
-		err = readStackConfigs()
+	if configs.GeneratorConfigs == nil {
+		err = readGeneratorConfigs(configs, options...)
 		if err != nil {
-			return fmt.Errorf("could not load stacks file: %w", err)
+			fileErrors = append(fileErrors, configFileError{"generators file", err})
 		}
 	}
-	return
+	return fileErrors
 }
 
-func readConfig() (err error) {
+func readConfig(configs *Config, options ...viper.DecoderConfigOption) (err error) {
 	configViper := viper.New()
-	configViper.SetConfigName("config")
-	configViper.AddConfigPath(".")
+	setConfigFile(configViper, ConfigFile, "config")
+	configViper.SetEnvPrefix(envPrefix)
+	configViper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	bindEnvs(configViper, reflect.TypeOf(Config{}), "")
 	configViper.SetDefault("update_interval", 120)
 	configViper.SetDefault("repos_path", "repos")
 	configViper.SetDefault("auto_rotate", true)
 	configViper.SetDefault("sops_secrets_discovery", false)
 	configViper.SetDefault("address", "0.0.0.0:8080")
+	configViper.SetDefault("instance_name", "swarm-cd")
+	configViper.SetDefault("prune_stacks", false)
+	configViper.SetDefault("prune_grace_period", 300)
+	configViper.SetDefault("dependency_timeout", 300)
+	configViper.SetDefault("hook_timeout", 600)
+	configViper.SetDefault("pin_image_digests", false)
+	configViper.SetDefault("state_file", "state.json")
+	configViper.SetDefault("self_heal", true)
+	configViper.SetDefault("secret_cache_ttl", 300)
+	configViper.SetDefault("sops_plaintext", "fail")
+	configViper.SetDefault("leader_election.enabled", false)
+	configViper.SetDefault("leader_election.lease_duration", 30)
+	configViper.SetDefault("workers", 4)
+	configViper.SetDefault("timeouts.pull", 300)
+	configViper.SetDefault("timeouts.decrypt", 60)
+	configViper.SetDefault("timeouts.deploy", 600)
+	configViper.SetDefault("timeouts.stack", 1800)
 	err = configViper.ReadInConfig()
 	if err != nil && !errors.As(err, &viper.ConfigFileNotFoundError{}) {
 		return
 	}
-	return configViper.Unmarshal(&Configs)
+	return configViper.Unmarshal(configs, options...)
 }
 
-func readRepoConfigs() (err error) {
+func readRepoConfigs(configs *Config, options ...viper.DecoderConfigOption) (err error) {
 	reposViper := viper.New()
-	reposViper.SetConfigName("repos")
-	reposViper.AddConfigPath(".")
+	setConfigFile(reposViper, ReposFile, "repos")
 	err = reposViper.ReadInConfig()
 	if err != nil {
 		return
 	}
-	return reposViper.Unmarshal(&Configs.RepoConfigs)
+	return reposViper.Unmarshal(&configs.RepoConfigs, options...)
 }
 
-func readStackConfigs() (err error) {
+func readStackConfigs(configs *Config, options ...viper.DecoderConfigOption) (err error) {
 	stacksViper := viper.New()
-	stacksViper.SetConfigName("stacks")
-	stacksViper.AddConfigPath(".")
+	setConfigFile(stacksViper, StacksFile, "stacks")
 	err = stacksViper.ReadInConfig()
 	if err != nil {
 		return
 	}
-	return stacksViper.Unmarshal(&Configs.StackConfigs)
+	return stacksViper.Unmarshal(&configs.StackConfigs, options...)
+}
+
+// readStacksDir adds the stacks of every yaml file in the stacks directory
+func readStacksDir(configs *Config, options ...viper.DecoderConfigOption) error {
+	entries, err := os.ReadDir(StacksDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		extension := filepath.Ext(entry.Name())
+		if entry.IsDir() || (extension != ".yaml" && extension != ".yml") {
+			continue
+		}
+		stacksFile := filepath.Join(StacksDir, entry.Name())
+		stacksViper := viper.New()
+		stacksViper.SetConfigFile(stacksFile)
+		err = stacksViper.ReadInConfig()
+		if err != nil {
+			return err
+		}
+		var stackConfigs map[string]*StackConfig
+		err = stacksViper.Unmarshal(&stackConfigs, options...)
+		if err != nil {
+			return fmt.Errorf("%s: %w", stacksFile, err)
+		}
+		if configs.StackConfigs == nil {
+			configs.StackConfigs = map[string]*StackConfig{}
+		}
+		for stack, stackConfig := range stackConfigs {
+			if _, ok := configs.StackConfigs[stack]; ok {
+				return fmt.Errorf("%s: stack %s is already defined", stacksFile, stack)
+			}
+			configs.StackConfigs[stack] = stackConfig
+		}
+	}
+	return nil
+}
+
+// setConfigFile uses the given file, or looks up
+// the file with the default name in the working directory
+func setConfigFile(configViper *viper.Viper, file string, defaultName string) {
+	if file != "" {
+		configViper.SetConfigFile(file)
+		return
+	}
+	configViper.SetConfigName(defaultName)
+	configViper.AddConfigPath(".")
+}
+
+// bindEnvs binds an environment variable to every field of the config, so
+// that fields without a default or a value in the file can be set from env
+func bindEnvs(configViper *viper.Viper, configType reflect.Type, prefix string) {
+	for configType.Kind() == reflect.Pointer {
+		configType = configType.Elem()
+	}
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if key == "" {
+			key = strings.ToLower(field.Name)
+		}
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() == reflect.Struct {
+			bindEnvs(configViper, fieldType, prefix+key+".")
+			continue
+		}
+		configViper.BindEnv(prefix + key)
+	}
+}
+
+func isDir(path string) bool {
+	fileInfo, err := os.Stat(path)
+	return err == nil && fileInfo.IsDir()
+}
+
+// ParseStackConfigs parses the contents of a stacks file
+func ParseStackConfigs(data []byte) (map[string]*StackConfig, error) {
+	stackConfigs := map[string]*StackConfig{}
+	err := parseYAMLConfig(data, &stackConfigs)
+	return stackConfigs, err
+}
+
+// ParseRepoConfigs parses the contents of a repos file
+func ParseRepoConfigs(data []byte) (map[string]*RepoConfig, error) {
+	repoConfigs := map[string]*RepoConfig{}
+	err := parseYAMLConfig(data, &repoConfigs)
+	return repoConfigs, err
+}
+
+func parseYAMLConfig(data []byte, target any) error {
+	configViper := viper.New()
+	configViper.SetConfigType("yaml")
+	err := configViper.ReadConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return configViper.Unmarshal(target)
+}
+
+// readGeneratorConfigs reads the optional generators file
+func readGeneratorConfigs(configs *Config, options ...viper.DecoderConfigOption) (err error) {
+	generatorsViper := viper.New()
+	setConfigFile(generatorsViper, GeneratorsFile, "generators")
+	err = generatorsViper.ReadInConfig()
+	if GeneratorsFile == "" && errors.As(err, &viper.ConfigFileNotFoundError{}) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	return generatorsViper.Unmarshal(&configs.GeneratorConfigs, options...)
+}
+
+// ValidateStackConfigs checks the options of the
+// stacks and the dependencies between them
+func ValidateStackConfigs(stackConfigs map[string]*StackConfig) error {
+	err := validateStackDependencies(stackConfigs)
+	if err != nil {
+		return fmt.Errorf("invalid stacks configuration: %w", err)
+	}
+	for stack, stackConfig := range stackConfigs {
+		_, err = ParseSyncWindows(stackConfig.SyncWindows)
+		if err != nil {
+			return fmt.Errorf("invalid configuration of %s stack: %w", stack, err)
+		}
+		if stackConfig.SyncPolicy != "" && stackConfig.SyncPolicy != "auto" && stackConfig.SyncPolicy != "manual" {
+			return fmt.Errorf("invalid configuration of %s stack: sync_policy must be auto or manual, got %q", stack, stackConfig.SyncPolicy)
+		}
+		err = ValidateSopsOptions(stackConfig.SopsPlaintext, stackConfig.SopsFormats)
+		if err != nil {
+			return fmt.Errorf("invalid configuration of %s stack: %w", stack, err)
+		}
+	}
+	return nil
+}
+
+func validateStackDependencies(stackConfigs map[string]*StackConfig) error {
+	for stack, stackConfig := range stackConfigs {
+		for _, dependency := range stackConfig.DependsOn {
+			if _, ok := stackConfigs[dependency]; !ok {
+				return fmt.Errorf("stack %s depends on %s which is not defined", stack, dependency)
+			}
+		}
+	}
+	// depth-first search, a stack that is reached
+	// again while still being visited is part of a cycle
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := map[string]int{}
+	var visit func(stack string, path []string) error
+	visit = func(stack string, path []string) error {
+		path = append(path, stack)
+		switch state[stack] {
+		case visiting:
+			return fmt.Errorf("dependency cycle between stacks: %s", strings.Join(path, " -> "))
+		case visited:
+			return nil
+		}
+		state[stack] = visiting
+		for _, dependency := range stackConfigs[stack].DependsOn {
+			if err := visit(dependency, path); err != nil {
+				return err
+			}
+		}
+		state[stack] = visited
+		return nil
+	}
+	stackNames := make([]string, 0, len(stackConfigs))
+	for stack := range stackConfigs {
+		stackNames = append(stackNames, stack)
+	}
+	// sort for deterministic error messages
+	sort.Strings(stackNames)
+	for _, stack := range stackNames {
+		if err := visit(stack, nil); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,221 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateStackDependencies(t *testing.T) {
+	tests := []struct {
+		name    string
+		stacks  map[string]*StackConfig
+		wantErr string
+	}{
+		{
+			name: "valid chain",
+			stacks: map[string]*StackConfig{
+				"db":      {},
+				"api":     {DependsOn: []string{"db"}},
+				"gateway": {DependsOn: []string{"api", "db"}},
+			},
+		},
+		{
+			name: "unknown dependency",
+			stacks: map[string]*StackConfig{
+				"api": {DependsOn: []string{"db"}},
+			},
+			wantErr: "stack api depends on db which is not defined",
+		},
+		{
+			name: "self dependency",
+			stacks: map[string]*StackConfig{
+				"api": {DependsOn: []string{"api"}},
+			},
+			wantErr: "dependency cycle between stacks: api -> api",
+		},
+		{
+			name: "cycle",
+			stacks: map[string]*StackConfig{
+				"api":     {DependsOn: []string{"gateway"}},
+				"db":      {DependsOn: []string{"api"}},
+				"gateway": {DependsOn: []string{"db"}},
+			},
+			wantErr: "dependency cycle between stacks: api -> gateway -> db -> api",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateStackDependencies(tt.stacks)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateStackDependencies() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseStackConfigs(t *testing.T) {
+	stackConfigs, err := ParseStackConfigs([]byte(`
+nginx:
+  repo: example
+  branch: main
+  compose_file: nginx/compose.yaml
+  depends_on: [db]
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	nginx, ok := stackConfigs["nginx"]
+	if !ok {
+		t.Fatalf("expected nginx stack, got %v", stackConfigs)
+	}
+	if nginx.Repo != "example" || nginx.ComposeFile != "nginx/compose.yaml" || len(nginx.DependsOn) != 1 {
+		t.Errorf("unexpected stack config: %+v", nginx)
+	}
+	_, err = ParseStackConfigs([]byte("nginx: [unclosed"))
+	if err == nil {
+		t.Errorf("expected an error for invalid yaml")
+	}
+}
+
+func TestReadConfigFromEnv(t *testing.T) {
+	defer func(configFile string) { ConfigFile = configFile }(ConfigFile)
+	ConfigFile = filepath.Join(t.TempDir(), "swarm-cd.yaml")
+	err := os.WriteFile(ConfigFile, []byte("update_interval: 60\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SWARMCD_UPDATE_INTERVAL", "30")
+	t.Setenv("SWARMCD_PRUNE_STACKS", "true")
+	t.Setenv("SWARMCD_STACKS_SOURCE_REPO", "config")
+
+	configs := &Config{}
+	err = readConfig(configs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if configs.UpdateInterval != 30 || !configs.PruneStacks {
+		t.Errorf("expected environment to override the file, got %+v", configs)
+	}
+	if configs.StacksSource == nil || configs.StacksSource.Repo != "config" {
+		t.Errorf("expected nested options to be set from environment, got %+v", configs.StacksSource)
+	}
+}
+
+func TestReadStacksDir(t *testing.T) {
+	defer func(stacksDir string) { StacksDir = stacksDir }(StacksDir)
+	StacksDir = t.TempDir()
+	files := map[string]string{
+		"nginx.yaml": "nginx:\n  repo: example\n  compose_file: nginx/compose.yaml\n",
+		"db.yml":     "db:\n  repo: example\n  compose_file: db/compose.yaml\n",
+		"notes.txt":  "not a stacks file",
+	}
+	for name, contents := range files {
+		err := os.WriteFile(filepath.Join(StacksDir, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	configs := &Config{StackConfigs: map[string]*StackConfig{"api": {Repo: "example"}}}
+	err := readStacksDir(configs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, stack := range []string{"api", "nginx", "db"} {
+		if _, ok := configs.StackConfigs[stack]; !ok {
+			t.Errorf("expected %s stack, got %v", stack, configs.StackConfigs)
+		}
+	}
+
+	err = readStacksDir(configs)
+	if err == nil || !strings.Contains(err.Error(), "is already defined") {
+		t.Errorf("expected an error for stacks defined twice, got %v", err)
+	}
+}
+
+func TestReadGeneratorConfigsFile(t *testing.T) {
+	defer func(generatorsFile string) { GeneratorsFile = generatorsFile }(GeneratorsFile)
+	GeneratorsFile = filepath.Join(t.TempDir(), "apps.yaml")
+	err := os.WriteFile(GeneratorsFile, []byte("apps:\n  repo: example\n  glob: stacks/*/compose.yaml\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs := &Config{}
+	err = readGeneratorConfigs(configs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if generator, ok := configs.GeneratorConfigs["apps"]; !ok || generator.Glob != "stacks/*/compose.yaml" {
+		t.Errorf("expected apps generator, got %v", configs.GeneratorConfigs)
+	}
+
+	GeneratorsFile = filepath.Join(t.TempDir(), "missing.yaml")
+	err = readGeneratorConfigs(&Config{})
+	if err == nil {
+		t.Errorf("expected an error for a missing generators file")
+	}
+}
+
+func TestTimeoutsOverride(t *testing.T) {
+	timeouts := TimeoutsConfig{Pull: 300, Decrypt: 60, Deploy: 600, Stack: 1800}
+	overridden := timeouts.Override(TimeoutsConfig{Deploy: 1200})
+	expected := TimeoutsConfig{Pull: 300, Decrypt: 60, Deploy: 1200, Stack: 1800}
+	if overridden != expected {
+		t.Errorf("expected %+v, got %+v", expected, overridden)
+	}
+}
+
+// writeConfigFiles points the configuration files to a temporary
+// directory, with the given config and a single stack
+func writeConfigFiles(t *testing.T, config string) {
+	configFile, reposFile, stacksFile, stacksDir := ConfigFile, ReposFile, StacksFile, StacksDir
+	t.Cleanup(func() { ConfigFile, ReposFile, StacksFile, StacksDir = configFile, reposFile, stacksFile, stacksDir })
+	dir := t.TempDir()
+	ConfigFile = filepath.Join(dir, "config.yaml")
+	ReposFile = filepath.Join(dir, "repos.yaml")
+	StacksFile = filepath.Join(dir, "stacks.yaml")
+	StacksDir = filepath.Join(dir, "stacks.d")
+	files := map[string]string{
+		ConfigFile: config,
+		ReposFile:  "example:\n  url: https://example.com/example.git\n",
+		StacksFile: "nginx:\n  repo: example\n  compose_file: nginx/compose.yaml\n",
+	}
+	for file, contents := range files {
+		err := os.WriteFile(file, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadConfigsLeaseDuration(t *testing.T) {
+	writeConfigFiles(t, "leader_election:\n  enabled: true\n  lease_duration: 0\n")
+	_, err := ReadConfigs()
+	if err == nil || !strings.Contains(err.Error(), "lease_duration must be at least") {
+		t.Errorf("expected an error for a lease_duration of 0, got %v", err)
+	}
+
+	writeConfigFiles(t, "leader_election:\n  enabled: true\n")
+	_, err = ReadConfigs()
+	if err != nil {
+		t.Errorf("unexpected error with the default lease_duration: %s", err)
+	}
+}
+
+func TestReadConfigsValidates(t *testing.T) {
+	// rejected by the validate command, so the daemon must reject it as well
+	writeConfigFiles(t, "workers: 0\nregistries:\n  ghcr:\n    address: ghcr.io\n")
+	_, err := ReadConfigs()
+	if err == nil {
+		t.Fatal("expected an error for invalid configs")
+	}
+	for _, problem := range []string{"workers must be at least 1", "registry ghcr: one of password_file or credential_helper is required"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %q in %s", problem, err)
+		}
+	}
+}
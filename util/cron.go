@@ -0,0 +1,126 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a standard five field cron expression:
+// minute, hour, day of month, month and day of week
+type CronSchedule struct {
+	minutes     []bool
+	hours       []bool
+	daysOfMonth []bool
+	months      []bool
+	daysOfWeek  []bool
+	// whether day of month and day of week are restricted,
+	// if both are, a time matches when either of them does
+	daysOfMonthRestricted bool
+	daysOfWeekRestricted  bool
+}
+
+type cronField struct {
+	name string
+	min  int
+	max  int
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12},
+	// 0 and 7 are both sunday
+	{name: "day of week", min: 0, max: 7},
+}
+
+func ParseCronSchedule(spec string) (*CronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid cron schedule %q: expected %d fields, got %d", spec, len(cronFields), len(fields))
+	}
+	values := make([][]bool, len(cronFields))
+	for i, field := range fields {
+		var err error
+		values[i], err = parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron schedule %q: %w", spec, err)
+		}
+	}
+	// fold sunday as 7 into 0
+	values[4][0] = values[4][0] || values[4][7]
+	return &CronSchedule{
+		minutes:               values[0],
+		hours:                 values[1],
+		daysOfMonth:           values[2],
+		months:                values[3],
+		daysOfWeek:            values[4][:7],
+		daysOfMonthRestricted: fields[2] != "*",
+		daysOfWeekRestricted:  fields[4] != "*",
+	}, nil
+}
+
+// parseCronField parses comma separated values, ranges
+// and steps like 1,5-10,*/15 into a set of allowed values
+func parseCronField(field string, spec cronField) ([]bool, error) {
+	values := make([]bool, spec.max+1)
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid %s step %q", spec.name, stepPart)
+			}
+		}
+		start, end := spec.min, spec.max
+		if rangePart != "*" {
+			startPart, endPart, isRange := strings.Cut(rangePart, "-")
+			var err error
+			start, err = parseCronValue(startPart, spec)
+			if err != nil {
+				return nil, err
+			}
+			end = start
+			if isRange {
+				end, err = parseCronValue(endPart, spec)
+				if err != nil {
+					return nil, err
+				}
+			} else if hasStep {
+				end = spec.max
+			}
+			if end < start {
+				return nil, fmt.Errorf("invalid %s range %q", spec.name, rangePart)
+			}
+		}
+		for value := start; value <= end; value += step {
+			values[value] = true
+		}
+	}
+	return values, nil
+}
+
+func parseCronValue(value string, spec cronField) (int, error) {
+	number, err := strconv.Atoi(value)
+	if err != nil || number < spec.min || number > spec.max {
+		return 0, fmt.Errorf("invalid %s %q, must be between %d and %d", spec.name, value, spec.min, spec.max)
+	}
+	return number, nil
+}
+
+// Matches reports whether the minute of t matches the schedule
+func (schedule *CronSchedule) Matches(t time.Time) bool {
+	if !schedule.minutes[t.Minute()] || !schedule.hours[t.Hour()] || !schedule.months[t.Month()] {
+		return false
+	}
+	dayOfMonth := schedule.daysOfMonth[t.Day()]
+	dayOfWeek := schedule.daysOfWeek[t.Weekday()]
+	if schedule.daysOfMonthRestricted && schedule.daysOfWeekRestricted {
+		return dayOfMonth || dayOfWeek
+	}
+	return dayOfMonth && dayOfWeek
+}
@@ -0,0 +1,46 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronSchedule(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule string
+		time     time.Time
+		want     bool
+	}{
+		{name: "every minute", schedule: "* * * * *", time: time.Date(2024, 5, 3, 13, 7, 0, 0, time.UTC), want: true},
+		{name: "exact time", schedule: "30 22 * * *", time: time.Date(2024, 5, 3, 22, 30, 0, 0, time.UTC), want: true},
+		{name: "wrong minute", schedule: "30 22 * * *", time: time.Date(2024, 5, 3, 22, 31, 0, 0, time.UTC), want: false},
+		{name: "friday afternoon", schedule: "0 12-17 * * 5", time: time.Date(2024, 5, 3, 14, 0, 0, 0, time.UTC), want: true},
+		{name: "not friday", schedule: "0 12-17 * * 5", time: time.Date(2024, 5, 4, 14, 0, 0, 0, time.UTC), want: false},
+		{name: "sunday as 7", schedule: "0 0 * * 7", time: time.Date(2024, 5, 5, 0, 0, 0, 0, time.UTC), want: true},
+		{name: "step", schedule: "*/15 * * * *", time: time.Date(2024, 5, 3, 13, 45, 0, 0, time.UTC), want: true},
+		{name: "step miss", schedule: "*/15 * * * *", time: time.Date(2024, 5, 3, 13, 46, 0, 0, time.UTC), want: false},
+		{name: "list", schedule: "0 8,20 * * *", time: time.Date(2024, 5, 3, 20, 0, 0, 0, time.UTC), want: true},
+		{name: "day of month or week", schedule: "0 0 1 * 1", time: time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC), want: true},
+		{name: "month", schedule: "0 0 * 12 *", time: time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := ParseCronSchedule(tt.schedule)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := schedule.Matches(tt.time); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInvalidCronSchedule(t *testing.T) {
+	for _, schedule := range []string{"* * * *", "60 * * * *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseCronSchedule(schedule); err == nil {
+			t.Errorf("expected an error parsing %q", schedule)
+		}
+	}
+}
@@ -4,16 +4,72 @@ import (
 	"log/slog"
 	"os"
 	"strings"
+	"sync"
 )
 
 var Logger *slog.Logger
 
+// secret values replaced in log messages and attributes, by where they
+// come from. Values read again from the same place replace the old ones
+var redactedSecrets = map[string]map[string]bool{}
+
+var redactedSecretsLock sync.RWMutex
+
+// replaces secret values in logs and rendered compose files
+const RedactedValue = "<redacted>"
+
+// values shorter than this are not redacted, as
+// replacing them would garble every log line
+const minRedactedSecretLength = 4
+
 func init() {
 	level := getLogLevelFromEnv()
-	logOptions := &slog.HandlerOptions{Level: level}
+	logOptions := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
 	Logger = slog.New(slog.NewTextHandler(os.Stderr, logOptions))
 }
 
+// RedactSecret hides the secret values read from source from the
+// logs, instead of the values last read from the same source
+func RedactSecret(source string, values ...string) {
+	secrets := map[string]bool{}
+	for _, value := range values {
+		if len(value) >= minRedactedSecretLength {
+			secrets[value] = true
+		}
+	}
+	redactedSecretsLock.Lock()
+	defer redactedSecretsLock.Unlock()
+	if len(secrets) == 0 {
+		delete(redactedSecrets, source)
+		return
+	}
+	redactedSecrets[source] = secrets
+}
+
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	if attr.Value.Kind() != slog.KindString && attr.Value.Kind() != slog.KindAny {
+		return attr
+	}
+	value := attr.Value.String()
+	redacted := Redact(value)
+	if redacted != value {
+		attr.Value = slog.StringValue(redacted)
+	}
+	return attr
+}
+
+// Redact replaces the registered secret values in a string
+func Redact(value string) string {
+	redactedSecretsLock.RLock()
+	defer redactedSecretsLock.RUnlock()
+	for _, secrets := range redactedSecrets {
+		for secret := range secrets {
+			value = strings.ReplaceAll(value, secret, RedactedValue)
+		}
+	}
+	return value
+}
+
 func getLogLevelFromEnv() slog.Level {
 	envLogLevel := strings.ToLower(os.Getenv("LOG_LEVEL"))
 	switch envLogLevel {
@@ -0,0 +1,21 @@
+package util
+
+import "testing"
+
+// Values read again from the same source replace the old ones
+func TestRedactSecretReplacesValuesOfSource(t *testing.T) {
+	RedactSecret("test source", "old-secret", "ab")
+	RedactSecret("other source", "other-secret")
+	if redacted := Redact("old-secret other-secret ab"); redacted != "<redacted> <redacted> ab" {
+		t.Errorf("unexpected redacted value: %q", redacted)
+	}
+	RedactSecret("test source", "new-secret")
+	if redacted := Redact("old-secret new-secret other-secret"); redacted != "old-secret <redacted> <redacted>" {
+		t.Errorf("unexpected redacted value: %q", redacted)
+	}
+	RedactSecret("test source")
+	RedactSecret("other source")
+	if redacted := Redact("new-secret other-secret"); redacted != "new-secret other-secret" {
+		t.Errorf("unexpected redacted value: %q", redacted)
+	}
+}
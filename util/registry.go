@@ -0,0 +1,342 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+)
+
+// media types accepted when fetching manifests
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+var linkNextRegex = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+var authParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// RegistryCredentials returns the username and password
+// to use for a registry host, both empty for anonymous access
+type RegistryCredentials func(host string) (username string, password string)
+
+// RegistryClient talks to OCI distribution registries
+type RegistryClient struct {
+	httpClient  *http.Client
+	credentials RegistryCredentials
+	lock        sync.Mutex
+	// creation times of images by image@digest, which never change
+	created map[string]time.Time
+}
+
+type registryManifest struct {
+	MediaType string `json:"mediaType"`
+	Config    struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			Architecture string `json:"architecture"`
+			OS           string `json:"os"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+func NewRegistryClient(credentials RegistryCredentials) *RegistryClient {
+	if credentials == nil {
+		credentials = func(string) (string, string) { return "", "" }
+	}
+	return &RegistryClient{
+		httpClient:  &http.Client{Timeout: 30 * time.Second},
+		credentials: credentials,
+		created:     map[string]time.Time{},
+	}
+}
+
+// RegistryHost returns the registry host of an image,
+// e.g. docker.io for official images
+func RegistryHost(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image %s: %w", image, err)
+	}
+	return reference.Domain(named), nil
+}
+
+// ListTags returns all the tags of an image repository
+func (client *RegistryClient) ListTags(ctx context.Context, image string) ([]string, error) {
+	host, repository, err := splitImage(image)
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	nextURL := registryURL(host, "/v2/"+repository+"/tags/list")
+	for nextURL != "" {
+		response, err := client.get(ctx, host, nextURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not list tags of %s: %w", image, err)
+		}
+		var tagList struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&tagList)
+		response.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not parse tags of %s: %w", image, err)
+		}
+		tags = append(tags, tagList.Tags...)
+		nextURL = ""
+		if match := linkNextRegex.FindStringSubmatch(response.Header.Get("Link")); match != nil {
+			next, err := response.Request.URL.Parse(match[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid next page link for tags of %s: %w", image, err)
+			}
+			nextURL = next.String()
+		}
+	}
+	return tags, nil
+}
+
+// ResolveDigest returns the digest of the manifest an image tag points to
+func (client *RegistryClient) ResolveDigest(ctx context.Context, image string, tag string) (string, error) {
+	host, repository, err := splitImage(image)
+	if err != nil {
+		return "", err
+	}
+	manifestURL := registryURL(host, "/v2/"+repository+"/manifests/"+tag)
+	headers := map[string]string{"Accept": strings.Join(manifestMediaTypes, ", ")}
+	response, err := client.do(ctx, http.MethodHead, host, manifestURL, headers)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve digest of %s:%s: %w", image, tag, err)
+	}
+	response.Body.Close()
+	digest := response.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("could not resolve digest of %s:%s: registry returned no digest", image, tag)
+	}
+	return digest, nil
+}
+
+// GetCreated returns the creation time of an image tag, read from its config.
+// Creation times are cached by the digest the tag points to, so that
+// only the digest is requested for tags that did not change
+func (client *RegistryClient) GetCreated(ctx context.Context, image string, tag string) (time.Time, error) {
+	digest, err := client.ResolveDigest(ctx, image, tag)
+	if err != nil {
+		return time.Time{}, err
+	}
+	client.lock.Lock()
+	created, ok := client.created[image+"@"+digest]
+	client.lock.Unlock()
+	if ok {
+		return created, nil
+	}
+	created, err = client.getCreated(ctx, image, digest)
+	if err != nil {
+		return time.Time{}, err
+	}
+	client.lock.Lock()
+	client.created[image+"@"+digest] = created
+	client.lock.Unlock()
+	return created, nil
+}
+
+// getCreated reads the creation time of an image from its config
+func (client *RegistryClient) getCreated(ctx context.Context, image string, digest string) (time.Time, error) {
+	host, repository, err := splitImage(image)
+	if err != nil {
+		return time.Time{}, err
+	}
+	manifest, err := client.getManifest(ctx, host, repository, digest)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not get manifest of %s@%s: %w", image, digest, err)
+	}
+	// use the linux/amd64 image of multi-platform images, or the first one
+	if len(manifest.Manifests) > 0 {
+		platformDigest := manifest.Manifests[0].Digest
+		for _, platformManifest := range manifest.Manifests {
+			if platformManifest.Platform.OS == "linux" && platformManifest.Platform.Architecture == "amd64" {
+				platformDigest = platformManifest.Digest
+				break
+			}
+		}
+		manifest, err = client.getManifest(ctx, host, repository, platformDigest)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("could not get manifest of %s@%s: %w", image, platformDigest, err)
+		}
+	}
+	response, err := client.get(ctx, host, registryURL(host, "/v2/"+repository+"/blobs/"+manifest.Config.Digest), nil)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not get config of %s@%s: %w", image, digest, err)
+	}
+	defer response.Body.Close()
+	var imageConfig struct {
+		Created time.Time `json:"created"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&imageConfig)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse config of %s@%s: %w", image, digest, err)
+	}
+	return imageConfig.Created, nil
+}
+
+func (client *RegistryClient) getManifest(ctx context.Context, host string, repository string, ref string) (*registryManifest, error) {
+	headers := map[string]string{"Accept": strings.Join(manifestMediaTypes, ", ")}
+	response, err := client.get(ctx, host, registryURL(host, "/v2/"+repository+"/manifests/"+ref), headers)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var manifest registryManifest
+	err = json.NewDecoder(response.Body).Decode(&manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func (client *RegistryClient) get(ctx context.Context, host string, requestURL string, headers map[string]string) (*http.Response, error) {
+	return client.do(ctx, http.MethodGet, host, requestURL, headers)
+}
+
+// do sends a request, authenticating with basic auth or a
+// bearer token when the registry asks for it
+func (client *RegistryClient) do(ctx context.Context, method string, host string, requestURL string, headers map[string]string) (*http.Response, error) {
+	response, err := client.send(ctx, method, requestURL, headers, "")
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusUnauthorized {
+		challenge := response.Header.Get("WWW-Authenticate")
+		response.Body.Close()
+		authorization, err := client.authorize(ctx, host, challenge)
+		if err != nil {
+			return nil, err
+		}
+		response, err = client.send(ctx, method, requestURL, headers, authorization)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("registry returned %s", response.Status)
+	}
+	return response, nil
+}
+
+func (client *RegistryClient) send(ctx context.Context, method string, requestURL string, headers map[string]string, authorization string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	return client.httpClient.Do(request)
+}
+
+func (client *RegistryClient) authorize(ctx context.Context, host string, challenge string) (string, error) {
+	username, password := client.credentials(host)
+	scheme, params, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if username == "" {
+			return "", fmt.Errorf("registry %s requires authentication", host)
+		}
+		request, _ := http.NewRequest(http.MethodGet, "/", nil)
+		request.SetBasicAuth(username, password)
+		return request.Header.Get("Authorization"), nil
+	case "bearer":
+		token, err := client.fetchToken(ctx, params, username, password)
+		if err != nil {
+			return "", fmt.Errorf("could not get token for registry %s: %w", host, err)
+		}
+		return "Bearer " + token, nil
+	default:
+		return "", fmt.Errorf("registry %s requires unsupported authentication %q", host, challenge)
+	}
+}
+
+func (client *RegistryClient) fetchToken(ctx context.Context, challengeParams string, username string, password string) (string, error) {
+	params := map[string]string{}
+	for _, match := range authParamRegex.FindAllStringSubmatch(challengeParams, -1) {
+		params[match[1]] = match[2]
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid token realm %q", params["realm"])
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if username != "" {
+		request.SetBasicAuth(username, password)
+	}
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return "", fmt.Errorf("token server returned %s: %s", response.Status, body)
+	}
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&tokenResponse)
+	if err != nil {
+		return "", err
+	}
+	if tokenResponse.Token != "" {
+		return tokenResponse.Token, nil
+	}
+	return tokenResponse.AccessToken, nil
+}
+
+func splitImage(image string) (host string, repository string, err error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid image %s: %w", image, err)
+	}
+	return reference.Domain(named), reference.Path(named), nil
+}
+
+func registryURL(host string, path string) string {
+	// docker hub serves the registry API on a different host
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	// like docker, talk plain http to local registries
+	scheme := "https"
+	hostname := strings.Split(host, ":")[0]
+	if hostname == "localhost" || strings.HasPrefix(hostname, "127.") {
+		scheme = "http"
+	}
+	return scheme + "://" + host + path
+}
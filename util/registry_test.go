@@ -0,0 +1,140 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRegistry serves a single image repository behind token
+// authentication, like a local registry with an auth server
+func newTestRegistry(t *testing.T) *httptest.Server {
+	return newCountingTestRegistry(t, map[string]int{})
+}
+
+// newCountingTestRegistry counts the requests it serves by path
+func newCountingTestRegistry(t *testing.T, requests map[string]int) *httptest.Server {
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "user" || password != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("scope") != "repository:team/app:pull" {
+			t.Errorf("unexpected token scope: %s", r.URL.Query().Get("scope"))
+		}
+		fmt.Fprint(w, `{"token": "secret-token"}`)
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:team/app:pull"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		requests[r.URL.Path]++
+		switch r.URL.Path {
+		case "/v2/team/app/tags/list":
+			if r.URL.Query().Get("last") == "" {
+				w.Header().Set("Link", `</v2/team/app/tags/list?n=2&last=1.1.0>; rel="next"`)
+				fmt.Fprint(w, `{"name": "team/app", "tags": ["1.0.0", "1.1.0"]}`)
+			} else {
+				fmt.Fprint(w, `{"name": "team/app", "tags": ["2.0.0"]}`)
+			}
+		case "/v2/team/app/manifests/1.0.0", "/v2/team/app/manifests/sha256:1234":
+			w.Header().Set("Docker-Content-Digest", "sha256:1234")
+			fmt.Fprint(w, `{"mediaType": "application/vnd.oci.image.manifest.v1+json", "config": {"digest": "sha256:abcd"}}`)
+		case "/v2/team/app/blobs/sha256:abcd":
+			fmt.Fprint(w, `{"created": "2024-05-01T10:00:00Z"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	server = httptest.NewServer(mux)
+	return server
+}
+
+func TestRegistryClient(t *testing.T) {
+	server := newTestRegistry(t)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	image := host + "/team/app"
+	client := NewRegistryClient(func(registryHost string) (string, string) {
+		if registryHost != host {
+			t.Errorf("unexpected registry host: %s", registryHost)
+		}
+		return "user", "pass"
+	})
+
+	tags, err := client.ListTags(context.Background(), image)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if strings.Join(tags, ",") != "1.0.0,1.1.0,2.0.0" {
+		t.Errorf("unexpected tags: %v", tags)
+	}
+
+	digest, err := client.ResolveDigest(context.Background(), image, "1.0.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if digest != "sha256:1234" {
+		t.Errorf("unexpected digest: %s", digest)
+	}
+
+	created, err := client.GetCreated(context.Background(), image, "1.0.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !created.Equal(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected creation time: %s", created)
+	}
+}
+
+// Creation times are only read once per digest
+func TestRegistryClientCachesCreated(t *testing.T) {
+	requests := map[string]int{}
+	server := newCountingTestRegistry(t, requests)
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/team/app"
+	client := NewRegistryClient(func(string) (string, string) { return "user", "pass" })
+	for i := 0; i < 2; i++ {
+		_, err := client.GetCreated(context.Background(), image, "1.0.0")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if requests["/v2/team/app/blobs/sha256:abcd"] != 1 {
+		t.Errorf("expected the config to be read once, got %d requests", requests["/v2/team/app/blobs/sha256:abcd"])
+	}
+}
+
+func TestRegistryClientWrongCredentials(t *testing.T) {
+	server := newTestRegistry(t)
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/team/app"
+	client := NewRegistryClient(nil)
+	_, err := client.ListTags(context.Background(), image)
+	if err == nil {
+		t.Errorf("expected an error listing tags without credentials")
+	}
+}
+
+func TestRegistryClientCanceled(t *testing.T) {
+	server := newTestRegistry(t)
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/team/app"
+	client := NewRegistryClient(func(string) (string, string) { return "user", "pass" })
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := client.ResolveDigest(ctx, image, "1.0.0")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the request to be canceled, got %v", err)
+	}
+}
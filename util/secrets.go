@@ -0,0 +1,222 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-yaml"
+)
+
+// SecretProvider returns secret values by path. Providers that store
+// several values under a path, like Vault, select one of them with key
+type SecretProvider interface {
+	GetSecret(ctx context.Context, path string, key string) (string, error)
+}
+
+// NewSecretProvider creates the provider of the given config type
+func NewSecretProvider(providerConfig *SecretProviderConfig) (SecretProvider, error) {
+	switch providerConfig.Type {
+	case "vault":
+		return NewVaultProvider(providerConfig)
+	case "file":
+		if providerConfig.Path == "" {
+			return nil, fmt.Errorf("file secret provider requires path")
+		}
+		return &FileProvider{dir: providerConfig.Path}, nil
+	case "env":
+		return &EnvProvider{allowed: providerConfig.Allowed}, nil
+	default:
+		return nil, fmt.Errorf("unknown secret provider type %q, must be vault, file or env", providerConfig.Type)
+	}
+}
+
+// VaultProvider reads secrets from a HashiCorp Vault KV secrets engine
+type VaultProvider struct {
+	httpClient *http.Client
+	address    string
+	token      string
+	namespace  string
+	mount      string
+	kvVersion  int
+}
+
+func NewVaultProvider(providerConfig *SecretProviderConfig) (*VaultProvider, error) {
+	if providerConfig.Address == "" {
+		return nil, fmt.Errorf("vault secret provider requires address")
+	}
+	token := providerConfig.Token
+	if token == "" && providerConfig.TokenFile != "" {
+		tokenBytes, err := os.ReadFile(providerConfig.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read vault token file %s: %w", providerConfig.TokenFile, err)
+		}
+		token = strings.TrimSpace(string(tokenBytes))
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if token == "" {
+		return nil, fmt.Errorf("vault secret provider requires one of token, token_file or the VAULT_TOKEN environment variable")
+	}
+	mount := providerConfig.Mount
+	if mount == "" {
+		mount = "secret"
+	}
+	kvVersion := providerConfig.KVVersion
+	if kvVersion == 0 {
+		kvVersion = 2
+	}
+	if kvVersion != 1 && kvVersion != 2 {
+		return nil, fmt.Errorf("vault kv_version must be 1 or 2, got %d", kvVersion)
+	}
+	RedactSecret("vault token of "+providerConfig.Address, token)
+	return &VaultProvider{
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		address:    strings.TrimSuffix(providerConfig.Address, "/"),
+		token:      token,
+		namespace:  providerConfig.Namespace,
+		mount:      strings.Trim(mount, "/"),
+		kvVersion:  kvVersion,
+	}, nil
+}
+
+func (provider *VaultProvider) GetSecret(ctx context.Context, secretPath string, key string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("vault secret %s requires a key", secretPath)
+	}
+	segments := strings.Split(strings.Trim(secretPath, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	apiPath := provider.mount + "/" + strings.Join(segments, "/")
+	if provider.kvVersion == 2 {
+		apiPath = provider.mount + "/data/" + strings.Join(segments, "/")
+	}
+	requestURL := provider.address + "/v1/" + apiPath
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("X-Vault-Token", provider.token)
+	if provider.namespace != "" {
+		request.Header.Set("X-Vault-Namespace", provider.namespace)
+	}
+	response, err := provider.httpClient.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("could not read vault secret %s: %w", secretPath, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not read vault secret %s: %s", secretPath, response.Status)
+	}
+	var body struct {
+		Data map[string]any `json:"data"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("could not decode vault secret %s: %w", secretPath, err)
+	}
+	data := body.Data
+	if provider.kvVersion == 2 {
+		data, _ = body.Data["data"].(map[string]any)
+	}
+	value, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no key %s", secretPath, key)
+	}
+	return fmt.Sprint(value), nil
+}
+
+// FileProvider reads secrets from files in a directory, like mounted
+// docker or kubernetes secrets. With a key, the file is parsed as YAML
+type FileProvider struct {
+	dir string
+}
+
+func (provider *FileProvider) GetSecret(_ context.Context, secretPath string, key string) (string, error) {
+	filePath := filepath.Join(provider.dir, filepath.FromSlash(secretPath))
+	relativePath, err := filepath.Rel(provider.dir, filePath)
+	if err != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("secret file %s is outside of %s", secretPath, provider.dir)
+	}
+	fileBytes, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", fmt.Errorf("could not read secret file %s: %w", secretPath, err)
+	}
+	if key == "" {
+		return strings.TrimSpace(string(fileBytes)), nil
+	}
+	var values map[string]any
+	err = yaml.Unmarshal(fileBytes, &values)
+	if err != nil {
+		return "", fmt.Errorf("could not parse secret file %s: %w", secretPath, err)
+	}
+	value, ok := values[key]
+	if !ok {
+		return "", fmt.Errorf("secret file %s has no key %s", secretPath, key)
+	}
+	return fmt.Sprint(value), nil
+}
+
+// EnvProvider reads secrets from allow-listed environment variables
+type EnvProvider struct {
+	allowed []string
+}
+
+func (provider *EnvProvider) GetSecret(_ context.Context, name string, key string) (string, error) {
+	if !slices.Contains(provider.allowed, name) {
+		return "", fmt.Errorf("environment variable %s is not allowed as a secret", name)
+	}
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// CachingProvider keeps the secrets returned by a provider for a while,
+// and registers them to be redacted from logs
+type CachingProvider struct {
+	name     string
+	provider SecretProvider
+	ttl      time.Duration
+	lock     sync.Mutex
+	entries  map[string]cachedSecret
+	now      func() time.Time
+}
+
+type cachedSecret struct {
+	value     string
+	expiresAt time.Time
+}
+
+func NewCachingProvider(name string, provider SecretProvider, ttl time.Duration) *CachingProvider {
+	return &CachingProvider{name: name, provider: provider, ttl: ttl, entries: map[string]cachedSecret{}, now: time.Now}
+}
+
+func (provider *CachingProvider) GetSecret(ctx context.Context, secretPath string, key string) (string, error) {
+	cacheKey := secretPath + "#" + key
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+	if entry, ok := provider.entries[cacheKey]; ok && provider.now().Before(entry.expiresAt) {
+		return entry.value, nil
+	}
+	value, err := provider.provider.GetSecret(ctx, secretPath, key)
+	if err != nil {
+		return "", err
+	}
+	RedactSecret(fmt.Sprintf("secret %s of %s provider", cacheKey, provider.name), value)
+	if provider.ttl > 0 {
+		provider.entries[cacheKey] = cachedSecret{value: value, expiresAt: provider.now().Add(provider.ttl)}
+	}
+	return value, nil
+}
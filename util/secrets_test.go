@@ -0,0 +1,128 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newVaultServer stands in for a vault dev server with a single KV secret
+func newVaultServer(t *testing.T, kvVersion int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "dev-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		data := map[string]any{"password": "s3cr3t-value"}
+		expectedPath := "/v1/secret/apps/db"
+		var body any = map[string]any{"data": data}
+		if kvVersion == 2 {
+			expectedPath = "/v1/secret/data/apps/db"
+			body = map[string]any{"data": map[string]any{"data": data, "metadata": map[string]any{"version": 1}}}
+		}
+		if r.URL.Path != expectedPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+}
+
+func TestVaultProvider(t *testing.T) {
+	for _, kvVersion := range []int{1, 2} {
+		server := newVaultServer(t, kvVersion)
+		defer server.Close()
+		provider, err := NewVaultProvider(&SecretProviderConfig{Address: server.URL, Token: "dev-token", KVVersion: kvVersion})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		value, err := provider.GetSecret(context.Background(), "apps/db", "password")
+		if err != nil {
+			t.Fatalf("kv v%d: unexpected error: %s", kvVersion, err)
+		}
+		if value != "s3cr3t-value" {
+			t.Errorf("kv v%d: unexpected value %q", kvVersion, value)
+		}
+		_, err = provider.GetSecret(context.Background(), "apps/db", "username")
+		if err == nil {
+			t.Errorf("kv v%d: expected an error for a missing key", kvVersion)
+		}
+		_, err = provider.GetSecret(context.Background(), "apps/missing", "password")
+		if err == nil {
+			t.Errorf("kv v%d: expected an error for a missing secret", kvVersion)
+		}
+	}
+}
+
+func TestFileProvider(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "token"), []byte("abcd1234\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "db.yaml"), []byte("password: hunter22\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &FileProvider{dir: dir}
+	if value, err := provider.GetSecret(context.Background(), "token", ""); err != nil || value != "abcd1234" {
+		t.Errorf("unexpected value %q, error %v", value, err)
+	}
+	if value, err := provider.GetSecret(context.Background(), "db.yaml", "password"); err != nil || value != "hunter22" {
+		t.Errorf("unexpected value %q, error %v", value, err)
+	}
+	if _, err := provider.GetSecret(context.Background(), "../etc/passwd", ""); err == nil {
+		t.Errorf("expected an error for a file outside of the directory")
+	}
+}
+
+func TestEnvProvider(t *testing.T) {
+	t.Setenv("DB_PASSWORD", "hunter22")
+	t.Setenv("HOME_SECRET", "other")
+	provider := &EnvProvider{allowed: []string{"DB_PASSWORD"}}
+	if value, err := provider.GetSecret(context.Background(), "DB_PASSWORD", ""); err != nil || value != "hunter22" {
+		t.Errorf("unexpected value %q, error %v", value, err)
+	}
+	if _, err := provider.GetSecret(context.Background(), "HOME_SECRET", ""); err == nil {
+		t.Errorf("expected an error for a variable that is not allowed")
+	}
+}
+
+type countingProvider struct {
+	calls int
+}
+
+func (provider *countingProvider) GetSecret(ctx context.Context, path string, key string) (string, error) {
+	provider.calls++
+	return "cached-" + path, nil
+}
+
+// Secrets are cached for the ttl and redacted from logs
+func TestCachingProvider(t *testing.T) {
+	counting := &countingProvider{}
+	now := time.Now()
+	provider := NewCachingProvider("counting", counting, time.Minute)
+	provider.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		if _, err := provider.GetSecret(context.Background(), "db", ""); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if counting.calls != 1 {
+		t.Errorf("expected the secret to be cached, got %d calls", counting.calls)
+	}
+	now = now.Add(2 * time.Minute)
+	provider.GetSecret(context.Background(), "db", "")
+	if counting.calls != 2 {
+		t.Errorf("expected the cached secret to expire, got %d calls", counting.calls)
+	}
+	if redacted := Redact("password is cached-db"); strings.Contains(redacted, "cached-db") {
+		t.Errorf("expected secret to be redacted, got %q", redacted)
+	}
+}
@@ -1,29 +1,362 @@
 package util
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
-	"github.com/getsops/sops/v3/decrypt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/aes"
+	sopsage "github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/cmd/sops/common"
+	"github.com/getsops/sops/v3/cmd/sops/formats"
+	sopsconfig "github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/keyservice"
+	"github.com/goccy/go-yaml"
 )
 
-func DecryptFile(filepath string) (err error) {
-	format := getFileFormat(filepath)
-	textBytes, err := decrypt.File(filepath, format)
+// ErrNotSopsFile is returned when decrypting a file without sops metadata
+var ErrNotSopsFile = errors.New("not a sops encrypted file")
+
+// formats of sops files, and policies for files without sops metadata
+var (
+	SopsFormats           = []string{"yaml", "json", "ini", "dotenv", "binary"}
+	SopsPlaintextPolicies = []string{"fail", "skip"}
+)
+
+// SopsKeys is the key material a stack may decrypt its sops files with.
+// When no key file is set, sops reads the keys from the process environment
+type SopsKeys struct {
+	AgeKeyFile string
+	GPGKeyFile string
+	// decrypt with the key files only, never with the
+	// keys of the environment, even if none is set
+	KeyFilesOnly bool
+}
+
+func (keys SopsKeys) isSet() bool {
+	return keys.AgeKeyFile != "" || keys.GPGKeyFile != ""
+}
+
+// ValidateSopsKeyFiles checks that the key files of a repo or stack are
+// among keyFiles, the ones the operator allows repos and stacks to use
+func ValidateSopsKeyFiles(keyFiles []string, keys SopsKeys) error {
+	for _, keyFile := range []string{keys.AgeKeyFile, keys.GPGKeyFile} {
+		if keyFile == "" {
+			continue
+		}
+		allowed := slices.ContainsFunc(keyFiles, func(allowedKeyFile string) bool {
+			return filepath.Clean(allowedKeyFile) == filepath.Clean(keyFile)
+		})
+		if !allowed {
+			return fmt.Errorf("sops key file %s is not listed in sops_key_files", keyFile)
+		}
+	}
+	return nil
+}
+
+// DecryptFileContents decrypts a sops file without writing it. The format
+// is detected from the sops metadata in the file when it is empty
+func DecryptFileContents(filepath string, format string, keys SopsKeys) ([]byte, error) {
+	encryptedData, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the file %s: %w", filepath, err)
+	}
+	return DecryptData(filepath, encryptedData, format, keys)
+}
+
+// DecryptData decrypts the contents of a sops file in memory,
+// filepath is used to detect the format and in errors
+func DecryptData(filepath string, encryptedData []byte, format string, keys SopsKeys) ([]byte, error) {
+	if format == "" {
+		var ok bool
+		format, ok = detectSopsFormat(filepath, encryptedData)
+		if !ok {
+			return nil, fmt.Errorf("could not decrypt the file %s: %w", filepath, ErrNotSopsFile)
+		}
+	}
+	textBytes, decryptedValues, err := decryptData(encryptedData, format, keys)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt the file %s: %w", filepath, err)
+	}
+	RedactSecret("sops file "+filepath, decryptedValues...)
+	return textBytes, nil
+}
+
+// RedactData returns the plaintext of a sops file with every value sops
+// encrypted replaced by RedactedValue, however short, without decrypting it
+func RedactData(filepath string, encryptedData []byte, format string) ([]byte, error) {
+	if format == "" {
+		var ok bool
+		format, ok = detectSopsFormat(filepath, encryptedData)
+		if !ok {
+			return nil, fmt.Errorf("could not redact the file %s: %w", filepath, ErrNotSopsFile)
+		}
+	}
+	store := common.StoreForFormat(formats.FormatFromString(format), sopsconfig.NewStoresConfig())
+	tree, err := store.LoadEncryptedFile(encryptedData)
+	if err != nil {
+		return nil, fmt.Errorf("could not redact the file %s: %w", filepath, err)
+	}
+	for _, branch := range tree.Branches {
+		redactEncryptedValues(branch)
+	}
+	return store.EmitPlainFile(tree.Branches)
+}
+
+// redactEncryptedValues replaces the encrypted values of a sops tree in place
+func redactEncryptedValues(value any) any {
+	switch value := value.(type) {
+	case sops.TreeBranch:
+		for i := range value {
+			value[i].Value = redactEncryptedValues(value[i].Value)
+		}
+	case []any:
+		for i := range value {
+			value[i] = redactEncryptedValues(value[i])
+		}
+	case string:
+		if strings.HasPrefix(value, "ENC[") {
+			return RedactedValue
+		}
+	}
+	return value
+}
+
+// IsSopsEncrypted reports whether the contents of a file have sops metadata
+func IsSopsEncrypted(filepath string, data []byte) bool {
+	_, ok := detectSopsFormat(filepath, data)
+	return ok
+}
+
+// decryptData does what decrypt.Data does, except that the data key is
+// decrypted by a key service that only knows the given keys, if any.
+// The values sops decrypted are returned as well
+func decryptData(encryptedData []byte, format string, keys SopsKeys) ([]byte, []string, error) {
+	keyServices := []keyservice.KeyServiceClient{keyservice.NewLocalClient()}
+	if keys.KeyFilesOnly && !keys.isSet() {
+		return nil, nil, fmt.Errorf("no sops_age_key_file or sops_gpg_key_file is set, and the keys of the environment can't be used once sops_key_files is set")
+	}
+	if keys.isSet() {
+		keyServer, err := newStackKeyServer(keys)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyServices = []keyservice.KeyServiceClient{keyservice.NewCustomLocalClient(keyServer)}
+	}
+	store := common.StoreForFormat(formats.FormatFromString(format), sopsconfig.NewStoresConfig())
+	tree, err := store.LoadEncryptedFile(encryptedData)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the tree is decrypted in place, the encrypted one tells
+	// which of its values sops encrypted
+	encryptedTree, err := store.LoadEncryptedFile(encryptedData)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := tree.Metadata.GetDataKeyWithKeyServices(keyServices, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	cipher := aes.NewCipher()
+	mac, err := tree.Decrypt(key, cipher)
 	if err != nil {
-		return fmt.Errorf("could not decrypt the file %s: %w", filepath, err)
+		return nil, nil, err
 	}
-	file, err := os.Create(filepath)
+	originalMac, err := cipher.Decrypt(
+		tree.Metadata.MessageAuthenticationCode,
+		key,
+		tree.Metadata.LastModified.Format(time.RFC3339),
+	)
 	if err != nil {
-		return fmt.Errorf("could not open the file %s: %w", filepath, err)
+		return nil, nil, fmt.Errorf("could not decrypt the original mac: %w", err)
 	}
-	defer file.Close()
-	_, err = file.Write(textBytes)
+	if originalMac != mac {
+		return nil, nil, fmt.Errorf("could not verify data integrity, expected mac %q, got %q", originalMac, mac)
+	}
+	var values []string
+	for i := range tree.Branches {
+		values = decryptedValues(encryptedTree.Branches[i], tree.Branches[i], values)
+	}
+	textBytes, err := store.EmitPlainFile(tree.Branches)
+	return textBytes, values, err
+}
+
+// decryptedValues appends the values of a decrypted sops tree
+// whose counterparts in the encrypted tree sops encrypted
+func decryptedValues(encrypted any, decrypted any, values []string) []string {
+	switch encrypted := encrypted.(type) {
+	case sops.TreeBranch:
+		decrypted, ok := decrypted.(sops.TreeBranch)
+		if !ok {
+			return values
+		}
+		for i := 0; i < len(encrypted) && i < len(decrypted); i++ {
+			values = decryptedValues(encrypted[i].Value, decrypted[i].Value, values)
+		}
+	case []any:
+		decrypted, ok := decrypted.([]any)
+		if !ok {
+			return values
+		}
+		for i := 0; i < len(encrypted) && i < len(decrypted); i++ {
+			values = decryptedValues(encrypted[i], decrypted[i], values)
+		}
+	case string:
+		if strings.HasPrefix(encrypted, "ENC[") {
+			values = append(values, fmt.Sprint(decrypted))
+		}
+	}
+	return values
+}
+
+// stackKeyServer decrypts sops data keys with the age identities and gpg
+// keys it was created with only. Unlike the default sops key service,
+// it never falls back to the keys of the environment or the gpg agent
+type stackKeyServer struct {
+	ageIdentities sopsage.ParsedIdentities
+	gpgKeyRing    openpgp.EntityList
+}
+
+func newStackKeyServer(keys SopsKeys) (*stackKeyServer, error) {
+	keyServer := &stackKeyServer{}
+	if keys.AgeKeyFile != "" {
+		ageKeys, err := os.ReadFile(keys.AgeKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read age key file %s: %w", keys.AgeKeyFile, err)
+		}
+		err = keyServer.ageIdentities.Import(string(ageKeys))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse age key file %s: %w", keys.AgeKeyFile, err)
+		}
+	}
+	if keys.GPGKeyFile != "" {
+		gpgKeys, err := os.ReadFile(keys.GPGKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read gpg key file %s: %w", keys.GPGKeyFile, err)
+		}
+		keyServer.gpgKeyRing, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(gpgKeys))
+		if err != nil {
+			// binary key rings are not armored
+			keyServer.gpgKeyRing, err = openpgp.ReadKeyRing(bytes.NewReader(gpgKeys))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse gpg key file %s: %w", keys.GPGKeyFile, err)
+		}
+	}
+	return keyServer, nil
+}
+
+func (keyServer *stackKeyServer) Decrypt(ctx context.Context, req *keyservice.DecryptRequest) (*keyservice.DecryptResponse, error) {
+	var plaintext []byte
+	var err error
+	switch key := req.Key.KeyType.(type) {
+	case *keyservice.Key_AgeKey:
+		plaintext, err = keyServer.decryptWithAge(req.Ciphertext)
+	case *keyservice.Key_PgpKey:
+		plaintext, err = keyServer.decryptWithGPG(req.Ciphertext)
+	default:
+		err = fmt.Errorf("%T keys are not supported with sops key files", key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &keyservice.DecryptResponse{Plaintext: plaintext}, nil
+}
+
+func (keyServer *stackKeyServer) Encrypt(ctx context.Context, req *keyservice.EncryptRequest) (*keyservice.EncryptResponse, error) {
+	return nil, fmt.Errorf("encryption is not supported")
+}
+
+func (keyServer *stackKeyServer) decryptWithAge(ciphertext []byte) ([]byte, error) {
+	// the age master key reads the identities from the
+	// environment when none are applied to it
+	if len(keyServer.ageIdentities) == 0 {
+		return nil, fmt.Errorf("no age key file is configured")
+	}
+	key := &sopsage.MasterKey{EncryptedKey: string(ciphertext)}
+	keyServer.ageIdentities.ApplyToMasterKey(key)
+	return key.Decrypt()
+}
+
+func (keyServer *stackKeyServer) decryptWithGPG(ciphertext []byte) ([]byte, error) {
+	if len(keyServer.gpgKeyRing) == 0 {
+		return nil, fmt.Errorf("no gpg key file is configured")
+	}
+	block, err := armor.Decode(bytes.NewReader(ciphertext))
 	if err != nil {
-		return fmt.Errorf("could not write the file %s: %w", filepath, err)
+		return nil, fmt.Errorf("could not decode the gpg encrypted data key: %w", err)
+	}
+	message, err := openpgp.ReadMessage(block.Body, keyServer.gpgKeyRing, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt the data key with the gpg key file: %w", err)
+	}
+	return io.ReadAll(message.UnverifiedBody)
+}
+
+// detectSopsFormat finds the format of a sops file from the metadata in its
+// contents. Binary files are stored like json files with a single data key,
+// the extension tells them apart
+func detectSopsFormat(filename string, data []byte) (string, bool) {
+	var jsonMap map[string]any
+	if json.Unmarshal(data, &jsonMap) == nil {
+		if !isSopsMetadata(jsonMap["sops"]) {
+			return "", false
+		}
+		if _, ok := jsonMap["data"]; ok && len(jsonMap) == 2 && getFileFormat(filename) != "json" {
+			return "binary", true
+		}
+		return "json", true
+	}
+	var yamlMap map[string]any
+	if yaml.Unmarshal(data, &yamlMap) == nil && isSopsMetadata(yamlMap["sops"]) {
+		return "yaml", true
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "[sops]" {
+			return "ini", true
+		}
+		if strings.HasPrefix(line, "sops_mac=") {
+			return "dotenv", true
+		}
+	}
+	return "", false
+}
+
+func isSopsMetadata(value any) bool {
+	metadata, ok := value.(map[string]any)
+	if !ok {
+		return false
+	}
+	_, ok = metadata["mac"]
+	return ok
+}
+
+// ValidateSopsOptions checks the plaintext policy and the format overrides of sops files
+func ValidateSopsOptions(plaintextPolicy string, formats map[string]string) error {
+	if plaintextPolicy != "" && !slices.Contains(SopsPlaintextPolicies, plaintextPolicy) {
+		return fmt.Errorf("sops_plaintext must be one of %s, got %q", strings.Join(SopsPlaintextPolicies, ", "), plaintextPolicy)
+	}
+	for file, format := range formats {
+		if !slices.Contains(SopsFormats, format) {
+			return fmt.Errorf("sops_formats: format of %s must be one of %s, got %q", file, strings.Join(SopsFormats, ", "), format)
+		}
 	}
-	return
+	return nil
 }
 
 func getFileFormat(filename string) string {
@@ -1,7 +1,15 @@
 package util
 
 import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"filippo.io/age"
+	sopsage "github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/keyservice"
 )
 
 func TestGetFileFormat(t *testing.T) {
@@ -64,3 +72,137 @@ func TestGetFileFormat(t *testing.T) {
 		})
 	}
 }
+
+// The stack key server decrypts with its own age key only,
+// and never with the one of the environment
+func TestStackKeyServer(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "age.key")
+	err = os.WriteFile(keyFile, []byte(identity.String()), 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	masterKey, err := sopsage.MasterKeyFromRecipient(identity.Recipient().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	err = masterKey.Encrypt([]byte("data key"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	request := &keyservice.DecryptRequest{
+		Key:        &keyservice.Key{KeyType: &keyservice.Key_AgeKey{AgeKey: &keyservice.AgeKey{Recipient: masterKey.Recipient}}},
+		Ciphertext: masterKey.EncryptedDataKey(),
+	}
+
+	keyServer, err := newStackKeyServer(SopsKeys{AgeKeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	response, err := keyServer.Decrypt(context.Background(), request)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(response.Plaintext) != "data key" {
+		t.Errorf("unexpected data key: %s", response.Plaintext)
+	}
+
+	t.Setenv(sopsage.SopsAgeKeyFileEnv, keyFile)
+	keyServer, err = newStackKeyServer(SopsKeys{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_, err = keyServer.Decrypt(context.Background(), request)
+	if err == nil {
+		t.Errorf("expected the key of the environment not to be used")
+	}
+}
+
+func TestDetectSopsFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		contents string
+		want     string
+		wantOk   bool
+	}{
+		{
+			name:     "yaml with another extension",
+			filename: "/path/to/secret.yml.enc",
+			contents: "password: ENC[AES256_GCM,data:abc,type:str]\nsops:\n    mac: ENC[AES256_GCM,data:abc,type:str]\n    version: 3.9.0\n",
+			want:     "yaml",
+			wantOk:   true,
+		},
+		{
+			name:     "json",
+			filename: "/path/to/secret.txt",
+			contents: `{"password": "ENC[AES256_GCM,data:abc,type:str]", "sops": {"mac": "ENC[AES256_GCM,data:abc,type:str]"}}`,
+			want:     "json",
+			wantOk:   true,
+		},
+		{
+			name:     "binary",
+			filename: "/path/to/secret.txt",
+			contents: `{"data": "ENC[AES256_GCM,data:abc,type:str]", "sops": {"mac": "ENC[AES256_GCM,data:abc,type:str]"}}`,
+			want:     "binary",
+			wantOk:   true,
+		},
+		{
+			name:     "json with a single data key",
+			filename: "/path/to/secret.json",
+			contents: `{"data": "ENC[AES256_GCM,data:abc,type:str]", "sops": {"mac": "ENC[AES256_GCM,data:abc,type:str]"}}`,
+			want:     "json",
+			wantOk:   true,
+		},
+		{
+			name:     "ini",
+			filename: "/path/to/secret",
+			contents: "[db]\npassword = ENC[AES256_GCM,data:abc,type:str]\n\n[sops]\nmac = ENC[AES256_GCM,data:abc,type:str]\n",
+			want:     "ini",
+			wantOk:   true,
+		},
+		{
+			name:     "dotenv",
+			filename: "/path/to/secret",
+			contents: "PASSWORD=ENC[AES256_GCM,data:abc,type:str]\nsops_mac=ENC[AES256_GCM,data:abc,type:str]\n",
+			want:     "dotenv",
+			wantOk:   true,
+		},
+		{
+			name:     "plain yaml",
+			filename: "/path/to/secret.yaml",
+			contents: "password: hunter2\n",
+			wantOk:   false,
+		},
+		{
+			name:     "plain text",
+			filename: "/path/to/secret.txt",
+			contents: "hunter2",
+			wantOk:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := detectSopsFormat(tt.filename, []byte(tt.contents))
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("detectSopsFormat() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+// Files without sops metadata are reported as such
+func TestDecryptPlaintextFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secret.yaml")
+	err := os.WriteFile(file, []byte("password: hunter2\n"), 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_, err = DecryptFileContents(file, "", SopsKeys{})
+	if !errors.Is(err, ErrNotSopsFile) {
+		t.Errorf("expected ErrNotSopsFile, got %v", err)
+	}
+}
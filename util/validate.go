@@ -0,0 +1,270 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// ValidateConfigFiles reads the configuration files like ReadConfigs, but
+// rejects unknown keys and reports every problem found instead of the first
+func ValidateConfigFiles() []error {
+	var problems []error
+	strict := func(decoderConfig *mapstructure.DecoderConfig) {
+		decoderConfig.ErrorUnused = true
+	}
+	for _, fileError := range readConfigFiles(&Config{}, strict) {
+		problems = append(problems, decodingProblems(fileError.description, fileError.err)...)
+	}
+	// strict decoding drops the entries with unknown keys,
+	// decode again to check the rest of their options
+	configs := &Config{}
+	readConfigFiles(configs)
+	return append(problems, validateConfigs(configs)...)
+}
+
+// decodingProblems splits the errors of all fields that could not be decoded
+func decodingProblems(file string, err error) []error {
+	var decodingError *mapstructure.Error
+	if !errors.As(err, &decodingError) {
+		return []error{fmt.Errorf("could not read %s: %w", file, err)}
+	}
+	problems := make([]error, 0, len(decodingError.Errors))
+	for _, message := range decodingError.Errors {
+		problems = append(problems, fmt.Errorf("invalid %s: %s", file, message))
+	}
+	return problems
+}
+
+// validateConfigs checks the options of the repos, stacks
+// and generators and the references between them
+func validateConfigs(configs *Config) []error {
+	var problems []error
+	if _, err := ParseSyncWindows(configs.SyncWindows); err != nil {
+		problems = append(problems, fmt.Errorf("invalid configuration: %w", err))
+	}
+	if err := ValidateSopsOptions(configs.SopsPlaintext, nil); err != nil {
+		problems = append(problems, fmt.Errorf("invalid configuration: %w", err))
+	}
+	if err := configs.Timeouts.validate(); err != nil {
+		problems = append(problems, fmt.Errorf("invalid configuration: %w", err))
+	}
+	if configs.InstanceName == "" {
+		problems = append(problems, fmt.Errorf("invalid configuration: instance_name must not be empty"))
+	}
+	if configs.Workers < 1 {
+		problems = append(problems, fmt.Errorf("invalid configuration: workers must be at least 1"))
+	}
+
+	for _, repo := range sortedKeys(configs.RepoConfigs) {
+		repoConfig := configs.RepoConfigs[repo]
+		if repoConfig.Url == "" {
+			problems = append(problems, fmt.Errorf("repo %s: url is required", repo))
+		}
+		problems = append(problems, validateCredentials(repo, "", repoConfig.Username, repoConfig.Password, repoConfig.PasswordFile)...)
+		problems = append(problems, validateCredentials(repo, "push_", repoConfig.PushUsername, repoConfig.PushPassword, repoConfig.PushPasswordFile)...)
+		for _, registry := range repoConfig.Registries {
+			if _, ok := configs.Registries[registry]; !ok {
+				problems = append(problems, fmt.Errorf("repo %s: no such registry %q", repo, registry))
+			}
+		}
+		repoKeys := SopsKeys{AgeKeyFile: repoConfig.SopsAgeKeyFile, GPGKeyFile: repoConfig.SopsGPGKeyFile}
+		if err := ValidateSopsKeyFiles(configs.SopsKeyFiles, repoKeys); err != nil {
+			problems = append(problems, fmt.Errorf("repo %s: %w", repo, err))
+		}
+	}
+
+	for _, stack := range sortedKeys(configs.StackConfigs) {
+		for _, problem := range validateStackConfig(configs, configs.StackConfigs[stack]) {
+			problems = append(problems, fmt.Errorf("stack %s: %w", stack, problem))
+		}
+	}
+	if err := validateStackDependencies(configs.StackConfigs); err != nil {
+		problems = append(problems, err)
+	}
+
+	for _, generator := range sortedKeys(configs.GeneratorConfigs) {
+		generatorConfig := configs.GeneratorConfigs[generator]
+		if _, ok := configs.RepoConfigs[generatorConfig.Repo]; !ok {
+			problems = append(problems, fmt.Errorf("generator %s: no such repo %q", generator, generatorConfig.Repo))
+		}
+		if generatorConfig.Glob == "" {
+			problems = append(problems, fmt.Errorf("generator %s: glob is required", generator))
+		} else if _, err := filepath.Match(generatorConfig.Glob, ""); err != nil {
+			problems = append(problems, fmt.Errorf("generator %s: invalid glob %q: %w", generator, generatorConfig.Glob, err))
+		}
+		for _, problem := range validateStackOptions(configs, &generatorConfig.Template.StackConfig) {
+			problems = append(problems, fmt.Errorf("generator %s: %w", generator, problem))
+		}
+	}
+
+	for _, provider := range sortedKeys(configs.SecretProviders) {
+		providerConfig := configs.SecretProviders[provider]
+		switch {
+		case providerConfig.Type != "vault" && providerConfig.Type != "file" && providerConfig.Type != "env":
+			problems = append(problems, fmt.Errorf("secret provider %s: type must be vault, file or env, got %q", provider, providerConfig.Type))
+		case providerConfig.Type == "vault" && providerConfig.Address == "":
+			problems = append(problems, fmt.Errorf("secret provider %s: address is required", provider))
+		case providerConfig.Type == "file" && providerConfig.Path == "":
+			problems = append(problems, fmt.Errorf("secret provider %s: path is required", provider))
+		}
+		for _, grants := range []map[string][]string{providerConfig.Stacks, providerConfig.Repos} {
+			for _, name := range sortedKeys(grants) {
+				for _, pattern := range grants[name] {
+					if _, err := path.Match(pattern, ""); err != nil {
+						problems = append(problems, fmt.Errorf("secret provider %s: invalid path pattern %q of %s: %w", provider, pattern, name, err))
+					}
+				}
+			}
+		}
+	}
+
+	for _, cluster := range sortedKeys(configs.Clusters) {
+		clusterConfig := configs.Clusters[cluster]
+		if clusterConfig.Host != "" && clusterConfig.Context != "" {
+			problems = append(problems, fmt.Errorf("cluster %s: host and context are mutually exclusive", cluster))
+		}
+		if clusterConfig.Host == "" && clusterConfig.Context == "" {
+			problems = append(problems, fmt.Errorf("cluster %s: one of host or context is required", cluster))
+		}
+		hasTLS := clusterConfig.TLSVerify || clusterConfig.TLSCACert != "" || clusterConfig.TLSCert != "" || clusterConfig.TLSKey != ""
+		if hasTLS && clusterConfig.Host == "" {
+			problems = append(problems, fmt.Errorf("cluster %s: tls options require a host", cluster))
+		}
+		if (clusterConfig.TLSCert == "") != (clusterConfig.TLSKey == "") {
+			problems = append(problems, fmt.Errorf("cluster %s: tls_cert and tls_key must be set together", cluster))
+		}
+	}
+
+	for _, registry := range sortedKeys(configs.Registries) {
+		registryConfig := configs.Registries[registry]
+		if registryConfig.Address == "" {
+			problems = append(problems, fmt.Errorf("registry %s: address is required", registry))
+		}
+		switch {
+		case registryConfig.PasswordFile != "" && registryConfig.CredentialHelper != "":
+			problems = append(problems, fmt.Errorf("registry %s: password_file and credential_helper are mutually exclusive", registry))
+		case registryConfig.PasswordFile == "" && registryConfig.CredentialHelper == "":
+			problems = append(problems, fmt.Errorf("registry %s: one of password_file or credential_helper is required", registry))
+		case registryConfig.PasswordFile != "" && registryConfig.Username == "":
+			problems = append(problems, fmt.Errorf("registry %s: username is required with a password_file", registry))
+		}
+	}
+
+	if configs.APIToken != "" && configs.APITokenFile != "" {
+		problems = append(problems, fmt.Errorf("invalid configuration: api_token and api_token_file are mutually exclusive"))
+	}
+
+	if configs.LeaderElection.Enabled && configs.LeaderElection.LeaseDuration < minLeaseDuration {
+		problems = append(problems, fmt.Errorf("leader_election: lease_duration must be at least %d seconds", minLeaseDuration))
+	}
+
+	if configs.StacksSource != nil {
+		if _, ok := configs.RepoConfigs[configs.StacksSource.Repo]; !ok {
+			problems = append(problems, fmt.Errorf("stacks_source: no such repo %q", configs.StacksSource.Repo))
+		}
+		if configs.StacksSource.StacksFile == "" {
+			problems = append(problems, fmt.Errorf("stacks_source: stacks_file is required"))
+		}
+		for _, keyFile := range configs.StacksSource.SopsKeyFiles {
+			if err := ValidateSopsKeyFiles(configs.SopsKeyFiles, SopsKeys{AgeKeyFile: keyFile}); err != nil {
+				problems = append(problems, fmt.Errorf("stacks_source: %w", err))
+			}
+		}
+		for _, registry := range configs.StacksSource.Registries {
+			if _, ok := configs.Registries[registry]; !ok {
+				problems = append(problems, fmt.Errorf("stacks_source: no such registry %q", registry))
+			}
+		}
+	}
+	return problems
+}
+
+func validateStackConfig(configs *Config, stackConfig *StackConfig) []error {
+	var problems []error
+	if _, ok := configs.RepoConfigs[stackConfig.Repo]; !ok {
+		problems = append(problems, fmt.Errorf("no such repo %q", stackConfig.Repo))
+	}
+	if stackConfig.ComposeFile == "" {
+		problems = append(problems, fmt.Errorf("compose_file is required"))
+	}
+	return append(problems, validateStackOptions(configs, stackConfig)...)
+}
+
+// validateStackOptions checks the options shared by stacks and generated stacks
+func validateStackOptions(configs *Config, stackConfig *StackConfig) []error {
+	var problems []error
+	if len(stackConfig.SopsFiles) > 0 && (configs.SopsSecretsDiscovery || stackConfig.SopsSecretsDiscovery) {
+		problems = append(problems, fmt.Errorf("sops_files is ignored when sops_secrets_discovery is enabled"))
+	}
+	stackKeys := SopsKeys{AgeKeyFile: stackConfig.SopsAgeKeyFile, GPGKeyFile: stackConfig.SopsGPGKeyFile}
+	if err := ValidateSopsKeyFiles(configs.SopsKeyFiles, stackKeys); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := ParseSyncWindows(stackConfig.SyncWindows); err != nil {
+		problems = append(problems, err)
+	}
+	if stackConfig.SyncPolicy != "" && stackConfig.SyncPolicy != "auto" && stackConfig.SyncPolicy != "manual" {
+		problems = append(problems, fmt.Errorf("sync_policy must be auto or manual, got %q", stackConfig.SyncPolicy))
+	}
+	if stackConfig.Hooks.Timeout < 0 {
+		problems = append(problems, fmt.Errorf("hooks timeout must not be negative"))
+	}
+	if err := stackConfig.Timeouts.validate(); err != nil {
+		problems = append(problems, err)
+	}
+	if err := ValidateSopsOptions(stackConfig.SopsPlaintext, stackConfig.SopsFormats); err != nil {
+		problems = append(problems, err)
+	}
+	for _, registry := range stackConfig.Registries {
+		if _, ok := configs.Registries[registry]; !ok {
+			problems = append(problems, fmt.Errorf("no such registry %q", registry))
+		}
+	}
+	for i, cluster := range stackConfig.Cluster {
+		if _, ok := configs.Clusters[cluster]; !ok {
+			problems = append(problems, fmt.Errorf("no such cluster %q", cluster))
+		}
+		if slices.Contains(stackConfig.Cluster[:i], cluster) {
+			problems = append(problems, fmt.Errorf("cluster %q is listed more than once", cluster))
+		}
+	}
+	for _, imageUpdate := range stackConfig.ImageUpdates {
+		// file defaults to the compose file of the stack
+		if imageUpdate.Image == "" {
+			problems = append(problems, fmt.Errorf("image_updates entries require image"))
+		}
+	}
+	return problems
+}
+
+func validateCredentials(repo string, propertyPrefix string, username string, password string, passwordFile string) []error {
+	if username == "" && password == "" && passwordFile == "" {
+		return nil
+	}
+	var problems []error
+	if username == "" {
+		problems = append(problems, fmt.Errorf("repo %s: %susername is required with a password", repo, propertyPrefix))
+	}
+	if password == "" && passwordFile == "" {
+		problems = append(problems, fmt.Errorf("repo %s: one of %spassword or %spassword_file is required", repo, propertyPrefix, propertyPrefix))
+	}
+	if password != "" && passwordFile != "" {
+		problems = append(problems, fmt.Errorf("repo %s: %spassword and %spassword_file are mutually exclusive", repo, propertyPrefix, propertyPrefix))
+	}
+	return problems
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
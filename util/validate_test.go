@@ -0,0 +1,163 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateConfigs(t *testing.T) {
+	configs := &Config{
+		InstanceName:         "swarm-cd",
+		Workers:              4,
+		SopsSecretsDiscovery: true,
+		RepoConfigs: map[string]*RepoConfig{
+			"example": {Url: "https://example.com/repo.git", Username: "me"},
+		},
+		StackConfigs: map[string]*StackConfig{
+			"nginx": {Repo: "example", ComposeFile: "nginx/compose.yaml", SopsFiles: []string{"secrets.yaml"}},
+			"api":   {Repo: "missing", SyncPolicy: "sometimes"},
+		},
+		GeneratorConfigs: map[string]*GeneratorConfig{
+			"apps": {Repo: "example", Glob: "stacks/[/compose.yaml"},
+		},
+	}
+	expected := []string{
+		"repo example: one of password or password_file is required",
+		`stack api: no such repo "missing"`,
+		"stack api: compose_file is required",
+		`stack api: sync_policy must be auto or manual, got "sometimes"`,
+		"stack nginx: sops_files is ignored when sops_secrets_discovery is enabled",
+		`generator apps: invalid glob "stacks/[/compose.yaml"`,
+	}
+	problems := validateConfigs(configs)
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), problems)
+	}
+	for i, problem := range problems {
+		if !strings.HasPrefix(problem.Error(), expected[i]) {
+			t.Errorf("expected %q, got %q", expected[i], problem)
+		}
+	}
+}
+
+func TestValidateValidConfigs(t *testing.T) {
+	configs := &Config{
+		InstanceName: "swarm-cd",
+		Workers:      4,
+		RepoConfigs: map[string]*RepoConfig{
+			"example": {Url: "https://example.com/repo.git", Username: "me", PasswordFile: "/run/secrets/password"},
+		},
+		StackConfigs: map[string]*StackConfig{
+			"nginx": {Repo: "example", ComposeFile: "nginx/compose.yaml", SopsFiles: []string{"secrets.yaml"}},
+			// file defaults to the compose file
+			"api": {Repo: "example", ComposeFile: "api/compose.yaml", ImageUpdates: []ImageUpdateConfig{{Image: "example/api"}}},
+		},
+	}
+	if problems := validateConfigs(configs); len(problems) != 0 {
+		t.Errorf("unexpected problems: %v", problems)
+	}
+}
+
+func TestValidateClusters(t *testing.T) {
+	configs := &Config{
+		InstanceName: "swarm-cd",
+		Workers:      4,
+		RepoConfigs: map[string]*RepoConfig{
+			"example": {Url: "https://example.com/repo.git"},
+		},
+		Clusters: map[string]*ClusterConfig{
+			"prod":    {Host: "tcp://prod:2376", TLSVerify: true, TLSCACert: "ca.pem", TLSCert: "cert.pem"},
+			"staging": {Context: "staging", TLSVerify: true},
+		},
+		StackConfigs: map[string]*StackConfig{
+			"nginx": {Repo: "example", ComposeFile: "nginx/compose.yaml", Cluster: []string{"prod", "dev", "prod"}},
+		},
+	}
+	expected := []string{
+		`stack nginx: no such cluster "dev"`,
+		`stack nginx: cluster "prod" is listed more than once`,
+		"cluster prod: tls_cert and tls_key must be set together",
+		"cluster staging: tls options require a host",
+	}
+	problems := validateConfigs(configs)
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), problems)
+	}
+	for i, problem := range problems {
+		if !strings.HasPrefix(problem.Error(), expected[i]) {
+			t.Errorf("expected %q, got %q", expected[i], problem)
+		}
+	}
+}
+
+func TestValidateRegistries(t *testing.T) {
+	configs := &Config{
+		InstanceName: "swarm-cd",
+		Workers:      4,
+		RepoConfigs: map[string]*RepoConfig{
+			"example": {Url: "https://example.com/repo.git", Registries: []string{"ghcr"}},
+		},
+		Registries: map[string]*RegistryConfig{
+			"ghcr": {Address: "ghcr.io", PasswordFile: "/run/secrets/ghcr"},
+			"ecr":  {CredentialHelper: "ecr-login", PasswordFile: "/run/secrets/ecr"},
+		},
+		StackConfigs: map[string]*StackConfig{
+			"nginx": {Repo: "example", ComposeFile: "nginx/compose.yaml", Registries: []string{"quay"}},
+		},
+	}
+	expected := []string{
+		`stack nginx: no such registry "quay"`,
+		"registry ecr: address is required",
+		"registry ecr: password_file and credential_helper are mutually exclusive",
+		"registry ghcr: username is required with a password_file",
+	}
+	problems := validateConfigs(configs)
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), problems)
+	}
+	for i, problem := range problems {
+		if !strings.HasPrefix(problem.Error(), expected[i]) {
+			t.Errorf("expected %q, got %q", expected[i], problem)
+		}
+	}
+}
+
+func TestValidateLeaderElection(t *testing.T) {
+	configs := &Config{InstanceName: "swarm-cd", Workers: 4, LeaderElection: LeaderElectionConfig{Enabled: true, LeaseDuration: 3}}
+	problems := validateConfigs(configs)
+	if len(problems) != 1 || problems[0].Error() != "leader_election: lease_duration must be at least 6 seconds" {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+	configs.LeaderElection.Enabled = false
+	if problems := validateConfigs(configs); len(problems) != 0 {
+		t.Fatalf("expected no problems when disabled, got %v", problems)
+	}
+}
+
+func TestValidateSopsKeyFiles(t *testing.T) {
+	configs := &Config{
+		InstanceName: "swarm-cd",
+		Workers:      4,
+		SopsKeyFiles: []string{"/secrets/team-a.key"},
+		RepoConfigs: map[string]*RepoConfig{
+			"team-a": {Url: "https://example.com/team-a.git", SopsAgeKeyFile: "/secrets/../secrets/team-a.key"},
+			"team-b": {Url: "https://example.com/team-b.git", SopsAgeKeyFile: "/secrets/team-b.key"},
+		},
+		StackConfigs: map[string]*StackConfig{
+			"app": {Repo: "team-a", ComposeFile: "compose.yaml", SopsGPGKeyFile: "/home/team-b/private.gpg"},
+		},
+	}
+	expected := []string{
+		"repo team-b: sops key file /secrets/team-b.key is not listed in sops_key_files",
+		"stack app: sops key file /home/team-b/private.gpg is not listed in sops_key_files",
+	}
+	problems := validateConfigs(configs)
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), problems)
+	}
+	for i, problem := range problems {
+		if problem.Error() != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], problem)
+		}
+	}
+}
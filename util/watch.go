@@ -0,0 +1,105 @@
+package util
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// names, without extension, of the configuration files that are watched
+var configFileNames = []string{"config", "repos", "stacks", "generators"}
+
+// editors and tools often write files in several steps,
+// wait for them to settle before reloading
+const configReloadDelay = time.Second
+
+// WatchConfigs calls onChange whenever one of the configuration files changes.
+// Directories are watched rather than files, so that files replaced
+// by renaming, like mounted configs and secrets, are picked up too
+func WatchConfigs(onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("could not watch configuration files: %w", err)
+	}
+	for _, dir := range watchedDirs() {
+		err = watcher.Add(dir)
+		if err != nil {
+			watcher.Close()
+			return fmt.Errorf("could not watch configuration files in %s: %w", dir, err)
+		}
+	}
+	go func() {
+		var lock sync.Mutex
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !isConfigFile(event.Name) {
+					continue
+				}
+				Logger.Debug("configuration file changed", "file", event.Name, "op", event.Op.String())
+				lock.Lock()
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(configReloadDelay, onChange)
+				lock.Unlock()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				Logger.Error(fmt.Sprintf("error watching configuration files: %s", err))
+			}
+		}
+	}()
+	return nil
+}
+
+func watchedDirs() []string {
+	dirs := []string{"."}
+	for _, file := range []string{ConfigFile, ReposFile, StacksFile, GeneratorsFile} {
+		if file != "" {
+			dirs = append(dirs, filepath.Dir(file))
+		}
+	}
+	if isDir(StacksDir) {
+		dirs = append(dirs, StacksDir)
+	}
+	watched := map[string]bool{}
+	var uniqueDirs []string
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if !watched[dir] {
+			watched[dir] = true
+			uniqueDirs = append(uniqueDirs, dir)
+		}
+	}
+	return uniqueDirs
+}
+
+func isConfigFile(path string) bool {
+	path = filepath.Clean(path)
+	if filepath.Dir(path) == filepath.Clean(StacksDir) {
+		return true
+	}
+	for _, file := range []string{ConfigFile, ReposFile, StacksFile, GeneratorsFile} {
+		if file != "" && path == filepath.Clean(file) {
+			return true
+		}
+	}
+	fileName := filepath.Base(path)
+	name := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	for _, configFileName := range configFileNames {
+		if name == configFileName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package util
+
+import "testing"
+
+func TestIsConfigFile(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"config.yaml":        true,
+		"./stacks.yml":       true,
+		"/app/repos.json":    true,
+		"generators.yaml":    true,
+		"stacks.yaml.swp":    false,
+		"values.yaml":        false,
+		"state.json":         false,
+		"repos/stacks/x.txt": false,
+	} {
+		if isConfigFile(path) != expected {
+			t.Errorf("isConfigFile(%q) should be %v", path, expected)
+		}
+	}
+}
+
+func TestIsConfigFileInConfiguredLocations(t *testing.T) {
+	defer func(configFile string, stacksDir string) {
+		ConfigFile, StacksDir = configFile, stacksDir
+	}(ConfigFile, StacksDir)
+	ConfigFile = "/etc/swarm-cd/swarm-cd.yaml"
+	StacksDir = "/etc/swarm-cd/stacks.d"
+	for path, expected := range map[string]bool{
+		"/etc/swarm-cd/swarm-cd.yaml":       true,
+		"/etc/swarm-cd/stacks.d/nginx.yaml": true,
+		"/etc/swarm-cd/other.yaml":          false,
+		"/etc/swarm-cd/stacks.d/sub/x.yaml": false,
+	} {
+		if isConfigFile(path) != expected {
+			t.Errorf("isConfigFile(%q) should be %v", path, expected)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package util
+
+import (
+	"fmt"
+	"time"
+)
+
+// SyncWindow allows or denies syncing for a duration
+// every time its schedule matches
+type SyncWindow struct {
+	Allow    bool
+	Schedule *CronSchedule
+	Duration time.Duration
+	Location *time.Location
+}
+
+func ParseSyncWindows(windowConfigs []SyncWindowConfig) ([]*SyncWindow, error) {
+	var windows []*SyncWindow
+	for i, windowConfig := range windowConfigs {
+		window := &SyncWindow{Location: time.Local}
+		switch windowConfig.Kind {
+		case "allow":
+			window.Allow = true
+		case "deny":
+			window.Allow = false
+		default:
+			return nil, fmt.Errorf("sync window %d: kind must be allow or deny, got %q", i, windowConfig.Kind)
+		}
+		var err error
+		window.Schedule, err = ParseCronSchedule(windowConfig.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("sync window %d: %w", i, err)
+		}
+		window.Duration, err = time.ParseDuration(windowConfig.Duration)
+		if err != nil || window.Duration <= 0 {
+			return nil, fmt.Errorf("sync window %d: invalid duration %q", i, windowConfig.Duration)
+		}
+		if windowConfig.Timezone != "" {
+			window.Location, err = time.LoadLocation(windowConfig.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("sync window %d: invalid timezone %q", i, windowConfig.Timezone)
+			}
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
@@ -1,26 +1,139 @@
 package web
 
 import (
+	"errors"
 	"net/http"
 	"sort"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/m-adawi/swarm-cd/swarmcd"
 )
 
+type syncRequest struct {
+	Revision string `json:"revision"`
+	Force    bool   `json:"force"`
+}
+
+type suspendRequest struct {
+	Reason string     `json:"reason"`
+	Until  *time.Time `json:"until"`
+}
+
 func getStacks(ctx *gin.Context) {
 	stacksStatus := swarmcd.GetStackStatus()
-	var stacks []map[string]string
+	var stacks []map[string]any
 	for k, v := range stacksStatus {
-		stacks = append(stacks, map[string]string{
-			"Name": k,
-			"Error": v.Error,
-			"RepoURL": v.RepoURL,
-			"Revision": v.Revision,
-		})
+		stacks = append(stacks, stackStatusResponse(k, v))
 	}
 	sort.Slice(stacks, func(i, j int) bool {
-		return stacks[i]["Name"] < stacks[j]["Name"]
+		return stacks[i]["Name"].(string) < stacks[j]["Name"].(string)
 	})
 	ctx.JSON(http.StatusOK, stacks)
-}
\ No newline at end of file
+}
+
+func syncStack(ctx *gin.Context) {
+	name := ctx.Param("name")
+	var request syncRequest
+	if ctx.Request.ContentLength != 0 {
+		if err := ctx.ShouldBindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+			return
+		}
+	}
+	err := swarmcd.SyncStack(name, request.Revision, request.Force)
+	switch {
+	case errors.Is(err, swarmcd.ErrStackNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"Error": err.Error()})
+	case errors.Is(err, swarmcd.ErrInvalidRevision):
+		ctx.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+	case errors.Is(err, swarmcd.ErrSyncBlocked), errors.Is(err, swarmcd.ErrRevisionMismatch), errors.Is(err, swarmcd.ErrStackSuspended), errors.Is(err, swarmcd.ErrSyncInProgress):
+		ctx.JSON(http.StatusConflict, gin.H{"Error": err.Error()})
+	case errors.Is(err, swarmcd.ErrNotLeader):
+		respondNotLeader(ctx, err)
+	case err != nil:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
+	default:
+		ctx.JSON(http.StatusOK, stackStatusResponse(name, swarmcd.GetStackStatus()[name]))
+	}
+}
+
+func suspendStack(ctx *gin.Context) {
+	request, ok := bindSuspendRequest(ctx)
+	if !ok {
+		return
+	}
+	respondToSuspension(ctx, swarmcd.SuspendStack(ctx.Param("name"), request.Reason, request.Until))
+}
+
+func resumeStack(ctx *gin.Context) {
+	respondToSuspension(ctx, swarmcd.ResumeStack(ctx.Param("name")))
+}
+
+func suspend(ctx *gin.Context) {
+	request, ok := bindSuspendRequest(ctx)
+	if !ok {
+		return
+	}
+	respondToSuspension(ctx, swarmcd.Suspend(request.Reason, request.Until))
+}
+
+func resume(ctx *gin.Context) {
+	respondToSuspension(ctx, swarmcd.Resume())
+}
+
+func bindSuspendRequest(ctx *gin.Context) (suspendRequest, bool) {
+	var request suspendRequest
+	if ctx.Request.ContentLength != 0 {
+		if err := ctx.ShouldBindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+			return request, false
+		}
+	}
+	if request.Until != nil && !request.Until.After(time.Now()) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"Error": "until must be in the future"})
+		return request, false
+	}
+	return request, true
+}
+
+func respondToSuspension(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, swarmcd.ErrStackNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"Error": err.Error()})
+	case errors.Is(err, swarmcd.ErrNotLeader):
+		respondNotLeader(ctx, err)
+	case err != nil:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
+	default:
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+// respondNotLeader rejects changes sent to a follower,
+// they have to be sent to the leader instead
+func respondNotLeader(ctx *gin.Context, err error) {
+	ctx.JSON(http.StatusServiceUnavailable, gin.H{"Error": err.Error(), "Leader": swarmcd.GetLeaderStatus().Leader})
+}
+
+func getLeader(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, swarmcd.GetLeaderStatus())
+}
+
+func stackStatusResponse(name string, status *swarmcd.StackStatus) map[string]any {
+	return map[string]any{
+		"Name":            name,
+		"Error":           status.Error,
+		"FailureReason":   status.FailureReason,
+		"RepoURL":         status.RepoURL,
+		"Cluster":         status.Cluster,
+		"Revision":        status.Revision,
+		"SyncStatus":      status.SyncStatus,
+		"PendingRevision": status.PendingRevision,
+		"Blocked":         status.Blocked,
+		"NextSyncWindow":  status.NextSyncWindow,
+		"Suspension":      status.Suspension,
+		"Drift":           status.Drift,
+		"Deployments":     status.Deployments,
+	}
+}
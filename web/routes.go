@@ -1,26 +1,60 @@
 package web
 
 import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
 	"github.com/gin-gonic/gin"
 	"github.com/m-adawi/swarm-cd/util"
 	"github.com/pkg/errors"
 	sloggin "github.com/samber/slog-gin"
 )
 
-var router *gin.Engine = gin.New()
-
-func init() {
+// newRouter is only called when serving, so that
+// subcommands don't print gin's debug output
+func newRouter(apiToken string) *gin.Engine {
+	router := gin.New()
 	router.Use(sloggin.New(util.Logger))
 	router.GET("/stacks", getStacks)
+	router.GET("/leader", getLeader)
+	// endpoints that change stacks require the api token
+	changes := router.Group("/", requireAPIToken(apiToken))
+	changes.POST("/stacks/:name/sync", syncStack)
+	changes.POST("/stacks/:name/suspend", suspendStack)
+	changes.POST("/stacks/:name/resume", resumeStack)
+	changes.POST("/suspend", suspend)
+	changes.POST("/resume", resume)
 	router.StaticFile("/ui", "ui/index.html")
 	router.Static("/assets", "ui/assets")
 	router.GET("/", func(c *gin.Context) {
 		c.Redirect(302, "/ui")
 	})
+	return router
+}
+
+// requireAPIToken rejects requests without the token as a bearer token.
+// Without a token, the endpoints are disabled
+func requireAPIToken(apiToken string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if apiToken == "" {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"Error": "changes through the API are disabled, set api_token or api_token_file to enable them"})
+			return
+		}
+		token, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) != 1 {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"Error": "missing or invalid api token"})
+			return
+		}
+		ctx.Next()
+	}
 }
 
-func RunServer(address string) error {
-	if err := router.Run(address); err != nil {
+// RunServer serves the API and the UI. Endpoints that change
+// stacks require apiToken, and are disabled if it is empty
+func RunServer(address string, apiToken string) error {
+	util.RedactSecret("api token", apiToken)
+	if err := newRouter(apiToken).Run(address); err != nil {
 		util.Logger.Error("router run", "address", address)
 		return errors.Wrap(err, "router run")
 	}